@@ -1,6 +1,7 @@
 package tftp
 
 import (
+	"math"
 	"math/rand"
 	"time"
 )
@@ -8,13 +9,30 @@ import (
 const (
 	defaultTimeout = 5 * time.Second
 	defaultRetries = 5
+	// defaultMaxWindow is the largest windowsize accepted by the server.
+	defaultMaxWindow = 64
+	// maxExponentialTimeout caps retransmission timeout growth.
+	maxExponentialTimeout = time.Minute
+)
+
+// DefaultTimeout and DefaultRetries are the timeout and the number of
+// retransmissions used by clients and servers created by NewClient and
+// NewServer, and restored by SetTimeout and SetRetries for invalid values.
+// Programs may change them before creating clients and servers to use
+// other defaults everywhere; the setters still override them per instance.
+var (
+	DefaultTimeout = defaultTimeout
+	DefaultRetries = defaultRetries
 )
 
 type backoffFunc func(int) time.Duration
 
 type backoff struct {
-	attempt int
-	handler backoffFunc
+	attempt     int
+	handler     backoffFunc
+	exponential bool
+	jitter      float64 // fraction of the timeout to vary it by
+	clock       clock
 }
 
 func (b *backoff) reset() {
@@ -25,11 +43,52 @@ func (b *backoff) count() int {
 	return b.attempt
 }
 
+// timeout returns time to wait for a reply to the current attempt. With
+// exponential timeout enabled it doubles with every attempt starting from
+// base up to maxExponentialTimeout (or base if it is larger). With jitter
+// set the result is randomly changed by up to that fraction.
+func (b *backoff) timeout(base time.Duration) time.Duration {
+	t := base
+	if b.exponential {
+		for i := 0; i < b.attempt && t < maxExponentialTimeout; i++ {
+			t *= 2
+		}
+		if t > maxExponentialTimeout && base < maxExponentialTimeout {
+			t = maxExponentialTimeout
+		}
+	}
+	if b.jitter > 0 {
+		t += time.Duration(float64(t) * b.jitter * (2*rand.Float64() - 1))
+	}
+	return t
+}
+
+// clampJitter limits jitter fraction to the range [0, 1).
+func clampJitter(fraction float64) float64 {
+	if fraction < 0 || math.IsNaN(fraction) {
+		return 0
+	}
+	if fraction >= 1 {
+		return 0.99
+	}
+	return fraction
+}
+
+// skip counts an attempt without waiting, for retransmissions the peer
+// asked for.
+func (b *backoff) skip() {
+	b.attempt++
+}
+
 func (b *backoff) backoff() {
+	c := b.clock
+	if c == nil {
+		c = realClock{}
+	}
 	if b.handler == nil {
-		time.Sleep(time.Duration(rand.Int63n(int64(time.Second))))
+		c.Sleep(time.Duration(rand.Int63n(int64(time.Second))))
 	} else {
-		time.Sleep(b.handler(b.attempt))
+		c.Sleep(b.handler(b.attempt))
 	}
 	b.attempt++
 }
@@ -0,0 +1,66 @@
+package tftp
+
+import (
+	"context"
+	"net"
+)
+
+// EnableBroadcast makes ListenAndServe bind its socket with SO_BROADCAST
+// and SO_REUSEADDR set, for clients that send their requests to a
+// broadcast address to discover a server. To receive such requests the
+// server must listen on the unspecified address, e.g. ":69". Replies are
+// always sent from a unicast address of the server.
+func (s *Server) EnableBroadcast() {
+	s.broadcast = true
+}
+
+// listenPacket binds the request socket of ListenAndServe.
+func (s *Server) listenPacket(addr *net.UDPAddr) (*net.UDPConn, error) {
+	if !s.broadcast {
+		return net.ListenUDP(s.listenNetwork(), addr)
+	}
+	lc := net.ListenConfig{Control: broadcastControl}
+	conn, err := lc.ListenPacket(context.Background(), s.listenNetwork(), addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// isBroadcast reports whether ip is the limited broadcast address or the
+// directed broadcast address of a network of a local interface.
+func isBroadcast(ip net.IP) bool {
+	ip = ip.To4()
+	if ip == nil {
+		return false
+	}
+	if ip.Equal(net.IPv4bcast) {
+		return true
+	}
+	if ip[3]&3 != 3 {
+		// Host bits of a broadcast address are all set.
+		return false
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || n.IP.To4() == nil || len(n.Mask) != net.IPv4len {
+			continue
+		}
+		if ones, _ := n.Mask.Size(); ones >= 31 {
+			// Point-to-point networks have no broadcast address.
+			continue
+		}
+		b := make(net.IP, net.IPv4len)
+		for i := range b {
+			b[i] = n.IP.To4()[i] | ^n.Mask[i]
+		}
+		if ip.Equal(b) {
+			return true
+		}
+	}
+	return false
+}
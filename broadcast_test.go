@@ -0,0 +1,158 @@
+package tftp
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsBroadcast(t *testing.T) {
+	for ip, expected := range map[string]bool{
+		"255.255.255.255": true,
+		"127.0.0.1":       false,
+		"0.0.0.0":         false,
+		"::1":             false,
+	} {
+		if isBroadcast(net.ParseIP(ip)) != expected {
+			t.Errorf("isBroadcast(%s) != %v", ip, expected)
+		}
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Skipf("interface addresses: %v", err)
+	}
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || n.IP.To4() == nil {
+			continue
+		}
+		if ones, _ := n.Mask.Size(); ones >= 31 {
+			continue
+		}
+		b := make(net.IP, net.IPv4len)
+		for i := range b {
+			b[i] = n.IP.To4()[i] | ^n.Mask[i]
+		}
+		if !isBroadcast(b) {
+			t.Errorf("broadcast address %v of %v is not detected", b, n)
+		}
+		if isBroadcast(n.IP) {
+			t.Errorf("interface address %v is taken for broadcast", n.IP)
+		}
+	}
+}
+
+// broadcastServer returns a server that sends the filename as the file
+// content. Results of transfers are sent to the channel returned.
+func broadcastServer(t *testing.T) (*Server, chan error) {
+	results := make(chan error, 1)
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		_, err := rf.ReadFrom(strings.NewReader(filename))
+		select {
+		case results <- err:
+		default:
+		}
+		return err
+	}, nil)
+	s.SetTimeout(500 * time.Millisecond)
+	s.SetRetries(1)
+	return s, results
+}
+
+func expectTransferDone(t *testing.T, results chan error) {
+	select {
+	case err := <-results:
+		if err != nil {
+			t.Errorf("transfer failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("transfer is not finished")
+	}
+}
+
+// checkUnicastReply checks the first DATA of a transfer started by a
+// broadcast request and completes the transfer.
+func checkUnicastReply(t *testing.T, p *rawPeer, reply []byte, addr *net.UDPAddr, filename string) {
+	if isBroadcast(addr.IP) || addr.IP.IsUnspecified() {
+		t.Errorf("reply from %v", addr)
+	}
+	if d := p.checkDATA(reply, 1); string(d[4:]) != filename {
+		t.Fatalf("DATA of %s expected, got %q", filename, d[4:])
+	}
+	p.send(NewACK(1).Pack(), addr)
+}
+
+func TestBroadcastRequest(t *testing.T) {
+	s, results := broadcastServer(t)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen UDP: %v", err)
+	}
+	go s.Serve(conn)
+	for s.Addr() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	defer s.Shutdown()
+
+	// Pretend the request was received on the limited broadcast address.
+	p := newRawPeer(t)
+	defer p.close()
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: p.conn.LocalAddr().(*net.UDPAddr).Port}
+	req := make([]byte, datagramLength)
+	n := packRQ(req, opRRQ, "discover", "octet", nil)
+	if err := s.handlePacket(net.IPv4bcast, peer, req, n, blockLength, nil); err != nil {
+		t.Fatalf("handling request: %v", err)
+	}
+	reply, addr := p.receive()
+	checkUnicastReply(t, p, reply, addr, "discover")
+	expectTransferDone(t, results)
+}
+
+func TestEnableBroadcast(t *testing.T) {
+	var bcast net.IP
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil && !n.IP.IsLoopback() {
+			if ones, _ := n.Mask.Size(); ones < 31 {
+				bcast = make(net.IP, net.IPv4len)
+				for i := range bcast {
+					bcast[i] = n.IP.To4()[i] | ^n.Mask[i]
+				}
+				break
+			}
+		}
+	}
+	if bcast == nil {
+		t.Skip("no interface with a broadcast address")
+	}
+	s, results := broadcastServer(t)
+	s.EnableBroadcast()
+	go s.ListenAndServe("0.0.0.0:0")
+	for s.Addr() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	defer s.Shutdown()
+
+	lc := net.ListenConfig{Control: broadcastControl}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", ":0")
+	if err != nil {
+		t.Fatalf("listen UDP: %v", err)
+	}
+	p := &rawPeer{t: t, conn: pc.(*net.UDPConn), buf: make([]byte, 65536)}
+	defer p.close()
+	req := make([]byte, datagramLength)
+	n := packRQ(req, opRRQ, "discover", "octet", nil)
+	if _, err := p.conn.WriteToUDP(req[:n], &net.UDPAddr{IP: bcast, Port: s.Addr().Port}); err != nil {
+		t.Skipf("broadcast is not supported: %v", err)
+	}
+	p.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, addr, err := p.conn.ReadFromUDP(p.buf)
+	if err != nil {
+		t.Skipf("broadcast is not delivered: %v", err)
+	}
+	checkUnicastReply(t, p, p.buf[:n], addr, "discover")
+	expectTransferDone(t, results)
+}
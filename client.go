@@ -1,10 +1,17 @@
 package tftp
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,28 +22,133 @@ func NewClient(addr string) (*Client, error) {
 		return nil, fmt.Errorf("resolving address %s: %v", addr, err)
 	}
 	return &Client{
-		addr:    a,
-		timeout: defaultTimeout,
-		retries: defaultRetries,
+		addr:       a,
+		timeout:    DefaultTimeout,
+		retries:    DefaultRetries,
+		reqRetries: -1,
+		clock:      realClock{},
 	}, nil
 }
 
 // SetTimeout sets maximum time client waits for single network round-trip to succeed.
-// Default is 5 seconds.
+// Default is DefaultTimeout, 5 seconds. Sub-second values are allowed, see RequestTimeout
+// for how they are sent to the server.
 func (c *Client) SetTimeout(t time.Duration) {
 	if t <= 0 {
-		c.timeout = defaultTimeout
+		c.timeout = DefaultTimeout
+	} else {
+		c.timeout = t
+	}
+}
+
+// Timeout returns the time client waits for single network round-trip.
+func (c *Client) Timeout() time.Duration {
+	return c.timeout
+}
+
+// SetTotalTimeout limits the time a whole transfer may take regardless of
+// retransmissions. A transfer that takes longer is aborted with
+// context.DeadlineExceeded error. Zero, the default, means no limit.
+func (c *Client) SetTotalTimeout(t time.Duration) {
+	c.totalTime = t
+}
+
+// SetDally sets the time the client waits after the final ACK of a
+// download to acknowledge the final block again if the server resends it
+// because the ACK was lost. WriteTo returns only once the period is over.
+// Zero, the default, disables it.
+func (c *Client) SetDally(d time.Duration) {
+	c.dally = d
+}
+
+// SetStrict makes transfers abort when the server breaks the protocol:
+// an OACK with options that were not requested is answered with error
+// code 8, a malformed packet or one not expected at that point of the
+// transfer with error code 4. Strict mode is off by default. An invalid
+// blksize value, or one larger than requested, is rejected with error
+// code 8 either way.
+func (c *Client) SetStrict(strict bool) {
+	c.strict = strict
+}
+
+// SetReadBuffer sets the size of the operating system receive buffer of
+// the sockets of transfers. Transfers fail to start if the size cannot be
+// set.
+func (c *Client) SetReadBuffer(bytes int) {
+	c.readBuf = bytes
+}
+
+// SetWriteBuffer sets the size of the operating system transmit buffer of
+// the sockets of transfers, see SetReadBuffer.
+func (c *Client) SetWriteBuffer(bytes int) {
+	c.writeBuf = bytes
+}
+
+// SetDSCP sets the DSCP value, 0 to 63, that marks the packets of
+// transfers for networks with QoS policies. Transfers fail to start if it
+// cannot be set. Zero, the default, leaves the system default.
+func (c *Client) SetDSCP(value int) {
+	c.dscp = value
+}
+
+// SetPortRange restricts the local ports of the sockets of transfers to
+// the range from min to max, e.g. to match firewall rules. A transfer
+// fails to start with ErrPortRangeExhausted if all ports of the range are
+// in use. Zero for both, the default, lets the system choose the port;
+// other invalid ranges are ignored.
+func (c *Client) SetPortRange(min, max int) {
+	if min == 0 && max == 0 || validPortRange(min, max) {
+		c.portMin, c.portMax = min, max
 	}
-	c.timeout = t
 }
 
 // SetRetries sets maximum number of attempts client made to transmit a packet.
-// Default is 5 attempts.
+// Default is DefaultRetries, 5 attempts. Zero disables retransmissions;
+// a negative count restores the default.
 func (c *Client) SetRetries(count int) {
-	if count < 1 {
-		c.retries = defaultRetries
+	if count < 0 {
+		c.retries = DefaultRetries
+	} else {
+		c.retries = count
+	}
+}
+
+// Retries returns maximum number of attempts client makes to transmit
+// a packet.
+func (c *Client) Retries() int {
+	return c.retries
+}
+
+// SetInitialRetries sets the number of retransmissions of the initial
+// request, which may need more patience than packets of a running
+// transfer, e.g. while the server is starting up. A negative count, the
+// default, means the value set with SetRetries is used. A request that is
+// not answered after them fails with ErrNoResponse.
+func (c *Client) SetInitialRetries(count int) {
+	c.reqRetries = count
+}
+
+// requestRetries returns the number of retransmissions of the request.
+func (c *Client) requestRetries() int {
+	if c.reqRetries < 0 {
+		return c.retries
 	}
-	c.retries = count
+	return c.reqRetries
+}
+
+// SetExponentialTimeout makes the client double the time it waits for
+// a reply with each retransmission of a packet, up to one minute. By
+// default the same timeout is used for all attempts.
+func (c *Client) SetExponentialTimeout(enabled bool) {
+	c.expTimeout = enabled
+}
+
+// SetJitter makes the client vary every retransmission timeout randomly
+// by up to fraction of it, e.g. 0.1 for ±10%, so that many clients started
+// at the same time do not retransmit in sync. Values are limited to the
+// range from 0, the default which disables jitter, to below 1.
+func (c *Client) SetJitter(fraction float64) {
+	c.jitter = clampJitter(fraction)
 }
 
 // SetBackoff sets a user provided function that is called to provide a
@@ -45,50 +157,228 @@ func (c *Client) SetBackoff(h backoffFunc) {
 	c.backoff = h
 }
 
+// SetBlockRollover sets the block number that follows block 65535 in
+// transfers of more than 65535 blocks. Most implementations wrap to 0,
+// which is the default, some expect 1. Other values are ignored.
+func (c *Client) SetBlockRollover(block uint16) {
+	if block <= 1 {
+		c.rollover = block
+	}
+}
+
+// SetOnRetransmit sets a function that is called each time a transfer
+// retransmits a packet after a timeout, to diagnose lossy links. It
+// receives the DATA block the transfer waits for to be acknowledged, or to
+// arrive in downloads, and the number of the retransmission, 1 for the
+// first one. The function is called synchronously from the goroutine
+// running the transfer and should return quickly.
+func (c *Client) SetOnRetransmit(f func(block uint16, attempt int)) {
+	c.onRetry = f
+}
+
+// SetOnProgress sets a function that is called as data blocks of a
+// transfer are confirmed. It receives the number of bytes transferred so
+// far and the transfer size from the tsize option, or -1 when the size is
+// not known. The function is called from a separate goroutine and does not
+// block the transfer; intermediate updates may be skipped if it is slow.
+// All calls complete before ReadFrom or WriteTo returns.
+func (c *Client) SetOnProgress(f func(bytes, total int64)) {
+	c.onProgress = f
+}
+
+// SetRateLimit limits the rate of data sent by the client to bytesPerSec.
+// It applies to Send only. Zero, the default, means no limit.
+func (c *Client) SetRateLimit(bytesPerSec int) {
+	c.rateLimit = bytesPerSec
+}
+
+// SetHook sets the Hook for success and failure of transfers. The
+// TransferStats passed to the hook describe a single Send or Receive.
+func (c *Client) SetHook(hook Hook) {
+	c.hook = hook
+}
+
 // SetBlockSize sets a custom block size used in the transmission.
+// Servers of this package answer sizes outside the 8..65464 range of
+// RFC 2348 with error code 8 instead of lowering them.
 func (c *Client) SetBlockSize(s int) {
 	c.blksize = s
 }
 
+// SetWindowSize sets the number of blocks that are sent before waiting
+// for an ACK (windowsize option, RFC 7440). Values less than 2 disable
+// the option, which is the default.
+func (c *Client) SetWindowSize(n int) {
+	c.window = n
+}
+
 // RequestTSize sets flag to indicate if tsize should be requested.
 func (c *Client) RequestTSize(s bool) {
 	c.tsize = s
 }
 
+// RequestTimeout sets flag to indicate if the timeout option (RFC 2349)
+// should be requested. The value proposed to the server is the client
+// timeout rounded up to whole seconds. If the server acknowledges the
+// option both sides use the negotiated value for retransmissions.
+func (c *Client) RequestTimeout(s bool) {
+	c.timeoutOpt = s
+}
+
+// RequestChecksum sets flag to indicate if the non-standard x-crc32 option
+// should be requested. If the server supports it the receiving side checks
+// a CRC-32 of the whole file after the final block and the transfer fails
+// with ErrChecksumMismatch if it does not match. Servers that do not know
+// the option ignore it and the file is transferred without the check.
+func (c *Client) RequestChecksum(s bool) {
+	c.checksum = s
+}
+
+// RequestAppend sets flag to indicate if write requests should ask the
+// server to append the data to the file using the non-standard x-append
+// option. Check the options negotiated by the transfer, see
+// NegotiatedOptions, to learn whether the server agreed; otherwise the
+// file is replaced.
+func (c *Client) RequestAppend(s bool) {
+	c.appendOpt = s
+}
+
+// RequestGzip sets flag to indicate if read requests should ask the server
+// to compress the file with gzip using the non-standard x-encoding option.
+// The data is not decompressed by the client. Check the x-encoding value
+// in the options negotiated by the transfer, see NegotiatedOptions, to
+// learn whether the server did compress it. Servers of this package do not
+// compress netascii transfers.
+func (c *Client) RequestGzip(s bool) {
+	c.gzip = s
+}
+
 // Client stores data about a single TFTP client
 type Client struct {
-	addr    *net.UDPAddr
-	timeout time.Duration
-	retries int
-	backoff backoffFunc
-	blksize int
-	tsize   bool
+	addr       *net.UDPAddr
+	timeout    time.Duration
+	retries    int
+	reqRetries int
+	totalTime  time.Duration
+	dally      time.Duration
+	readBuf    int // socket buffer sizes if positive
+	writeBuf   int
+	dscp       int
+	portMin    int // range of local ports if portMax is not zero
+	portMax    int
+	backoff    backoffFunc
+	blksize    int
+	tsize      bool
+	timeoutOpt bool
+	checksum   bool
+	gzip       bool
+	strict     bool
+	appendOpt  bool
+	rollover   uint16
+	window     int
+	onProgress func(bytes, total int64)
+	onRetry    func(block uint16, attempt int)
+	rateLimit  int
+	hook       Hook
+	expTimeout bool
+	jitter     float64
+	clock      clock
 }
 
 // Send starts outgoing file transmission. It returns io.ReaderFrom or error.
-func (c Client) Send(filename string, mode string) (io.ReaderFrom, error) {
-	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+// The transfer also implements io.WriteCloser so that io.Copy can write to
+// it; Close must be called once the copy is done.
+func (c *Client) Send(filename string, mode string) (io.ReaderFrom, error) {
+	return c.SendContext(context.Background(), filename, mode)
+}
+
+// SendContext is like Send but the transfer, including the ReadFrom call
+// on the returned io.ReaderFrom, is aborted once ctx is done. The error
+// returned in this case is ctx.Err().
+func (c *Client) SendContext(ctx context.Context, filename string, mode string) (io.ReaderFrom, error) {
+	return c.send(ctx, nil, filename, mode, -1, nil)
+}
+
+// dial opens a connection with a new socket for a single transfer.
+func (c *Client) dial() (*connConnection, error) {
+	conn, err := listenUDP(udpNetwork(c.addr), &net.UDPAddr{}, c.portMin, c.portMax)
 	if err != nil {
 		return nil, err
 	}
+	if err := setBuffers(conn, c.readBuf, c.writeBuf); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := setDSCP(conn, c.dscp); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &connConnection{conn: conn}, nil
+}
+
+// send starts an outgoing transfer over cc, or over a new connection if
+// cc is nil. The tsize option is sent if size is not negative. State, if
+// not nil, is kept up to date during the transfer.
+func (c *Client) send(ctx context.Context, cc *connConnection, filename string, mode string, size int64, state *transferState) (io.ReaderFrom, error) {
+	if cc == nil {
+		var err error
+		if cc, err = c.dial(); err != nil {
+			return nil, err
+		}
+	}
+	if c.totalTime > 0 {
+		ctx, cc.cancel = context.WithTimeout(ctx, c.totalTime)
+	}
+	cc.cancelOn(ctx)
 	s := &sender{
-		send:    make([]byte, datagramLength),
-		receive: make([]byte, datagramLength),
-		conn:    &connConnection{conn: conn},
-		retry:   &backoff{handler: c.backoff},
-		timeout: c.timeout,
-		retries: c.retries,
-		addr:    c.addr,
-		mode:    mode,
+		ctx:        ctx,
+		send:       make([]byte, datagramLength),
+		receive:    make([]byte, datagramLength),
+		conn:       cc,
+		retry:      &backoff{handler: c.backoff, exponential: c.expTimeout, jitter: c.jitter, clock: c.clock},
+		timeout:    c.timeout,
+		retries:    c.retries,
+		addr:       c.addr,
+		mode:       mode,
+		rollover:   c.rollover,
+		onProgress: c.onProgress,
+		onRetry:    c.onRetry,
+		rateLimit:  c.rateLimit,
+		hook:       c.hook,
+		state:      state,
+		filename:   filename,
+		startTime:  c.clock.Now(),
+		clock:      c.clock,
+		strict:     c.strict,
 	}
-	if c.blksize != 0 {
+	if c.blksize != 0 || c.timeoutOpt || c.window > 1 || c.checksum || c.appendOpt || size >= 0 {
 		s.opts = make(options)
+	}
+	if c.blksize != 0 {
 		s.opts["blksize"] = strconv.Itoa(c.blksize)
 	}
+	if size >= 0 {
+		s.opts["tsize"] = strconv.FormatInt(size, 10)
+	}
+	if c.checksum {
+		s.opts[optChecksum] = "1"
+	}
+	if c.appendOpt {
+		s.opts[optAppend] = "1"
+	}
+	if c.timeoutOpt {
+		s.opts["timeout"] = timeoutOption(c.timeout)
+	}
+	if c.window > 1 {
+		s.opts["windowsize"] = strconv.Itoa(c.window)
+	}
 	n := packRQ(s.send, opWRQ, filename, mode, s.opts)
+	s.retries = c.requestRetries()
 	addr, err := s.sendWithRetry(n)
+	s.retries = c.retries
 	if err != nil {
-		return nil, err
+		cc.close()
+		return nil, requestError(ctx, "WRQ", c.addr, optionsRejected(err, s.opts))
 	}
 	s.addr = addr
 	s.opts = nil
@@ -96,27 +386,56 @@ func (c Client) Send(filename string, mode string) (io.ReaderFrom, error) {
 }
 
 // Receive starts incoming file transmission. It returns io.WriterTo or error.
-func (c Client) Receive(filename string, mode string) (io.WriterTo, error) {
-	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
-	if err != nil {
-		return nil, err
+// The transfer also implements io.ReadCloser so that io.Copy can read from
+// it.
+func (c *Client) Receive(filename string, mode string) (io.WriterTo, error) {
+	return c.ReceiveContext(context.Background(), filename, mode)
+}
+
+// ReceiveContext is like Receive but the transfer, including the WriteTo
+// call on the returned io.WriterTo, is aborted once ctx is done. The error
+// returned in this case is ctx.Err().
+func (c *Client) ReceiveContext(ctx context.Context, filename string, mode string) (io.WriterTo, error) {
+	return c.receive(ctx, nil, filename, mode, nil)
+}
+
+// receive starts an incoming transfer over cc, or over a new connection
+// if cc is nil. State, if not nil, is kept up to date during the transfer.
+func (c *Client) receive(ctx context.Context, cc *connConnection, filename string, mode string, state *transferState) (io.WriterTo, error) {
+	if cc == nil {
+		var err error
+		if cc, err = c.dial(); err != nil {
+			return nil, err
+		}
 	}
-	if c.timeout == 0 {
-		c.timeout = defaultTimeout
+	if c.totalTime > 0 {
+		ctx, cc.cancel = context.WithTimeout(ctx, c.totalTime)
 	}
+	cc.cancelOn(ctx)
 	r := &receiver{
-		send:     make([]byte, datagramLength),
-		receive:  make([]byte, datagramLength),
-		conn:     &connConnection{conn: conn},
-		retry:    &backoff{handler: c.backoff},
-		timeout:  c.timeout,
-		retries:  c.retries,
-		addr:     c.addr,
-		autoTerm: true,
-		block:    1,
-		mode:     mode,
-	}
-	if c.blksize != 0 || c.tsize {
+		ctx:        ctx,
+		send:       make([]byte, datagramLength),
+		receive:    make([]byte, datagramLength, datagramLength+1),
+		conn:       cc,
+		retry:      &backoff{handler: c.backoff, exponential: c.expTimeout, jitter: c.jitter, clock: c.clock},
+		timeout:    c.timeout,
+		retries:    c.retries,
+		addr:       c.addr,
+		autoTerm:   true,
+		dally:      c.dally,
+		block:      1,
+		mode:       mode,
+		rollover:   c.rollover,
+		onProgress: c.onProgress,
+		onRetry:    c.onRetry,
+		hook:       c.hook,
+		state:      state,
+		filename:   filename,
+		startTime:  c.clock.Now(),
+		clock:      c.clock,
+		strict:     c.strict,
+	}
+	if c.blksize != 0 || c.tsize || c.timeoutOpt || c.window > 1 || c.checksum || c.gzip {
 		r.opts = make(options)
 	}
 	if c.blksize != 0 {
@@ -127,12 +446,344 @@ func (c Client) Receive(filename string, mode string) (io.WriterTo, error) {
 	if c.tsize {
 		r.opts["tsize"] = "0"
 	}
+	if c.timeoutOpt {
+		r.opts["timeout"] = timeoutOption(c.timeout)
+		defer func() { delete(r.opts, "timeout") }()
+	}
+	if c.window > 1 {
+		r.opts["windowsize"] = strconv.Itoa(c.window)
+		defer func() { delete(r.opts, "windowsize") }()
+	}
+	if c.checksum {
+		r.opts[optChecksum] = "1"
+		defer func() { delete(r.opts, optChecksum) }()
+	}
+	if c.gzip {
+		r.opts[optEncoding] = "gzip"
+		defer func() { delete(r.opts, optEncoding) }()
+	}
 	n := packRQ(r.send, opRRQ, filename, mode, r.opts)
+	r.retries = c.requestRetries()
 	l, addr, err := r.receiveWithRetry(n)
+	r.retries = c.retries
 	if err != nil {
-		return nil, err
+		cc.close()
+		return nil, requestError(ctx, "RRQ", c.addr, optionsRejected(err, r.opts))
 	}
 	r.l = l
 	r.addr = addr
 	return r, nil
 }
+
+// PutFile uploads the contents of src to the server as filename. It
+// returns the number of bytes sent.
+func (c *Client) PutFile(filename string, mode string, src io.Reader) (int64, error) {
+	rf, err := c.Send(filename, mode)
+	if err != nil {
+		return 0, err
+	}
+	return rf.ReadFrom(src)
+}
+
+// GetFile downloads filename from the server and writes it to dst. It
+// returns the number of bytes received.
+func (c *Client) GetFile(filename string, mode string, dst io.Writer) (int64, error) {
+	wt, err := c.Receive(filename, mode)
+	if err != nil {
+		return 0, err
+	}
+	return wt.WriteTo(dst)
+}
+
+// Download saves filename from the server to the local file at path. The
+// data is written to a temporary file in the same directory, which is
+// synced to disk and renamed to path once the transfer is complete. If the
+// transfer fails the temporary file is removed, so that no partial data is
+// left behind and an existing file at path is kept. A replaced file keeps
+// its permissions, a new one gets those os.Create would give it. It
+// returns the number of bytes received.
+func (c *Client) Download(filename, mode, path string) (n int64, err error) {
+	f, err := createTemp(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	// A replaced file keeps its permissions.
+	if fi, err := os.Stat(path); err == nil {
+		if err := f.Chmod(fi.Mode().Perm()); err != nil {
+			return 0, err
+		}
+	}
+	n, err = c.GetFile(filename, mode, f)
+	if err != nil {
+		return n, err
+	}
+	if err = f.Sync(); err != nil {
+		return n, err
+	}
+	if err = f.Close(); err != nil {
+		return n, err
+	}
+	return n, os.Rename(f.Name(), path)
+}
+
+// createTemp creates a new file in dir with a random name starting with
+// prefix. Unlike os.CreateTemp it uses permissions 0666 before the umask,
+// like os.Create does.
+func createTemp(dir, prefix string) (*os.File, error) {
+	for i := 0; ; i++ {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && i < 10000 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// Upload sends the local file at path to the server as filename. The size
+// of the file is announced with the tsize option in octet mode; in other
+// modes the data sent differs in size from the file. Errors opening the
+// local file are returned before a request is sent. It returns the number
+// of bytes sent.
+func (c *Client) Upload(filename, mode, path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if fi.IsDir() {
+		return 0, fmt.Errorf("%s is a directory", path)
+	}
+	size := fi.Size()
+	if !strings.EqualFold(mode, "octet") {
+		size = -1
+	}
+	rf, err := c.send(context.Background(), nil, filename, mode, size, nil)
+	if err != nil {
+		return 0, err
+	}
+	return rf.ReadFrom(f)
+}
+
+// Probe checks that filename can be downloaded from the server without
+// transferring it. It sends a read request with the tsize option, waits
+// for the OACK or the first DATA packet and cancels the transfer with an
+// ERROR packet. It returns the size of the file offered by the server, or
+// -1 if the server does not support the option.
+func (c *Client) Probe(filename, mode string) (tsize int64, err error) {
+	pc := *c
+	pc.tsize = true
+	wt, err := pc.receive(context.Background(), nil, filename, mode, nil)
+	if err != nil {
+		return 0, err
+	}
+	r := wt.(*receiver)
+	tsize = -1
+	if n, ok := r.Size(); ok {
+		tsize = n
+	}
+	n := packERROR(r.send, codeNotDefined, "probe done")
+	err = r.conn.sendTo(r.send[:n], r.addr)
+	r.conn.close()
+	return tsize, err
+}
+
+// Transfer is a client transfer running in the background, see GetAsync
+// and PutAsync.
+type Transfer struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+	state  transferState
+}
+
+// transferState is the part of the state of a sender or receiver that a
+// Transfer exposes. It is updated by the transfer goroutine and read by
+// Transfer methods.
+type transferState struct {
+	mu          sync.Mutex
+	block       uint16
+	retransmits int
+	wc          WindowControl // sender of an upload once it started
+	window      int           // set with SetWindow before that
+}
+
+// update records the block being sent or awaited and the retransmissions
+// so far. It does nothing if s is nil.
+func (s *transferState) update(block uint16, retransmits int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.block = block
+	s.retransmits = retransmits
+	s.mu.Unlock()
+}
+
+// control makes Window and SetWindow of the Transfer act on the sender wc
+// and passes on a window set before.
+func (s *transferState) control(wc WindowControl) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.wc = wc
+	if s.window > 0 {
+		wc.SetWindow(s.window)
+	}
+}
+
+// Abort stops the transfer and sends an ERROR packet to the server. Wait
+// returns context.Canceled for an aborted transfer unless it has already
+// finished.
+func (t *Transfer) Abort() {
+	t.cancel()
+}
+
+// Wait blocks until the transfer is finished and returns its error.
+func (t *Transfer) Wait() error {
+	<-t.done
+	return t.err
+}
+
+// CurrentBlock returns the number of the block being sent in an upload or
+// awaited in a download.
+func (t *Transfer) CurrentBlock() uint16 {
+	t.state.mu.Lock()
+	defer t.state.mu.Unlock()
+	return t.state.block
+}
+
+// Retransmits returns the number of packets retransmitted so far.
+func (t *Transfer) Retransmits() int {
+	t.state.mu.Lock()
+	defer t.state.mu.Unlock()
+	return t.state.retransmits
+}
+
+// Window returns the number of blocks an upload sends before waiting for
+// an ACK, see WindowControl. It is 1 for downloads and until the upload
+// has started.
+func (t *Transfer) Window() int {
+	t.state.mu.Lock()
+	wc := t.state.wc
+	t.state.mu.Unlock()
+	if wc == nil {
+		return 1
+	}
+	return wc.Window()
+}
+
+// SetWindow changes the window of an upload starting with the next window
+// sent, see WindowControl. It may be called before the upload has started
+// and has no effect on downloads.
+func (t *Transfer) SetWindow(n int) {
+	t.state.mu.Lock()
+	defer t.state.mu.Unlock()
+	if t.state.wc != nil {
+		t.state.wc.SetWindow(n)
+	} else if n > 0 {
+		t.state.window = n
+	}
+}
+
+func startTransfer(run func(ctx context.Context, state *transferState) error) *Transfer {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &Transfer{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(t.done)
+		defer cancel()
+		t.err = run(ctx, &t.state)
+	}()
+	return t
+}
+
+// GetAsync is like GetFile but returns at once. The download runs in the
+// background until it is finished or aborted.
+func (c *Client) GetAsync(filename string, mode string, dst io.Writer) *Transfer {
+	return startTransfer(func(ctx context.Context, state *transferState) error {
+		wt, err := c.receive(ctx, nil, filename, mode, state)
+		if err != nil {
+			return err
+		}
+		_, err = wt.WriteTo(dst)
+		return err
+	})
+}
+
+// PutAsync is like PutFile but returns at once. The upload runs in the
+// background until it is finished or aborted.
+func (c *Client) PutAsync(filename string, mode string, src io.Reader) *Transfer {
+	return startTransfer(func(ctx context.Context, state *transferState) error {
+		rf, err := c.send(ctx, nil, filename, mode, -1, state)
+		if err != nil {
+			return err
+		}
+		if wc, ok := rf.(WindowControl); ok {
+			state.control(wc)
+		}
+		_, err = rf.ReadFrom(src)
+		return err
+	})
+}
+
+// requestError returns err of the request op to addr, reporting a timeout
+// waiting for the reply as ErrNoResponse unless ctx is done.
+func requestError(ctx context.Context, op string, addr *net.UDPAddr, err error) error {
+	var ne net.Error
+	if ctx.Err() == nil && errors.As(err, &ne) && ne.Timeout() {
+		return &noResponseError{op: op, addr: addr, err: ne}
+	}
+	return err
+}
+
+// checkBlockSizeOffer verifies that the blksize value acknowledged by the
+// server does not exceed the one requested by the client (RFC 2348).
+func checkBlockSizeOffer(requested options, offered string) error {
+	req, ok := requested["blksize"]
+	if !ok {
+		return fmt.Errorf("blksize was not requested")
+	}
+	n, err := strconv.Atoi(offered)
+	if err != nil {
+		return fmt.Errorf("invalid blksize offered: %q", offered)
+	}
+	m, err := strconv.Atoi(req)
+	if err != nil {
+		return err
+	}
+	if n > m {
+		return fmt.Errorf("blksize offered %d is larger than requested %d", n, m)
+	}
+	return nil
+}
+
+// checkWindowSizeOffer verifies that the windowsize value acknowledged by
+// the server is valid and does not exceed the one requested by the client
+// (RFC 7440). It returns the window to use.
+func checkWindowSizeOffer(requested options, offered string) (int, error) {
+	req, ok := requested["windowsize"]
+	if !ok {
+		return 0, fmt.Errorf("windowsize was not requested")
+	}
+	n, err := parseWindowSizeOption(offered)
+	if err != nil {
+		return 0, fmt.Errorf("invalid windowsize offered: %q", offered)
+	}
+	m, err := strconv.Atoi(req)
+	if err != nil {
+		return 0, err
+	}
+	if n > m {
+		return 0, fmt.Errorf("windowsize offered %d is larger than requested %d", n, m)
+	}
+	return n, nil
+}
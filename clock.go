@@ -0,0 +1,20 @@
+package tftp
+
+import "time"
+
+// clock is the source of time for retransmission timeouts, backoff and
+// rate limiting. Tests replace it to control time. Waiting for a packet
+// goes by it only in single port mode, where transfers read from a
+// channel; transfers with a socket of their own wait with the deadline of
+// the socket in real time, see connConnection.setDeadline.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
@@ -1,8 +1,12 @@
 package tftp
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net"
+	"sync"
 	"time"
 
 	"golang.org/x/net/ipv6"
@@ -32,7 +36,14 @@ type connection interface {
 }
 
 type connConnection struct {
-	conn *net.UDPConn
+	conn        *net.UDPConn
+	mu          sync.Mutex
+	interrupted bool
+	done        chan struct{}
+	cancel      context.CancelFunc // called on close if set
+	closeOnce   sync.Once
+	shared      bool         // conn is owned by a Session and kept open
+	stale       *net.UDPAddr // datagrams from this address are dropped
 }
 
 type chanConnection struct {
@@ -41,6 +52,9 @@ type chanConnection struct {
 	srcAddr, addr *net.UDPAddr
 	timeout       time.Duration
 	complete      chan string
+	clock         clock
+	done          <-chan struct{}    // interrupts reads once closed
+	cancel        context.CancelFunc // called on close if set
 }
 
 func (c *chanConnection) sendTo(data []byte, addr *net.UDPAddr) error {
@@ -65,11 +79,10 @@ func (c *chanConnection) sendTo(data []byte, addr *net.UDPAddr) error {
 func (c *chanConnection) readFrom(buffer []byte) (int, *net.UDPAddr, error) {
 	select {
 	case data := <-c.channel:
-		for i := range data {
-			buffer[i] = data[i]
-		}
-		return len(data), c.addr, nil
-	case <-time.After(c.timeout):
+		return copy(buffer, data), c.addr, nil
+	case <-c.clock.After(c.timeout):
+		return 0, nil, makeError(c.addr.String())
+	case <-c.done:
 		return 0, nil, makeError(c.addr.String())
 	}
 }
@@ -80,6 +93,9 @@ func (c *chanConnection) setDeadline(deadline time.Duration) error {
 }
 
 func (c *chanConnection) close() {
+	if c.cancel != nil {
+		c.cancel()
+	}
 	close(c.channel)
 	c.complete <- c.addr.String()
 }
@@ -99,13 +115,158 @@ func makeError(addr string) net.Error {
 }
 
 func (c *connConnection) readFrom(buffer []byte) (int, *net.UDPAddr, error) {
-	return c.conn.ReadFromUDP(buffer)
+	for {
+		n, addr, err := c.conn.ReadFromUDP(buffer)
+		if err == nil && c.stale != nil && addr.Port == c.stale.Port && addr.IP.Equal(c.stale.IP) {
+			continue
+		}
+		return n, addr, err
+	}
 }
 
+// setDeadline makes reads time out after deadline of real time. The
+// clock of the transfer does not apply to the socket.
 func (c *connConnection) setDeadline(deadline time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.interrupted {
+		return c.conn.SetReadDeadline(time.Unix(1, 0))
+	}
 	return c.conn.SetReadDeadline(time.Now().Add(deadline))
 }
 
+// interrupt makes pending and subsequent reads fail with timeout error.
+func (c *connConnection) interrupt() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.interrupted = true
+	c.conn.SetReadDeadline(time.Unix(1, 0))
+}
+
+// cancelOn interrupts the connection once ctx is done. Watching stops
+// when the connection is closed.
+func (c *connConnection) cancelOn(ctx context.Context) {
+	if ctx.Done() == nil {
+		return
+	}
+	c.done = make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.interrupt()
+		case <-c.done:
+		}
+	}()
+}
+
 func (c *connConnection) close() {
-	c.conn.Close()
+	c.closeOnce.Do(func() {
+		if c.done != nil {
+			close(c.done)
+		}
+		if c.cancel != nil {
+			c.cancel()
+		}
+	})
+	if !c.shared {
+		c.conn.Close()
+	}
+}
+
+// isTimeout reports whether err is caused by an expired read deadline.
+// Only such errors are worth a retransmission, other errors like ICMP
+// port unreachable reported as connection refused end transfers at once.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// rejectTID answers a datagram received from an unexpected source with
+// ERROR(5) as required by RFC 1350. The transfer itself is not affected.
+func rejectTID(c connection, addr *net.UDPAddr) {
+	const msg = "unknown transfer ID"
+	b := make([]byte, len(msg)+6)
+	n := packERROR(b, codeUnknownTID, msg)
+	c.sendTo(b[:n], addr)
+}
+
+// setBuffers sets the sizes of the receive and transmit buffers of conn.
+// Sizes that are not positive are left at the system default.
+func setBuffers(conn *net.UDPConn, read, write int) error {
+	if read > 0 {
+		if err := conn.SetReadBuffer(read); err != nil {
+			return err
+		}
+	}
+	if write > 0 {
+		if err := conn.SetWriteBuffer(write); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// udpNetwork returns network name for a transmission socket that matches
+// address family of the peer. IPv4-mapped IPv6 addresses are treated as
+// IPv4 ones.
+func udpNetwork(addr *net.UDPAddr) string {
+	if addr.IP.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
+}
+
+// listenUDP opens a socket on laddr. If max is not zero the port is taken
+// from the range min to max: the ports are tried in turn starting at a
+// random one, so that transfers do not all compete for the first. Only a
+// port in use moves on to the next one; any other error is returned as is.
+func listenUDP(network string, laddr *net.UDPAddr, min, max int) (*net.UDPConn, error) {
+	if max == 0 {
+		return net.ListenUDP(network, laddr)
+	}
+	addr := *laddr
+	n := max - min + 1
+	start := rand.Intn(n)
+	var err error
+	for i := 0; i < n; i++ {
+		addr.Port = min + (start+i)%n
+		var conn *net.UDPConn
+		if conn, err = net.ListenUDP(network, &addr); err == nil {
+			return conn, nil
+		}
+		if !addrInUse(err) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%w %d-%d: %v", ErrPortRangeExhausted, min, max, err)
+}
+
+// validPortRange reports whether min to max is a range of ports for
+// SetPortRange.
+func validPortRange(min, max int) bool {
+	return min > 0 && min <= max && max <= 65535
+}
+
+// setDSCP marks the packets sent over conn with the DSCP value dscp, the
+// upper six bits of the IPv4 TOS and the IPv6 traffic class fields. Zero
+// leaves the system default.
+func setDSCP(conn *net.UDPConn, dscp int) error {
+	if dscp == 0 {
+		return nil
+	}
+	if dscp < 0 || dscp > 63 {
+		return fmt.Errorf("DSCP out of range: %d", dscp)
+	}
+	ip := conn.LocalAddr().(*net.UDPAddr).IP
+	if ip.To4() != nil {
+		return ipv4.NewConn(conn).SetTOS(dscp << 2)
+	}
+	if err := ipv6.NewConn(conn).SetTrafficClass(dscp << 2); err != nil {
+		return err
+	}
+	if ip.IsUnspecified() {
+		// Dual stack socket, IPv4 packets take the TOS of the socket.
+		ipv4.NewConn(conn).SetTOS(dscp << 2)
+	}
+	return nil
 }
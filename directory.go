@@ -0,0 +1,186 @@
+package tftp
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// NewDirectoryServer creates TFTP server that serves files from the root
+// directory. Clients may upload new files into root unless readOnly is
+// set; existing files are never overwritten. Requests for files outside
+// of root, including ones reached through symbolic links, are rejected
+// with an access violation error.
+func NewDirectoryServer(root string, readOnly bool) *Server {
+	d := &directory{root: root, readOnly: readOnly}
+	return NewServer(d.handleRead, d.handleWrite)
+}
+
+type directory struct {
+	root     string
+	readOnly bool
+}
+
+func (d *directory) handleRead(filename string, rf io.ReaderFrom) error {
+	path, err := d.resolve(filename, false)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return fileError(err)
+	}
+	defer file.Close()
+	_, err = rf.ReadFrom(file)
+	return err
+}
+
+func (d *directory) handleWrite(filename string, wt io.WriterTo) error {
+	if d.readOnly {
+		return &TftpError{Code: codeAccessViolation, Message: "server is read-only"}
+	}
+	path, err := d.resolve(filename, true)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fileError(err)
+	}
+	_, err = wt.WriteTo(file)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// CreateFunc opens a new file for a write request. It should fail with an
+// error satisfying errors.Is(err, fs.ErrExist) if the file exists.
+type CreateFunc func(name string) (io.WriteCloser, error)
+
+// NewFSServer creates TFTP server that serves files from fsys, such as
+// an embed.FS. Uploads are stored with create; if create is nil the
+// server is read-only. Names are resolved with the rules of fs.ValidPath
+// after cleaning, so requests for absolute names or names escaping the
+// root with ".." are rejected with an access violation error.
+func NewFSServer(fsys fs.FS, create CreateFunc) *Server {
+	d := &fsDirectory{fsys: fsys, create: create}
+	return NewServer(d.handleRead, d.handleWrite)
+}
+
+type fsDirectory struct {
+	fsys   fs.FS
+	create CreateFunc
+}
+
+func (d *fsDirectory) handleRead(filename string, rf io.ReaderFrom) error {
+	name, err := fsName(filename)
+	if err != nil {
+		return err
+	}
+	file, err := d.fsys.Open(name)
+	if err != nil {
+		return fileError(err)
+	}
+	defer file.Close()
+	_, err = rf.ReadFrom(file)
+	return err
+}
+
+func (d *fsDirectory) handleWrite(filename string, wt io.WriterTo) error {
+	if d.create == nil {
+		return &TftpError{Code: codeAccessViolation, Message: "server is read-only"}
+	}
+	name, err := fsName(filename)
+	if err != nil {
+		return err
+	}
+	file, err := d.create(name)
+	if err != nil {
+		return fileError(err)
+	}
+	_, err = wt.WriteTo(file)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// fsName converts filename requested by a client to a name for fs.FS.
+func fsName(filename string) (string, error) {
+	name := path.Clean(filename)
+	if !fs.ValidPath(name) {
+		return "", ErrAccessViolation
+	}
+	return name, nil
+}
+
+// resolve maps filename to a path under root. Symbolic links are followed
+// and the result must stay inside root. For writes the file itself does
+// not exist yet so only its directory is checked.
+func (d *directory) resolve(filename string, write bool) (string, error) {
+	path, err := SafeJoin(d.root, filename)
+	if err != nil {
+		return "", err
+	}
+	root, err := filepath.EvalSymlinks(d.root)
+	if err != nil {
+		return "", err
+	}
+	target := path
+	if write {
+		target = filepath.Dir(path)
+	}
+	real, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		return "", fileError(err)
+	}
+	rel, err := filepath.Rel(root, real)
+	if err != nil || escapes(rel) {
+		return "", ErrAccessViolation
+	}
+	return path, nil
+}
+
+// SafeJoin joins filename requested by a client to root. Absolute names
+// and names that escape root with ".." are rejected with a *TftpError
+// carrying the access violation code, so a handler can return it as is
+// to answer the client with ERROR(2). Symbolic links are not resolved.
+func SafeJoin(root, filename string) (string, error) {
+	name := filepath.FromSlash(filename)
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" ||
+		strings.HasPrefix(name, string(filepath.Separator)) {
+		return "", ErrAccessViolation
+	}
+	name = filepath.Clean(name)
+	if escapes(name) {
+		return "", ErrAccessViolation
+	}
+	return filepath.Join(root, name), nil
+}
+
+// escapes reports whether relative path p points outside of its base.
+func escapes(p string) bool {
+	return p == ".." || strings.HasPrefix(p, ".."+string(filepath.Separator))
+}
+
+// fileError converts errors from os and io/fs packages into errors sent
+// to a client.
+func fileError(err error) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return ErrFileNotFound
+	case errors.Is(err, fs.ErrExist):
+		return &TftpError{Code: codeFileExists, Message: "file already exists"}
+	case errors.Is(err, fs.ErrPermission):
+		return ErrAccessViolation
+	}
+	return err
+}
@@ -0,0 +1,231 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func makeDirectoryServer(t *testing.T, readOnly bool) (string, *Server, *Client) {
+	base, err := ioutil.TempDir("", "tftp")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	root := filepath.Join(base, "root")
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatalf("creating root: %v", err)
+	}
+	files := map[string]string{
+		"secret":              "outside of root",
+		"root/hello.txt":      "hello",
+		"root/sub/nested.txt": "nested",
+	}
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(base, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("writing %s: %v", name, err)
+		}
+	}
+	os.Symlink(filepath.Join(base, "secret"), filepath.Join(root, "link"))
+	s := NewDirectoryServer(root, readOnly)
+	c, _ := runTestServer(t, s)
+	return base, s, c
+}
+
+func receiveString(c *Client, filename string) (string, error) {
+	wt, err := c.Receive(filename, "octet")
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	_, err = wt.WriteTo(buf)
+	return buf.String(), err
+}
+
+func expectErrorCode(t *testing.T, err error, code uint16) {
+	t.Helper()
+	var e *TftpError
+	if !errors.As(err, &e) {
+		t.Errorf("TftpError with code %d expected, got %v", code, err)
+		return
+	}
+	if e.Code != code {
+		t.Errorf("error code %d expected, got %v", code, e)
+	}
+}
+
+func TestDirectoryServerRead(t *testing.T) {
+	base, s, c := makeDirectoryServer(t, true)
+	defer os.RemoveAll(base)
+	defer s.Shutdown()
+	for name, content := range map[string]string{
+		"hello.txt":      "hello",
+		"sub/nested.txt": "nested",
+	} {
+		got, err := receiveString(c, name)
+		if err != nil {
+			t.Errorf("receiving %s: %v", name, err)
+		} else if got != content {
+			t.Errorf("%s: %q expected, got %q", name, content, got)
+		}
+	}
+	_, err := receiveString(c, "missing.txt")
+	expectErrorCode(t, err, codeFileNotFound)
+}
+
+func TestDirectoryServerTraversal(t *testing.T) {
+	base, s, c := makeDirectoryServer(t, false)
+	defer os.RemoveAll(base)
+	defer s.Shutdown()
+	for _, name := range []string{
+		"../secret",
+		"sub/../../secret",
+		filepath.Join(base, "secret"),
+		"link",
+	} {
+		_, err := receiveString(c, name)
+		expectErrorCode(t, err, codeAccessViolation)
+	}
+	rf, err := c.Send("../uploaded", "octet")
+	if err == nil {
+		_, err = rf.ReadFrom(strings.NewReader("data"))
+	}
+	expectErrorCode(t, err, codeAccessViolation)
+	if _, err := os.Stat(filepath.Join(base, "uploaded")); !os.IsNotExist(err) {
+		t.Errorf("file outside of root was created")
+	}
+}
+
+func TestDirectoryServerWrite(t *testing.T) {
+	base, s, c := makeDirectoryServer(t, false)
+	defer os.RemoveAll(base)
+	defer s.Shutdown()
+	rf, err := c.Send("sub/uploaded.txt", "octet")
+	if err != nil {
+		t.Fatalf("requesting write: %v", err)
+	}
+	_, err = rf.ReadFrom(strings.NewReader("uploaded"))
+	if err != nil {
+		t.Fatalf("sending: %v", err)
+	}
+	got, err := receiveString(c, "sub/uploaded.txt")
+	if err != nil || got != "uploaded" {
+		t.Errorf("reading uploaded file: %q, %v", got, err)
+	}
+	rf, err = c.Send("hello.txt", "octet")
+	if err == nil {
+		_, err = rf.ReadFrom(strings.NewReader("overwrite"))
+	}
+	expectErrorCode(t, err, codeFileExists)
+}
+
+func TestDirectoryServerReadOnly(t *testing.T) {
+	base, s, c := makeDirectoryServer(t, true)
+	defer os.RemoveAll(base)
+	defer s.Shutdown()
+	rf, err := c.Send("new.txt", "octet")
+	if err == nil {
+		_, err = rf.ReadFrom(strings.NewReader("data"))
+	}
+	expectErrorCode(t, err, codeAccessViolation)
+	if _, err := os.Stat(filepath.Join(base, "root", "new.txt")); !os.IsNotExist(err) {
+		t.Errorf("file was created on read-only server")
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	root := filepath.FromSlash("/srv/tftp")
+	for _, name := range []string{
+		"../../etc/passwd",
+		"/etc/passwd",
+		"a/../../b",
+		"..",
+	} {
+		p, err := SafeJoin(root, name)
+		if err == nil {
+			t.Errorf("%s: error expected, got %s", name, p)
+			continue
+		}
+		expectErrorCode(t, err, codeAccessViolation)
+	}
+	for name, expected := range map[string]string{
+		"pxelinux.cfg/default": "/srv/tftp/pxelinux.cfg/default",
+		"a/./b/../c":           "/srv/tftp/a/c",
+		"..foo":                "/srv/tftp/..foo",
+	} {
+		p, err := SafeJoin(root, name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if p != filepath.FromSlash(expected) {
+			t.Errorf("%s: %s expected, got %s", name, expected, p)
+		}
+	}
+}
+
+type memFile struct {
+	bytes.Buffer
+	files map[string]string
+	name  string
+}
+
+func (f *memFile) Close() error {
+	f.files[f.name] = f.String()
+	return nil
+}
+
+func TestFSServer(t *testing.T) {
+	fsys := fstest.MapFS{
+		"hello.txt":      {Data: []byte("hello")},
+		"sub/nested.txt": {Data: []byte("nested")},
+	}
+	uploads := map[string]string{}
+	s := NewFSServer(fsys, func(name string) (io.WriteCloser, error) {
+		if _, ok := fsys[name]; ok {
+			return nil, fs.ErrExist
+		}
+		return &memFile{files: uploads, name: name}, nil
+	})
+	c, _ := runTestServer(t, s)
+
+	for name, expected := range map[string]string{
+		"hello.txt":        "hello",
+		"sub/nested.txt":   "nested",
+		"sub/../hello.txt": "hello",
+	} {
+		if content, err := receiveString(c, name); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if content != expected {
+			t.Errorf("%s: %q expected, got %q", name, expected, content)
+		}
+	}
+	_, err := receiveString(c, "missing.txt")
+	expectErrorCode(t, err, codeFileNotFound)
+	for _, name := range []string{"../hello.txt", "/hello.txt"} {
+		_, err = receiveString(c, name)
+		expectErrorCode(t, err, codeAccessViolation)
+	}
+
+	rf, err := c.Send("new.txt", "octet")
+	if err == nil {
+		_, err = rf.ReadFrom(strings.NewReader("uploaded"))
+	}
+	if err != nil {
+		t.Fatalf("sending new.txt: %v", err)
+	}
+	rf, err = c.Send("hello.txt", "octet")
+	if err == nil {
+		_, err = rf.ReadFrom(strings.NewReader("overwrite"))
+	}
+	expectErrorCode(t, err, codeFileExists)
+	s.Shutdown()
+	if uploads["new.txt"] != "uploaded" {
+		t.Errorf("upload is not stored: %q", uploads)
+	}
+}
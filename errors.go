@@ -0,0 +1,147 @@
+package tftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// TftpError is an error reported by the remote peer with an ERROR packet.
+// Use errors.As to obtain it from an error returned by a transfer.
+//
+// Handlers may also return a TftpError to control the error code and
+// message sent to the client. The same holds for the io.Reader passed to
+// ReadFrom and the io.Writer passed to WriteTo: a Read or Write failing
+// with a TftpError, possibly wrapped, for instance after CloseWithError
+// of an io.Pipe, aborts the transfer with its code and message.
+type TftpError struct {
+	Code    uint16
+	Message string
+}
+
+func (e *TftpError) Error() string {
+	return fmt.Sprintf("code: %d, message: %s", e.Code, e.Message)
+}
+
+// Is reports whether target is a *TftpError with the same code. It makes
+// errors.Is(err, ErrFileNotFound) true for any file not found error,
+// including ones received from the peer.
+func (e *TftpError) Is(target error) bool {
+	t, ok := target.(*TftpError)
+	return ok && t.Code == e.Code
+}
+
+// Errors a handler can return, possibly wrapped, to answer the client
+// with the respective error code. Other errors are sent with code 0 (not
+// defined) and the error text as message.
+var (
+	ErrFileNotFound    = &TftpError{Code: codeFileNotFound, Message: "file not found"}
+	ErrAccessViolation = &TftpError{Code: codeAccessViolation, Message: "access violation"}
+	ErrDiskFull        = &TftpError{Code: codeDiskFull, Message: "disk full or allocation exceeded"}
+	ErrBadOption       = &TftpError{Code: codeBadOption, Message: "bad option"}
+)
+
+// ErrTruncated is returned, possibly wrapped, by WriteTo of an incoming
+// transfer when the peer stopped sending before the final short block, so
+// the data received is incomplete. The error also satisfies net.Error with
+// Timeout reporting true.
+var ErrTruncated = errors.New("transfer truncated")
+
+// truncatedError wraps the timeout that ended an incomplete transfer.
+type truncatedError struct {
+	err net.Error
+}
+
+func (e *truncatedError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrTruncated, e.err)
+}
+
+func (e *truncatedError) Timeout() bool   { return e.err.Timeout() }
+func (e *truncatedError) Temporary() bool { return e.err.Temporary() }
+func (e *truncatedError) Unwrap() error   { return e.err }
+
+func (e *truncatedError) Is(target error) bool {
+	return target == ErrTruncated
+}
+
+// ErrNoResponse is returned, possibly wrapped, by Client when the server
+// did not answer a request before the retransmissions of the request ran
+// out, e.g. because of a wrong address or a firewall. The error also
+// satisfies net.Error with Timeout reporting true.
+var ErrNoResponse = errors.New("no response")
+
+// noResponseError wraps the timeout that ended a request.
+type noResponseError struct {
+	op   string // RRQ or WRQ
+	addr *net.UDPAddr
+	err  net.Error
+}
+
+func (e *noResponseError) Error() string {
+	return fmt.Sprintf("%v to %s from %v: %v", ErrNoResponse, e.op, e.addr, e.err)
+}
+
+func (e *noResponseError) Timeout() bool   { return e.err.Timeout() }
+func (e *noResponseError) Temporary() bool { return e.err.Temporary() }
+func (e *noResponseError) Unwrap() error   { return e.err }
+
+func (e *noResponseError) Is(target error) bool {
+	return target == ErrNoResponse
+}
+
+// ErrPortRangeExhausted is returned, possibly wrapped, when the socket of a
+// transfer cannot be opened because all ports of the range set with
+// SetPortRange are in use.
+var ErrPortRangeExhausted = errors.New("no free port in range")
+
+// withCode returns err as is if it is a *TftpError and wraps it into one
+// with the code provided otherwise.
+func withCode(err error, code uint16) error {
+	var e *TftpError
+	if errors.As(err, &e) {
+		return err
+	}
+	return &TftpError{Code: code, Message: err.Error()}
+}
+
+// errorCodeMessage returns the code and message to put into an ERROR
+// packet sent to the peer on err.
+func errorCodeMessage(err error) (uint16, string) {
+	var e *TftpError
+	if errors.As(err, &e) {
+		return e.Code, e.Message
+	}
+	return codeNotDefined, err.Error()
+}
+
+// optionsRejected adds the options of a request to err if the server
+// refused them with error code 8, see ErrBadOption.
+func optionsRejected(err error, opts options) error {
+	if errors.Is(err, ErrBadOption) {
+		return fmt.Errorf("server rejected options %v: %w", opts, err)
+	}
+	return err
+}
+
+// errMalformedPacket is the error of a strict peer on receiving a packet
+// that cannot be parsed.
+var errMalformedPacket = &TftpError{Code: codeIllegalOperation, Message: "malformed packet"}
+
+// unexpectedPacket is the error of a strict peer on receiving a packet
+// that is not allowed at this point of the transfer. It is nil for
+// requests, a client retransmits them if the first reply is lost and in
+// single port mode they reach the transfer.
+func unexpectedPacket(b []byte) error {
+	op := Opcode(binary.BigEndian.Uint16(b))
+	if op == OpcodeRRQ || op == OpcodeWRQ {
+		return nil
+	}
+	return &TftpError{Code: codeIllegalOperation, Message: fmt.Sprintf("unexpected %v packet", op)}
+}
+
+// badOption is the error of a strict peer on an option it does not
+// implement or an option value it does not accept.
+func badOption(name, value string) error {
+	return &TftpError{Code: codeBadOption, Message: fmt.Sprintf("bad option %s=%s", name, value)}
+}
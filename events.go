@@ -0,0 +1,52 @@
+package tftp
+
+import (
+	"fmt"
+	"net"
+)
+
+// EventType is the stage of a transfer an Event reports.
+type EventType int
+
+const (
+	// EventRequest is emitted when a request is received, before it is
+	// authorized or a handler is called.
+	EventRequest EventType = iota + 1
+	// EventStarted is emitted when the handler for a request is called.
+	EventStarted
+	// EventBlock is emitted when a data block was transferred: sent and
+	// acknowledged in read transfers or received in write transfers.
+	EventBlock
+	// EventCompleted is emitted when a transfer finished successfully.
+	EventCompleted
+	// EventFailed is emitted when a transfer was aborted. Err holds the
+	// reason.
+	EventFailed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventRequest:
+		return "request"
+	case EventStarted:
+		return "started"
+	case EventBlock:
+		return "block"
+	case EventCompleted:
+		return "completed"
+	case EventFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event describes a step in the lifecycle of a server transfer. See
+// Server.SetEventHandler.
+type Event struct {
+	Type       EventType
+	Op         Op
+	Filename   string
+	RemoteAddr *net.UDPAddr
+	Bytes      int64 // data bytes transferred so far
+	Err        error // set for EventFailed
+}
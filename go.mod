@@ -1,6 +1,6 @@
 module github.com/pin/tftp
 
-go 1.13
+go 1.16
 
 require (
 	github.com/stretchr/testify v1.4.0
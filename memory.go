@@ -0,0 +1,70 @@
+package tftp
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// NewMemoryServer creates TFTP server that serves files kept in memory.
+// It starts with a copy of files. Clients may upload new files which are
+// added to the returned MemoryFiles; existing files are never
+// overwritten. Requests for missing files are answered with file not
+// found error.
+func NewMemoryServer(files map[string][]byte) (*Server, *MemoryFiles) {
+	m := &MemoryFiles{files: make(map[string][]byte, len(files))}
+	for name, data := range files {
+		m.files[name] = data
+	}
+	return NewServer(m.handleRead, m.handleWrite), m
+}
+
+// MemoryFiles holds the files of a server created with NewMemoryServer.
+// It is safe for concurrent use.
+type MemoryFiles struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+// Get returns contents of the file and whether it exists.
+func (m *MemoryFiles) Get(filename string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[filename]
+	return data, ok
+}
+
+// Put adds the file or replaces its contents.
+func (m *MemoryFiles) Put(filename string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[filename] = data
+}
+
+func (m *MemoryFiles) handleRead(filename string, rf io.ReaderFrom) error {
+	data, ok := m.Get(filename)
+	if !ok {
+		return ErrFileNotFound
+	}
+	rf.(OutgoingTransfer).SetSize(int64(len(data)))
+	_, err := rf.ReadFrom(bytes.NewReader(data))
+	return err
+}
+
+func (m *MemoryFiles) handleWrite(filename string, wt io.WriterTo) error {
+	if _, ok := m.Get(filename); ok {
+		return &TftpError{Code: codeFileExists, Message: "file already exists"}
+	}
+	buf := &bytes.Buffer{}
+	_, err := wt.WriteTo(buf)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[filename]; ok {
+		return &TftpError{Code: codeFileExists, Message: "file already exists"}
+	}
+	m.files[filename] = buf.Bytes()
+	return nil
+}
@@ -0,0 +1,33 @@
+package tftp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMemoryServer(t *testing.T) {
+	s, files := NewMemoryServer(map[string][]byte{"pxelinux.0": []byte("boot")})
+	c, _ := startTestServer(t, s)
+
+	got, err := receiveString(c, "pxelinux.0")
+	if err != nil || got != "boot" {
+		t.Errorf("pre-seeded file: %q, %v", got, err)
+	}
+	_, err = receiveString(c, "missing")
+	expectErrorCode(t, err, codeFileNotFound)
+
+	payload := bytes.Repeat([]byte("upload"), 200)
+	if _, err := c.PutFile("uploaded", "octet", bytes.NewReader(payload)); err != nil {
+		t.Fatalf("uploading: %v", err)
+	}
+	data, ok := files.Get("uploaded")
+	if !ok || !bytes.Equal(data, payload) {
+		t.Errorf("uploaded file mismatch: %d bytes, %v", len(data), ok)
+	}
+	got, err = receiveString(c, "uploaded")
+	if err != nil || got != string(payload) {
+		t.Errorf("reading back uploaded file: %d bytes, %v", len(got), err)
+	}
+	_, err = c.PutFile("pxelinux.0", "octet", bytes.NewReader(payload))
+	expectErrorCode(t, err, codeFileExists)
+}
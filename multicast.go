@@ -0,0 +1,236 @@
+package tftp
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// mcastTransfer is a multicast read transfer (RFC 2090) that other clients
+// requesting the same file join as listeners. When the master client stops
+// acknowledging blocks the first listener is made the master.
+type mcastTransfer struct {
+	mu      sync.Mutex
+	conn    connection
+	group   *net.UDPAddr
+	opts    options        // negotiated with the first master
+	order   []string       // of the options in the request of the master
+	waiting []*net.UDPAddr // listeners in order of their requests
+	closed  bool           // listeners could not catch up, see close
+}
+
+// mcastKey identifies the data of a multicast transfer: the file and the
+// mode and options that change the bytes sent. Requests join a running
+// transfer only if their key matches.
+type mcastKey struct {
+	filename string
+	mode     string
+	encoding string
+}
+
+// transferKey returns the key of a read request for filename.
+func transferKey(filename, mode string, opts options) mcastKey {
+	k := mcastKey{filename: filename, mode: mode}
+	if strings.EqualFold(opts[optEncoding], "gzip") && mode != "netascii" {
+		k.encoding = "gzip"
+	}
+	return k
+}
+
+// mcastOption returns the value of the multicast option for a client.
+func mcastOption(group *net.UDPAddr, master bool) string {
+	m := 0
+	if master {
+		m = 1
+	}
+	return fmt.Sprintf("%s,%d,%d", group.IP, group.Port, m)
+}
+
+// setOptions records the options negotiated with the master once the
+// first OACK is acknowledged. Listeners are accepted only after that.
+func (t *mcastTransfer) setOptions(opts options, order []string) {
+	t.mu.Lock()
+	t.opts = opts.copy()
+	t.order = order
+	t.mu.Unlock()
+}
+
+// close makes the transfer refuse listeners. They join after DATA has
+// started, so they depend on the blocks they missed being sent again.
+func (t *mcastTransfer) close() {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+}
+
+// join adds addr to the listeners and tells it the negotiated options
+// with master set to 0. It returns false if the transfer is not ready
+// yet, and open is false if it does not accept listeners at all.
+func (t *mcastTransfer) join(addr *net.UDPAddr) (joined, open bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false, false
+	}
+	if t.opts == nil {
+		return false, true
+	}
+	opts := options(t.opts.copy())
+	opts["multicast"] = mcastOption(t.group, false)
+	b := make([]byte, datagramLength)
+	n := packOACK(b, opts.list(t.order))
+	if err := t.conn.sendTo(b[:n], addr); err != nil {
+		return false, true
+	}
+	t.waiting = append(t.waiting, addr)
+	return true, true
+}
+
+// next removes the first listener and returns it, or nil if there are no
+// listeners left.
+func (t *mcastTransfer) next() *net.UDPAddr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.waiting) == 0 {
+		return nil
+	}
+	addr := t.waiting[0]
+	t.waiting = t.waiting[1:]
+	return addr
+}
+
+// mcastJoin makes addr a listener of the running multicast transfer with
+// key k. It returns false if there is no such transfer or it does not
+// accept listeners, then the request starts a transfer of its own.
+func (s *Server) mcastJoin(k mcastKey, addr *net.UDPAddr) bool {
+	s.mcastMu.Lock()
+	t := s.mcastTx[k]
+	s.mcastMu.Unlock()
+	if t == nil {
+		return false
+	}
+	joined, open := t.join(addr)
+	if !open {
+		s.log.Printf("multicast transfer of %s does not accept listeners, %v gets its own", k.filename, addr)
+		return false
+	}
+	if joined {
+		s.log.Printf("%v joined multicast transfer of %s", addr, k.filename)
+	} else {
+		// The client retransmits its request.
+		s.log.Printf("multicast transfer of %s is not ready for %v", k.filename, addr)
+	}
+	return true
+}
+
+// mcastStart registers a multicast transfer with key k over conn, in
+// place of a closed one with the same key. The transfer gets the lowest
+// port from the one of the group up that no other running multicast
+// transfer uses. It returns nil if there is none.
+func (s *Server) mcastStart(k mcastKey, conn connection) *mcastTransfer {
+	s.mcastMu.Lock()
+	defer s.mcastMu.Unlock()
+	port := s.mcastGroup.Port
+	for s.mcastPorts[port] {
+		port++
+	}
+	if port > 65535 {
+		return nil
+	}
+	t := &mcastTransfer{conn: conn, group: &net.UDPAddr{IP: s.mcastGroup.IP, Port: port}}
+	if s.mcastTx == nil {
+		s.mcastTx = make(map[mcastKey]*mcastTransfer)
+		s.mcastPorts = make(map[int]bool)
+	}
+	s.mcastTx[k] = t
+	s.mcastPorts[port] = true
+	return t
+}
+
+// mcastEnd removes the multicast transfer t with key k.
+func (s *Server) mcastEnd(k mcastKey, t *mcastTransfer) {
+	s.mcastMu.Lock()
+	if s.mcastTx[k] == t {
+		delete(s.mcastTx, k)
+	}
+	delete(s.mcastPorts, t.group.Port)
+	s.mcastMu.Unlock()
+}
+
+// mcastSource is the data of a multicast transfer, read again from the
+// start of a block when a promoted master asks for blocks it missed.
+type mcastSource struct {
+	rs    io.Seeker
+	start int64 // offset of block 1
+}
+
+// rewindACK is the ACK of the new master for an older block than
+// the one being sent. The transfer continues with the block after it.
+type rewindACK uint16
+
+func (b rewindACK) Error() string {
+	return fmt.Sprintf("master needs the blocks after %d", uint16(b))
+}
+
+// mcastOpen lets other clients join the multicast transfer once the
+// options are negotiated. They join after DATA started, so only a
+// transfer that can send the blocks they missed again accepts them:
+// one in lockstep, without windowsize or sender anticipation, of data
+// that can be read again from r. Others ask for a transfer of their own.
+func (s *sender) mcastOpen(r io.Reader) {
+	if rs, ok := r.(io.Seeker); ok && s.window <= 1 && !s.sendA.enabled {
+		if start, err := rs.Seek(0, io.SeekCurrent); err == nil {
+			s.mcastSrc = &mcastSource{rs: rs, start: start}
+			s.mcastTx.setOptions(s.opts, s.optOrder)
+			return
+		}
+	}
+	s.mcastTx.close()
+}
+
+// rewind continues the transfer with the block after b, which the new
+// master acknowledged. It returns the number of bytes sent before it.
+func (s *sender) rewind(b uint16) (int64, error) {
+	// The distance from block b to the block being sent.
+	d := int(s.block - b)
+	if s.rollover == 1 && b > s.block {
+		d-- // block 0 is skipped on wraparound
+	}
+	if d > s.blocks+1 {
+		return 0, errFutureACK
+	}
+	s.blocks -= d - 1
+	s.block = blockAfter(b, 1, s.rollover)
+	n := int64(s.blocks) * int64(len(s.send)-4)
+	s.bytes = n
+	s.logf("rewinding to block %d for the new master", s.block)
+	_, err := s.mcastSrc.rs.Seek(s.mcastSrc.start+n, io.SeekStart)
+	return n, err
+}
+
+// promote hands the master role over to the next listener once the
+// master stopped acknowledging blocks. The new master acknowledges the
+// last block it received in order, from which the transfer continues,
+// see rewind.
+func (s *sender) promote() bool {
+	if !s.multicast || s.mcastTx == nil || s.mcastSrc == nil {
+		return false
+	}
+	addr := s.mcastTx.next()
+	if addr == nil {
+		return false
+	}
+	s.logf("master %v timed out, %v takes over", s.addr, addr)
+	b := make([]byte, datagramLength)
+	n := packOACK(b, []Option{{Name: "multicast", Value: mcastOption(s.mcast, true)}})
+	if err := s.conn.sendTo(b[:n], addr); err != nil {
+		return false
+	}
+	s.addr = addr
+	s.tid = addr.Port
+	s.resync = true
+	s.retry.reset()
+	return true
+}
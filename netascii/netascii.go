@@ -84,24 +84,34 @@ func FromWriter(w io.Writer) io.Writer {
 func (w *fromWriter) Write(p []byte) (n int, err error) {
 	for n < len(p) {
 		if w.cr {
-			if p[n] == LF {
+			w.cr = false
+			switch p[n] {
+			case LF:
 				w.buf[w.i] = LF
-			}
-			if p[n] == NUL {
+				n++
+			case NUL:
+				w.buf[w.i] = CR
+				n++
+			default:
+				// CR that is not followed by LF or NUL is kept as is
+				// and the next byte is processed normally.
 				w.buf[w.i] = CR
 			}
-			w.cr = false
 			w.i++
 		} else if p[n] == CR {
 			w.cr = true
+			n++
 		} else {
 			w.buf[w.i] = p[n]
 			w.i++
+			n++
 		}
-		n++
 		if w.i == len(w.buf) || n == len(p) {
 			_, err = w.w.Write(w.buf[:w.i])
 			w.i = 0
+			if err != nil {
+				return n, err
+			}
 		}
 	}
 	return n, err
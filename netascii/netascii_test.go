@@ -87,3 +87,26 @@ func TestOneByte(t *testing.T) {
 		t.Errorf("text mismatch \n%x \n%x", text, text2)
 	}
 }
+
+func TestFromInvalidCR(t *testing.T) {
+	b := &bytes.Buffer{}
+	from := FromWriter(b)
+	from.Write([]byte("la\rbu\r\r\n"))
+	if b.String() != "la\rbu\r\n" {
+		t.Errorf("unexpected conversion: %q", b.String())
+	}
+}
+
+func TestFromSplitWrites(t *testing.T) {
+	for text, netascii := range basic {
+		for i := 1; i < len(netascii); i++ {
+			b := &bytes.Buffer{}
+			from := FromWriter(b)
+			from.Write([]byte(netascii[:i]))
+			from.Write([]byte(netascii[i:]))
+			if b.String() != text {
+				t.Errorf("%q split at %d: %q != %q", netascii, i, b.String(), text)
+			}
+		}
+	}
+}
@@ -4,24 +4,233 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// Opcode is the type of a packet, the first two bytes on the wire.
+type Opcode uint16
+
+// Opcodes (RFC 1350, RFC 2347)
+const (
+	OpcodeRRQ   Opcode = 1 // Read request (RRQ)
+	OpcodeWRQ   Opcode = 2 // Write request (WRQ)
+	OpcodeDATA  Opcode = 3 // Data
+	OpcodeACK   Opcode = 4 // Acknowledgement
+	OpcodeERROR Opcode = 5 // Error
+	OpcodeOACK  Opcode = 6 // Options Acknowledgment
+)
+
+func (op Opcode) String() string {
+	switch op {
+	case OpcodeRRQ:
+		return "RRQ"
+	case OpcodeWRQ:
+		return "WRQ"
+	case OpcodeDATA:
+		return "DATA"
+	case OpcodeACK:
+		return "ACK"
+	case OpcodeERROR:
+		return "ERROR"
+	case OpcodeOACK:
+		return "OACK"
+	}
+	return fmt.Sprintf("Opcode(%d)", uint16(op))
+}
+
 const (
-	opRRQ   = uint16(1) // Read request (RRQ)
-	opWRQ   = uint16(2) // Write request (WRQ)
-	opDATA  = uint16(3) // Data
-	opACK   = uint16(4) // Acknowledgement
-	opERROR = uint16(5) // Error
-	opOACK  = uint16(6) // Options Acknowledgment
+	opRRQ   = uint16(OpcodeRRQ)
+	opWRQ   = uint16(OpcodeWRQ)
+	opDATA  = uint16(OpcodeDATA)
+	opACK   = uint16(OpcodeACK)
+	opERROR = uint16(OpcodeERROR)
+	opOACK  = uint16(OpcodeOACK)
+)
+
+// ErrorCode is the code carried by an ERROR packet, see TftpError.
+type ErrorCode uint16
+
+// Error codes (RFC 1350, RFC 2347)
+const (
+	CodeNotDefined       ErrorCode = 0 // Not defined, see error message
+	CodeFileNotFound     ErrorCode = 1 // File not found
+	CodeAccessViolation  ErrorCode = 2 // Access violation
+	CodeDiskFull         ErrorCode = 3 // Disk full or allocation exceeded
+	CodeIllegalOperation ErrorCode = 4 // Illegal TFTP operation
+	CodeUnknownTID       ErrorCode = 5 // Unknown transfer ID
+	CodeFileExists       ErrorCode = 6 // File already exists
+	CodeNoSuchUser       ErrorCode = 7 // No such user
+	CodeBadOption        ErrorCode = 8 // Option negotiation failed
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case CodeNotDefined:
+		return "not defined"
+	case CodeFileNotFound:
+		return "file not found"
+	case CodeAccessViolation:
+		return "access violation"
+	case CodeDiskFull:
+		return "disk full or allocation exceeded"
+	case CodeIllegalOperation:
+		return "illegal TFTP operation"
+	case CodeUnknownTID:
+		return "unknown transfer ID"
+	case CodeFileExists:
+		return "file already exists"
+	case CodeNoSuchUser:
+		return "no such user"
+	case CodeBadOption:
+		return "option negotiation failed"
+	}
+	return fmt.Sprintf("ErrorCode(%d)", uint16(c))
+}
+
+const (
+	codeNotDefined       = uint16(CodeNotDefined)
+	codeFileNotFound     = uint16(CodeFileNotFound)
+	codeAccessViolation  = uint16(CodeAccessViolation)
+	codeDiskFull         = uint16(CodeDiskFull)
+	codeIllegalOperation = uint16(CodeIllegalOperation)
+	codeUnknownTID       = uint16(CodeUnknownTID)
+	codeFileExists       = uint16(CodeFileExists)
+	codeNoSuchUser       = uint16(CodeNoSuchUser)
+	codeBadOption        = uint16(CodeBadOption)
 )
 
 const (
 	blockLength    = 512
 	datagramLength = 516
+	minBlockLength = 8     // smallest blksize allowed by RFC 2348
+	maxBlockLength = 65464 // largest blksize allowed by RFC 2348
 )
 
+// maxPacketLength is the size of a DATA packet of the largest block size.
+// Requests and OACKs are much smaller, so it limits all packets.
+const maxPacketLength = maxBlockLength + 4
+
 type options map[string]string
 
+// optChecksum is a non-standard option. When both sides agree on it the
+// sender of the data sends a CRC-32 (IEEE) of the whole file in an OACK
+// after the final block is acknowledged and the receiver verifies it.
+const optChecksum = "x-crc32"
+
+// optEncoding is a non-standard option. A client sends x-encoding=gzip to
+// ask for a read request to be served gzip compressed.
+const optEncoding = "x-encoding"
+
+// optAppend is a non-standard option. A client sends x-append=1 with a
+// write request to ask for the data to be appended to the file.
+const optAppend = "x-append"
+
+// Limits of the options of a request accepted by unpackRQ. Requests
+// exceeding them are rejected with error code 8.
+const (
+	maxOptions      = 32
+	maxOptionLength = 255 // of the name and of the value
+)
+
+// copy returns a copy of o, nil if o is nil.
+func (o options) copy() map[string]string {
+	if o == nil {
+		return nil
+	}
+	c := make(map[string]string, len(o))
+	for k, v := range o {
+		c[k] = v
+	}
+	return c
+}
+
+// list returns the options in the order of names, typically the order of
+// the request, followed by the ones not in names sorted by name.
+func (o options) list(names []string) []Option {
+	l := make([]Option, 0, len(o))
+	for _, name := range names {
+		if v, ok := o[name]; ok && !hasOption(l, name) {
+			l = append(l, Option{Name: name, Value: v})
+		}
+	}
+	var rest []string
+	for name := range o {
+		if !hasOption(l, name) {
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(rest)
+	for _, name := range rest {
+		l = append(l, Option{Name: name, Value: o[name]})
+	}
+	return l
+}
+
+func hasOption(l []Option, name string) bool {
+	for _, o := range l {
+		if o.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTimeoutOption parses value of the timeout option (RFC 2349).
+func parseTimeoutOption(value string) (time.Duration, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if n < 1 || n > 255 {
+		return 0, fmt.Errorf("timeout out of range: %d", n)
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+// parseBlockSizeOption parses value of the blksize option (RFC 2348).
+// A value it fails for is clearly invalid, unlike one larger than a peer
+// supports, which the peer lowers, so it is rejected with error code 8
+// even when the peer is not strict.
+func parseBlockSizeOption(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if n < minBlockLength || n > maxBlockLength {
+		return 0, fmt.Errorf("blksize out of range: %d", n)
+	}
+	return n, nil
+}
+
+// parseWindowSizeOption parses value of the windowsize option (RFC 7440).
+func parseWindowSizeOption(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if n < 1 || n > 65535 {
+		return 0, fmt.Errorf("windowsize out of range: %d", n)
+	}
+	return n, nil
+}
+
+// timeoutOption converts t to a timeout option value rounding it up to
+// whole seconds.
+func timeoutOption(t time.Duration) string {
+	n := int((t + time.Second - 1) / time.Second)
+	if n < 1 {
+		n = 1
+	}
+	if n > 255 {
+		n = 255
+	}
+	return strconv.Itoa(n)
+}
+
 // RRQ/WRQ packet
 //
 //  2 bytes     string    1 byte    string    1 byte
@@ -53,50 +262,194 @@ func packRQ(p []byte, op uint16, filename, mode string, opts options) int {
 }
 
 func unpackRQ(p []byte) (filename, mode string, opts options, err error) {
+	filename, mode, list, err := splitRQ(p)
+	if err != nil || len(list) == 0 {
+		return filename, mode, nil, err
+	}
+	if len(list) > maxOptions {
+		return "", "", nil, &TftpError{Code: codeBadOption,
+			Message: fmt.Sprintf("more than %d options", maxOptions)}
+	}
+	for _, o := range list {
+		if len(o.Name) > maxOptionLength || len(o.Value) > maxOptionLength {
+			return "", "", nil, &TftpError{Code: codeBadOption,
+				Message: fmt.Sprintf("option longer than %d bytes", maxOptionLength)}
+		}
+	}
+	opts = make(options)
+	for _, o := range list {
+		// option names are case insensitive (RFC 2347)
+		opts[strings.ToLower(o.Name)] = o.Value
+	}
+	return filename, mode, opts, nil
+}
+
+// optionOrder returns the lower case names of the options of request p in
+// the order they appear on the wire.
+func optionOrder(p []byte) []string {
+	_, _, list, _ := splitRQ(p)
+	names := make([]string, len(list))
+	for i, o := range list {
+		names[i] = strings.ToLower(o.Name)
+	}
+	return names
+}
+
+// splitRQ unpacks a request keeping options in the order they appear on
+// the wire. An empty option name ends the request, some clients pad
+// requests with zeros or garbage after the final terminator.
+func splitRQ(p []byte) (filename, mode string, opts []Option, err error) {
+	op := Opcode(binary.BigEndian.Uint16(p))
 	bs := bytes.Split(p[2:], []byte{0})
 	if len(bs) < 2 {
-		return "", "", nil, fmt.Errorf("missing filename or mode")
+		return "", "", nil, &ParseError{Opcode: op, Offset: len(p),
+			Reason: "missing mode"}
 	}
 	filename = string(bs[0])
 	mode = string(bs[1])
-	if len(bs) < 4 {
-		return filename, mode, nil, nil
+	tail := bs[2:]
+	if n := len(tail); n > 0 && len(tail[n-1]) == 0 {
+		tail = tail[:n-1] // empty string after the final terminator
 	}
-	opts = make(options)
-	for i := 2; i+1 < len(bs); i += 2 {
-		opts[string(bs[i])] = string(bs[i+1])
+	padded := false
+	for i := 0; i < len(tail); i += 2 {
+		if len(tail[i]) == 0 {
+			tail, padded = tail[:i], true
+			break
+		}
+	}
+	if len(tail)%2 != 0 {
+		name := tail[len(tail)-1]
+		return "", "", nil, &ParseError{Opcode: op, Offset: len(p) - len(name),
+			Reason: fmt.Sprintf("option %q has no value", name)}
+	}
+	if !padded && p[len(p)-1] != 0 {
+		return "", "", nil, &ParseError{Opcode: op, Offset: len(p),
+			Reason: "unterminated string"}
+	}
+	for i := 0; i+1 < len(tail); i += 2 {
+		opts = append(opts, Option{Name: string(tail[i]), Value: string(tail[i+1])})
 	}
 	return filename, mode, opts, nil
 }
 
+// RRQ is a read request packet.
+type RRQ struct {
+	Filename string
+	Mode     string
+	Options  []Option
+}
+
+// Pack returns wire representation of the packet.
+func (p *RRQ) Pack() []byte {
+	return packRequest(OpcodeRRQ, p.Filename, p.Mode, p.Options)
+}
+
+// WRQ is a write request packet.
+type WRQ struct {
+	Filename string
+	Mode     string
+	Options  []Option
+}
+
+// Pack returns wire representation of the packet.
+func (p *WRQ) Pack() []byte {
+	return packRequest(OpcodeWRQ, p.Filename, p.Mode, p.Options)
+}
+
+func packRequest(op Opcode, filename, mode string, opts []Option) []byte {
+	n := 2 + len(filename) + len(mode) + 2
+	for _, o := range opts {
+		n += len(o.Name) + len(o.Value) + 2
+	}
+	b := make([]byte, n)
+	binary.BigEndian.PutUint16(b, uint16(op))
+	n = 2
+	for _, s := range []string{filename, mode} {
+		n += copy(b[n:], s)
+		n++
+	}
+	for _, o := range opts {
+		n += copy(b[n:], o.Name)
+		n++
+		n += copy(b[n:], o.Value)
+		n++
+	}
+	return b
+}
+
+// Option is a single option name and value pair (RFC 2347).
+type Option struct {
+	Name  string
+	Value string
+}
+
 // OACK packet
 //
 // +----------+---~~---+---+---~~---+---+---~~---+---+---~~---+---+
 // |  Opcode  |  opt1  | 0 | value1 | 0 |  optN  | 0 | valueN | 0 |
 // +----------+---~~---+---+---~~---+---+---~~---+---+---~~---+---+
-type pOACK []byte
+//
+// OACK is an Option Acknowledgment packet (RFC 2347). Options are kept in
+// the order they appear on the wire.
+type OACK struct {
+	Options []Option
+}
+
+// Pack returns wire representation of the packet.
+func (p *OACK) Pack() []byte {
+	n := 2
+	for _, o := range p.Options {
+		n += len(o.Name) + len(o.Value) + 2
+	}
+	b := make([]byte, n)
+	binary.BigEndian.PutUint16(b, uint16(OpcodeOACK))
+	n = 2
+	for _, o := range p.Options {
+		n += copy(b[n:], o.Name)
+		n++
+		n += copy(b[n:], o.Value)
+		n++
+	}
+	return b
+}
+
+func (p *OACK) options() options {
+	opts := make(options, len(p.Options))
+	for _, o := range p.Options {
+		opts[o.Name] = o.Value
+	}
+	return opts
+}
 
-func packOACK(p []byte, opts options) int {
+func packOACK(p []byte, opts []Option) int {
 	binary.BigEndian.PutUint16(p, opOACK)
 	n := 2
-	for name, value := range opts {
-		n += copy(p[n:], name)
+	for _, o := range opts {
+		n += copy(p[n:], o.Name)
 		p[n] = 0
 		n++
-		n += copy(p[n:], value)
+		n += copy(p[n:], o.Value)
 		p[n] = 0
 		n++
 	}
 	return n
 }
 
-func unpackOACK(p []byte) (opts options, err error) {
+func unpackOACK(p []byte) (*OACK, error) {
+	if p[len(p)-1] != 0 {
+		return nil, &ParseError{Opcode: OpcodeOACK, Offset: len(p),
+			Reason: "unterminated string"}
+	}
 	bs := bytes.Split(p[2:], []byte{0})
-	opts = make(options)
+	oack := &OACK{}
 	for i := 0; i+1 < len(bs); i += 2 {
-		opts[string(bs[i])] = string(bs[i+1])
+		oack.Options = append(oack.Options, Option{
+			Name:  string(bs[i]),
+			Value: string(bs[i+1]),
+		})
 	}
-	return opts, nil
+	return oack, nil
 }
 
 // ERROR packet
@@ -119,8 +472,30 @@ func (p pERROR) code() uint16 {
 	return binary.BigEndian.Uint16(p[2:])
 }
 
+// message returns the error message up to the first zero byte, ignoring
+// any padding after it.
 func (p pERROR) message() string {
-	return string(p[4:])
+	m := p[4:]
+	if i := bytes.IndexByte(m, 0); i >= 0 {
+		m = m[:i]
+	}
+	return string(m)
+}
+
+// ERROR is an error packet. Transfers report errors received from the
+// peer as TftpError.
+type ERROR struct {
+	Code    ErrorCode
+	Message string
+}
+
+// Pack returns wire representation of the packet.
+func (p *ERROR) Pack() []byte {
+	b := make([]byte, len(p.Message)+5)
+	binary.BigEndian.PutUint16(b, uint16(OpcodeERROR))
+	binary.BigEndian.PutUint16(b[2:], uint16(p.Code))
+	copy(b[4:], p.Message)
+	return b
 }
 
 // DATA packet
@@ -135,6 +510,28 @@ func (p pDATA) block() uint16 {
 	return binary.BigEndian.Uint16(p[2:])
 }
 
+// DATA is a data packet. It is meant for tools and tests that work with
+// individual packets, transfers use their own buffers.
+type DATA struct {
+	Block uint16
+	Data  []byte
+}
+
+// NewDATA returns a DATA packet for block carrying data. The data is not
+// copied.
+func NewDATA(block uint16, data []byte) *DATA {
+	return &DATA{Block: block, Data: data}
+}
+
+// Pack returns wire representation of the packet.
+func (p *DATA) Pack() []byte {
+	b := make([]byte, 4+len(p.Data))
+	binary.BigEndian.PutUint16(b, uint16(OpcodeDATA))
+	binary.BigEndian.PutUint16(b[2:], p.Block)
+	copy(b[4:], p.Data)
+	return b
+}
+
 // ACK packet
 //
 //  2 bytes    2 bytes
@@ -147,44 +544,136 @@ func (p pACK) block() uint16 {
 	return binary.BigEndian.Uint16(p[2:])
 }
 
+// ACK is an acknowledgement packet. Like DATA it is meant for tools and
+// tests.
+type ACK struct {
+	Block uint16
+}
+
+// NewACK returns an ACK packet for block.
+func NewACK(block uint16) *ACK {
+	return &ACK{Block: block}
+}
+
+// Pack returns wire representation of the packet.
+func (p *ACK) Pack() []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint16(b, uint16(OpcodeACK))
+	binary.BigEndian.PutUint16(b[2:], p.Block)
+	return b
+}
+
+// ParseError is returned when a packet is malformed.
+type ParseError struct {
+	Opcode Opcode // opcode of the packet, 0 if the packet is too short
+	Offset int    // offset of the byte where parsing failed
+	Reason string
+}
+
+func (e *ParseError) Error() string {
+	if e.Opcode == 0 {
+		return fmt.Sprintf("parsing packet at offset %d: %s", e.Offset, e.Reason)
+	}
+	return fmt.Sprintf("parsing %v packet at offset %d: %s",
+		e.Opcode, e.Offset, e.Reason)
+}
+
 func parsePacket(p []byte) (interface{}, error) {
 	l := len(p)
 	if l < 2 {
-		return nil, fmt.Errorf("short packet")
+		return nil, &ParseError{Offset: l, Reason: "short packet"}
 	}
-	opcode := binary.BigEndian.Uint16(p)
+	if l > maxPacketLength {
+		return nil, &ParseError{Opcode: Opcode(binary.BigEndian.Uint16(p)),
+			Offset: maxPacketLength, Reason: fmt.Sprintf("packet too large: %d bytes", l)}
+	}
+	opcode := Opcode(binary.BigEndian.Uint16(p))
+	// minimal length of each packet type
+	var min int
 	switch opcode {
-	case opRRQ:
-		if l < 4 {
-			return nil, fmt.Errorf("short RRQ packet: %d", l)
-		}
+	case OpcodeRRQ, OpcodeWRQ, OpcodeDATA, OpcodeACK:
+		min = 4
+	case OpcodeERROR:
+		min = 5
+	case OpcodeOACK:
+		min = 6
+	default:
+		return nil, &ParseError{Opcode: opcode, Offset: 0, Reason: "unknown opcode"}
+	}
+	if l < min {
+		return nil, &ParseError{Opcode: opcode, Offset: l,
+			Reason: fmt.Sprintf("short packet: %d bytes", l)}
+	}
+	switch opcode {
+	case OpcodeRRQ:
 		return pRRQ(p), nil
-	case opWRQ:
-		if l < 4 {
-			return nil, fmt.Errorf("short WRQ packet: %d", l)
-		}
+	case OpcodeWRQ:
 		return pWRQ(p), nil
-	case opDATA:
-		if l < 4 {
-			return nil, fmt.Errorf("short DATA packet: %d", l)
-		}
+	case OpcodeDATA:
 		return pDATA(p), nil
-	case opACK:
-		if l < 4 {
-			return nil, fmt.Errorf("short ACK packet: %d", l)
-		}
+	case OpcodeACK:
 		return pACK(p), nil
-	case opERROR:
-		if l < 5 {
-			return nil, fmt.Errorf("short ERROR packet: %d", l)
-		}
+	case OpcodeERROR:
 		return pERROR(p), nil
-	case opOACK:
-		if l < 6 {
-			return nil, fmt.Errorf("short OACK packet: %d", l)
+	default:
+		return unpackOACK(p)
+	}
+}
+
+// Packet is a TFTP packet: *RRQ, *WRQ, *DATA, *ACK, *ERROR or *OACK.
+//
+// The packet types, ParsePacket and ReadPacket do not depend on Client or
+// Server state and are safe to use directly, e.g. to implement relays or
+// to feed fuzzers. Transfers driven with them are not subject to any of
+// the retransmission or option negotiation logic of this package.
+type Packet interface {
+	// Pack returns wire representation of the packet.
+	Pack() []byte
+}
+
+// ParsePacket parses wire representation of a packet. Malformed packets,
+// including ones with unterminated strings and ones larger than a DATA
+// packet of the largest block size, are reported with *ParseError. Bytes
+// following the terminator of an ERROR message or the last string of a
+// request are ignored. Data of a returned DATA packet refers to b, other
+// packets do not keep references to it.
+func ParsePacket(b []byte) (Packet, error) {
+	p, err := parsePacket(b)
+	if err != nil {
+		return nil, err
+	}
+	switch p := p.(type) {
+	case pRRQ:
+		filename, mode, opts, err := splitRQ(p)
+		if err != nil {
+			return nil, err
 		}
-		return pOACK(p), nil
+		return &RRQ{Filename: filename, Mode: mode, Options: opts}, nil
+	case pWRQ:
+		filename, mode, opts, err := splitRQ(p)
+		if err != nil {
+			return nil, err
+		}
+		return &WRQ{Filename: filename, Mode: mode, Options: opts}, nil
+	case pDATA:
+		return &DATA{Block: p.block(), Data: p[4:]}, nil
+	case pACK:
+		return &ACK{Block: p.block()}, nil
+	case pERROR:
+		return &ERROR{Code: ErrorCode(p.code()), Message: p.message()}, nil
 	default:
-		return nil, fmt.Errorf("unknown opcode: %d", opcode)
+		return p.(*OACK), nil
+	}
+}
+
+// ReadPacket reads a single datagram from conn and parses it. The source
+// address is returned even if the packet is malformed.
+func ReadPacket(conn *net.UDPConn) (Packet, *net.UDPAddr, error) {
+	b := make([]byte, 65536)
+	n, addr, err := conn.ReadFromUDP(b)
+	if err != nil {
+		return nil, nil, err
 	}
+	p, err := ParsePacket(b[:n])
+	return p, addr, err
 }
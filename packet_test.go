@@ -0,0 +1,365 @@
+package tftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOACKPack(t *testing.T) {
+	oack := &OACK{Options: []Option{
+		{Name: "blksize", Value: "1428"},
+		{Name: "tsize", Value: "1048576"},
+		{Name: "timeout", Value: "3"},
+	}}
+	want := []byte("\x00\x06blksize\x001428\x00tsize\x001048576\x00timeout\x003\x00")
+	got := oack.Pack()
+	if !bytes.Equal(got, want) {
+		t.Fatalf("packed OACK mismatch:\n got: %q\nwant: %q", got, want)
+	}
+	p, err := parsePacket(got)
+	if err != nil {
+		t.Fatalf("parsing OACK: %v", err)
+	}
+	parsed, ok := p.(*OACK)
+	if !ok {
+		t.Fatalf("OACK expected, got %T", p)
+	}
+	if len(parsed.Options) != len(oack.Options) {
+		t.Fatalf("options count mismatch: %d != %d",
+			len(parsed.Options), len(oack.Options))
+	}
+	for i, o := range oack.Options {
+		if parsed.Options[i] != o {
+			t.Errorf("option %d mismatch: %v != %v", i, parsed.Options[i], o)
+		}
+	}
+	if !bytes.Equal(parsed.Pack(), want) {
+		t.Errorf("repacked OACK mismatch: %q", parsed.Pack())
+	}
+}
+
+func TestUnpackRQOptions(t *testing.T) {
+	p := []byte("\x00\x02upload.bin\x00octet\x00BlkSize\x001428\x00TSIZE\x0012345\x00")
+	filename, mode, opts, err := unpackRQ(p)
+	if err != nil {
+		t.Fatalf("unpacking WRQ: %v", err)
+	}
+	if filename != "upload.bin" || mode != "octet" {
+		t.Errorf("filename or mode mismatch: %q, %q", filename, mode)
+	}
+	if len(opts) != 2 || opts["blksize"] != "1428" || opts["tsize"] != "12345" {
+		t.Errorf("options mismatch: %v", opts)
+	}
+
+	p = []byte("\x00\x02upload.bin\x00octet\x00blksize\x001428\x00tsize\x00")
+	_, _, _, err = unpackRQ(p)
+	if err == nil {
+		t.Errorf("error expected for option without value")
+	}
+}
+
+func TestOptionOrder(t *testing.T) {
+	p := []byte("\x00\x01file\x00octet\x00TSize\x000\x00blksize\x001024\x00")
+	order := optionOrder(p)
+	if !reflect.DeepEqual(order, []string{"tsize", "blksize"}) {
+		t.Fatalf("order mismatch: %v", order)
+	}
+	opts := options{"blksize": "1024", "tsize": "100", "timeout": "2"}
+	l := opts.list(order)
+	want := []Option{{"tsize", "100"}, {"blksize", "1024"}, {"timeout", "2"}}
+	if !reflect.DeepEqual(l, want) {
+		t.Errorf("list mismatch: %v, want %v", l, want)
+	}
+}
+
+func TestDATAPack(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("hello"), make([]byte, 512)} {
+		d := NewDATA(65535, data)
+		b := d.Pack()
+		if len(b) != 4+len(data) {
+			t.Fatalf("packed DATA length %d, expected %d", len(b), 4+len(data))
+		}
+		p, err := parsePacket(b)
+		if err != nil {
+			t.Fatalf("parsing DATA: %v", err)
+		}
+		parsed, ok := p.(pDATA)
+		if !ok {
+			t.Fatalf("DATA expected, got %T", p)
+		}
+		if parsed.block() != d.Block {
+			t.Errorf("block mismatch: %d != %d", parsed.block(), d.Block)
+		}
+		if !bytes.Equal(parsed[4:], data) {
+			t.Errorf("data mismatch: %q != %q", parsed[4:], data)
+		}
+	}
+}
+
+func TestACKPack(t *testing.T) {
+	want := []byte("\x00\x04\x01\x02")
+	got := NewACK(0x0102).Pack()
+	if !bytes.Equal(got, want) {
+		t.Fatalf("packed ACK mismatch:\n got: %q\nwant: %q", got, want)
+	}
+	p, err := parsePacket(got)
+	if err != nil {
+		t.Fatalf("parsing ACK: %v", err)
+	}
+	parsed, ok := p.(pACK)
+	if !ok {
+		t.Fatalf("ACK expected, got %T", p)
+	}
+	if parsed.block() != 0x0102 {
+		t.Errorf("block mismatch: %d", parsed.block())
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for _, tt := range []struct {
+		packet []byte
+		opcode Opcode
+		offset int
+	}{
+		{[]byte("\x00"), 0, 1},
+		{[]byte("\x00\x09\x00\x00"), 9, 0},
+		{[]byte("\x00\x03\x00"), OpcodeDATA, 3},
+		{[]byte("\x00\x01"), OpcodeRRQ, 2},
+	} {
+		_, err := parsePacket(tt.packet)
+		e, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("%q: ParseError expected, got %v", tt.packet, err)
+			continue
+		}
+		if e.Opcode != tt.opcode || e.Offset != tt.offset {
+			t.Errorf("%q: opcode %d at offset %d expected, got %v",
+				tt.packet, tt.opcode, tt.offset, e)
+		}
+	}
+
+	// truncated requests
+	for _, tt := range []struct {
+		packet string
+		offset int
+	}{
+		{"\x00\x01boot.img", 10},
+		{"\x00\x01boot.img\x00octet\x00blksize", 17},
+	} {
+		_, _, _, err := unpackRQ([]byte(tt.packet))
+		e, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("%q: ParseError expected, got %v", tt.packet, err)
+			continue
+		}
+		if e.Opcode != OpcodeRRQ || e.Offset != tt.offset {
+			t.Errorf("%q: RRQ error at offset %d expected, got %v",
+				tt.packet, tt.offset, e)
+		}
+	}
+}
+
+func TestOpcodeValues(t *testing.T) {
+	for _, tt := range []struct {
+		op   Opcode
+		wire uint16
+		name string
+	}{
+		{OpcodeRRQ, 1, "RRQ"},
+		{OpcodeWRQ, 2, "WRQ"},
+		{OpcodeDATA, 3, "DATA"},
+		{OpcodeACK, 4, "ACK"},
+		{OpcodeERROR, 5, "ERROR"},
+		{OpcodeOACK, 6, "OACK"},
+	} {
+		if uint16(tt.op) != tt.wire || tt.op.String() != tt.name {
+			t.Errorf("%v: wire value %d expected, got %d", tt.op, tt.wire, uint16(tt.op))
+		}
+	}
+	for op, b := range map[Opcode][]byte{
+		OpcodeDATA: NewDATA(1, nil).Pack(),
+		OpcodeACK:  NewACK(1).Pack(),
+		OpcodeOACK: (&OACK{}).Pack(),
+	} {
+		if Opcode(binary.BigEndian.Uint16(b)) != op {
+			t.Errorf("%v packed with opcode %q", op, b[:2])
+		}
+	}
+	for i, code := range []ErrorCode{
+		CodeNotDefined, CodeFileNotFound, CodeAccessViolation,
+		CodeDiskFull, CodeIllegalOperation, CodeUnknownTID,
+		CodeFileExists, CodeNoSuchUser, CodeBadOption,
+	} {
+		if uint16(code) != uint16(i) {
+			t.Errorf("%v: wire value %d expected, got %d", code, i, uint16(code))
+		}
+	}
+}
+
+func TestParsePacket(t *testing.T) {
+	packets := []Packet{
+		&RRQ{Filename: "boot.img", Mode: "octet"},
+		&WRQ{Filename: "upload", Mode: "netascii", Options: []Option{
+			{Name: "blksize", Value: "1428"},
+			{Name: "tsize", Value: "100"},
+		}},
+		&DATA{Block: 7, Data: []byte("hello")},
+		&ACK{Block: 65535},
+		&ERROR{Code: CodeFileNotFound, Message: "no such file"},
+		&OACK{Options: []Option{{Name: "windowsize", Value: "4"}}},
+	}
+	for _, want := range packets {
+		got, err := ParsePacket(want.Pack())
+		if err != nil {
+			t.Errorf("parsing %T: %v", want, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("parsed packet mismatch: got %#v, want %#v", got, want)
+		}
+	}
+	var perr *ParseError
+	if _, err := ParsePacket([]byte("\x00\x07")); !errors.As(err, &perr) {
+		t.Errorf("ParseError expected for unknown opcode, got %v", err)
+	}
+	if _, err := ParsePacket([]byte("\x00\x01file\x00octet\x00blksize\x00")); !errors.As(err, &perr) {
+		t.Errorf("ParseError expected for option without value, got %v", err)
+	}
+}
+
+func TestParsePaddedPacket(t *testing.T) {
+	// Requests and errors padded with zeros to a fixed length, or with
+	// garbage after the final terminator.
+	pad := string(make([]byte, 32))
+	for _, tt := range []struct {
+		packet string
+		want   Packet
+	}{
+		{"\x00\x01boot.img\x00octet\x00" + pad,
+			&RRQ{Filename: "boot.img", Mode: "octet"}},
+		{"\x00\x01boot.img\x00octet\x00\x00\xde\xad",
+			&RRQ{Filename: "boot.img", Mode: "octet"}},
+		{"\x00\x02upload\x00octet\x00blksize\x001428\x00" + pad,
+			&WRQ{Filename: "upload", Mode: "octet", Options: []Option{
+				{Name: "blksize", Value: "1428"},
+			}}},
+		{"\x00\x05\x00\x01no such file\x00" + pad,
+			&ERROR{Code: CodeFileNotFound, Message: "no such file"}},
+		{"\x00\x05\x00\x00disk full\x00\xff\xfe",
+			&ERROR{Code: CodeNotDefined, Message: "disk full"}},
+	} {
+		got, err := ParsePacket([]byte(tt.packet))
+		if err != nil {
+			t.Errorf("%q: %v", tt.packet, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %#v, want %#v", tt.packet, got, tt.want)
+		}
+	}
+	_, mode, _, err := unpackRQ([]byte("\x00\x01boot.img\x00octet\x00" + pad))
+	if err != nil || mode != "octet" {
+		t.Errorf("unpacking padded request: mode %q, %v", mode, err)
+	}
+}
+
+func TestReadPacket(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen UDP: %v", err)
+	}
+	defer conn.Close()
+	peer, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("dial UDP: %v", err)
+	}
+	defer peer.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	want := &DATA{Block: 1, Data: make([]byte, maxBlockLength)}
+	if _, err := peer.Write(want.Pack()); err != nil {
+		t.Fatalf("sending: %v", err)
+	}
+	p, addr, err := ReadPacket(conn)
+	if err != nil {
+		t.Fatalf("reading packet: %v", err)
+	}
+	if addr.String() != peer.LocalAddr().String() {
+		t.Errorf("source address %v, want %v", addr, peer.LocalAddr())
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("packet mismatch: got %T with %d bytes", p, len(p.(*DATA).Data))
+	}
+
+	if _, err := peer.Write([]byte("\x00")); err != nil {
+		t.Fatalf("sending: %v", err)
+	}
+	_, addr, err = ReadPacket(conn)
+	var perr *ParseError
+	if !errors.As(err, &perr) {
+		t.Errorf("ParseError expected, got %v", err)
+	}
+	if addr == nil {
+		t.Errorf("source address expected for malformed packet")
+	}
+}
+
+func TestParsePacketLimits(t *testing.T) {
+	for _, b := range [][]byte{
+		[]byte("\x00\x01file"),
+		[]byte("\x00\x02file\x00octet"),
+		[]byte("\x00\x01file\x00octet\x00blksize\x001024"),
+		[]byte("\x00\x06blksize\x001024"),
+	} {
+		_, err := ParsePacket(b)
+		var perr *ParseError
+		if !errors.As(err, &perr) || perr.Offset != len(b) {
+			t.Errorf("%q: ParseError at offset %d expected, got %v", b, len(b), err)
+		}
+	}
+
+	data := NewDATA(1, make([]byte, maxBlockLength)).Pack()
+	if _, err := ParsePacket(data); err != nil {
+		t.Errorf("DATA of the largest block size: %v", err)
+	}
+	_, err := ParsePacket(append(data, 0))
+	var perr *ParseError
+	if !errors.As(err, &perr) || perr.Offset != maxPacketLength {
+		t.Errorf("ParseError for oversized packet expected, got %v", err)
+	}
+}
+
+func TestUnpackRQLimits(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("\x00\x01boot.img\x00octet\x00")
+	for i := 0; i <= maxOptions; i++ {
+		fmt.Fprintf(&b, "x-opt%d\x001\x00", i)
+	}
+	_, _, _, err := unpackRQ([]byte(b.String()))
+	if e, ok := err.(*TftpError); !ok || e.Code != codeBadOption {
+		t.Errorf("%d options: bad option error expected, got %v", maxOptions+1, err)
+	}
+
+	long := strings.Repeat("a", maxOptionLength+1)
+	for _, p := range []string{
+		"\x00\x01boot.img\x00octet\x00" + long + "\x001\x00",
+		"\x00\x01boot.img\x00octet\x00blksize\x00" + long + "\x00",
+	} {
+		_, _, _, err := unpackRQ([]byte(p))
+		if e, ok := err.(*TftpError); !ok || e.Code != codeBadOption {
+			t.Errorf("long option: bad option error expected, got %v", err)
+		}
+	}
+
+	p := "\x00\x01boot.img\x00octet\x00blksize\x00" + long[1:] + "\x00"
+	if _, _, _, err := unpackRQ([]byte(p)); err != nil {
+		t.Errorf("option of %d bytes: %v", maxOptionLength, err)
+	}
+}
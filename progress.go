@@ -0,0 +1,80 @@
+package tftp
+
+import (
+	"strconv"
+	"sync"
+)
+
+// progress delivers transfer progress to a user callback. The callback
+// runs in a separate goroutine so that a slow callback does not stall the
+// transfer; updates that arrive while it is running are coalesced.
+type progress struct {
+	f      func(bytes, total int64)
+	mu     sync.Mutex
+	bytes  int64
+	total  int64
+	notify chan struct{}
+	done   chan struct{}
+}
+
+// newProgress returns nil if f is nil. All methods of progress are no-op
+// on nil receiver.
+func newProgress(f func(bytes, total int64), total int64) *progress {
+	if f == nil {
+		return nil
+	}
+	p := &progress{
+		f:      f,
+		total:  total,
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *progress) run() {
+	defer close(p.done)
+	last := int64(-1)
+	for range p.notify {
+		p.mu.Lock()
+		bytes, total := p.bytes, p.total
+		p.mu.Unlock()
+		if bytes != last {
+			p.f(bytes, total)
+			last = bytes
+		}
+	}
+}
+
+func (p *progress) update(bytes int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.bytes = bytes
+	p.mu.Unlock()
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+// close waits until the callback has seen the last update.
+func (p *progress) close() {
+	if p == nil {
+		return
+	}
+	close(p.notify)
+	<-p.done
+}
+
+// tsizeTotal returns the value of tsize option or -1 if it is absent.
+func tsizeTotal(opts options) int64 {
+	if s, ok := opts["tsize"]; ok {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n
+		}
+	}
+	return -1
+}
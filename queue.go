@@ -0,0 +1,90 @@
+package tftp
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// errServerBusy rejects requests when all transfer slots are taken.
+var errServerBusy = &TftpError{Code: codeNotDefined, Message: "server busy"}
+
+// SetQueueDepth makes the server queue up to n requests received while
+// the limit set with SetMaxConcurrent is reached, instead of rejecting
+// them. Queued requests are started in the order they arrived as running
+// transfers end, and new requests queue up behind them rather than take a
+// slot that frees up. If no slot frees up while the client still waits for
+// a reply, for the timeout times the number of retries, the request is
+// rejected with a "server busy" error, as are requests beyond n queued
+// ones. Retransmissions of a queued request are ignored. Zero, the
+// default, disables the queue.
+func (s *Server) SetQueueDepth(n int) {
+	s.queueDepth = n
+}
+
+// waiter is a queued request.
+type waiter struct {
+	addr  string
+	ready chan struct{} // closed when the request is given a slot
+}
+
+// admit reserves a transfer slot for the request op from addr, or a place
+// in the queue if all slots are taken or other requests wait for one. The
+// request is rejected otherwise. The returned waiter is nil if the request
+// got a slot.
+func (s *Server) admit(op string, addr *net.UDPAddr) (*waiter, error) {
+	s.queueMu.Lock()
+	if len(s.queued) == 0 && s.acquire() {
+		s.queueMu.Unlock()
+		return nil, nil
+	}
+	if len(s.queued) < s.queueDepth {
+		w := &waiter{addr: addr.String(), ready: make(chan struct{})}
+		s.queued = append(s.queued, w)
+		s.queueMu.Unlock()
+		s.log.Printf("%s from %v queued", op, addr)
+		return w, nil
+	}
+	s.queueMu.Unlock()
+	s.reject(addr, errServerBusy.Code, errServerBusy.Message)
+	return nil, fmt.Errorf("rejecting %s from %v: too many transfers", op, addr)
+}
+
+// isQueued reports whether a request from addr waits in the queue.
+func (s *Server) isQueued(addr *net.UDPAddr) bool {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	for _, w := range s.queued {
+		if w.addr == addr.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// unqueue removes w from the queue. It returns false if w was given a
+// slot already, which it then holds.
+func (s *Server) unqueue(w *waiter) bool {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	for i, q := range s.queued {
+		if q == w {
+			s.queued = append(s.queued[:i], s.queued[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// dequeue waits until the queued request w is given a transfer slot. It
+// returns false if that did not happen in time or the server shuts down.
+func (s *Server) dequeue(w *waiter) bool {
+	select {
+	case <-w.ready:
+		return true
+	case <-s.clock.After(s.timeout * time.Duration(s.retries)):
+	case <-s.stop:
+	}
+	// The slot may have been given to w in the meantime.
+	return !s.unqueue(w)
+}
@@ -0,0 +1,48 @@
+package tftp
+
+import (
+	"context"
+	"time"
+)
+
+// rateLimiter paces outgoing data using a token bucket. The bucket
+// starts empty and holds at most 100ms worth of data, so short idle
+// periods (e.g. waiting for an ACK) do not allow big bursts.
+type rateLimiter struct {
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+	clock  clock
+}
+
+// newRateLimiter returns nil if bytesPerSec is not positive. Methods of
+// rateLimiter are no-op on nil receiver.
+func newRateLimiter(bytesPerSec int, c clock) *rateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(bytesPerSec), last: c.Now(), clock: c}
+}
+
+// wait blocks until n bytes may be sent or ctx is done.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	now := l.clock.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if max := l.rate / 10; l.tokens > max {
+		l.tokens = max
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return nil
+	}
+	select {
+	case <-l.clock.After(time.Duration(-l.tokens / l.rate * float64(time.Second))):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
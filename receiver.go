@@ -1,9 +1,14 @@
 package tftp
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
+	"log"
 	"net"
 	"strconv"
 	"time"
@@ -26,6 +31,12 @@ type IncomingTransfer interface {
 func (r *receiver) RemoteAddr() net.UDPAddr { return *r.addr }
 func (r *receiver) LocalIP() net.IP         { return r.localIP }
 
+func (r *receiver) Options() map[string]string { return r.negotiated.copy() }
+
+func (r *receiver) Append() bool {
+	return r.appendOK && r.opts[optAppend] == "1"
+}
+
 func (r *receiver) Size() (n int64, ok bool) {
 	if r.opts != nil {
 		if s, ok := r.opts["tsize"]; ok {
@@ -40,6 +51,7 @@ func (r *receiver) Size() (n int64, ok bool) {
 }
 
 type receiver struct {
+	ctx            context.Context
 	send           []byte
 	receive        []byte
 	addr           *net.UDPAddr
@@ -48,26 +60,53 @@ type receiver struct {
 	tid            int
 	conn           connection
 	block          uint16
+	rollover       uint16
 	retry          *backoff
 	timeout        time.Duration
 	retries        int
 	l              int
 	autoTerm       bool
-	dally          bool
+	dally          time.Duration
 	mode           string
 	opts           options
+	optOrder       []string // option names in request order
+	negotiated     options
 	singlePort     bool
 	maxBlockLen    int
+	window         int
+	maxWindow      int
+	unacked        int
 	hook           Hook
+	onProgress     func(bytes, total int64)
+	onEvent        func(Event)
+	onRetry        func(block uint16, attempt int)
+	crc            hash.Hash32 // checksum of data received, see x-crc32 option
+	state          *transferState
+	clock          clock
+	log            *log.Logger // transfer logger, may be nil
+	strict         bool
+	appendOK       bool // x-append may be acknowledged
+	maxSize        int64
 	startTime      time.Time
 	datagramsSent  int
 	datagramsAcked int
+	blocks         int
+	bytes          int64
+	retransmits    int
+	pipe           *io.PipeReader // see Read
+	onData         func()         // called once when DATA first arrives
 }
 
 func (r *receiver) WriteTo(w io.Writer) (n int64, err error) {
 	if r.mode == "netascii" {
 		w = netascii.FromWriter(w)
 	}
+	p := newProgress(r.onProgress, tsizeTotal(r.opts))
+	defer p.close()
+	if size, ok := r.Size(); ok && r.maxSize > 0 && size > r.maxSize {
+		r.abort(ErrDiskFull)
+		return 0, ErrDiskFull
+	}
 	if r.opts != nil {
 		err := r.sendOptions()
 		if err != nil {
@@ -78,25 +117,52 @@ func (r *receiver) WriteTo(w io.Writer) (n int64, err error) {
 	binary.BigEndian.PutUint16(r.send[0:2], opACK)
 	for {
 		if r.l > 0 {
+			if r.maxSize > 0 && n+int64(r.l-4) > r.maxSize {
+				r.abort(ErrDiskFull)
+				return n, ErrDiskFull
+			}
+			if r.crc != nil {
+				r.crc.Write(r.receive[4:r.l])
+			}
 			l, err := w.Write(r.receive[4:r.l])
 			n += int64(l)
 			if err != nil {
 				r.abort(err)
 				return n, err
 			}
+			r.blocks++
+			r.bytes += int64(l)
+			p.update(n)
+			r.emit(EventBlock, nil)
 			if r.l < len(r.receive) {
+				if r.crc != nil {
+					if err := r.verifyChecksum(); err != nil {
+						r.abort(err)
+						return n, err
+					}
+				}
 				if r.autoTerm {
-					r.terminate()
+					if err := r.terminate(); err != nil {
+						return n, err
+					}
 				}
 				return n, nil
 			}
+			r.unacked++
 		}
 		binary.BigEndian.PutUint16(r.send[2:4], r.block)
-		r.block++ // send ACK for current block and expect next one
-		ll, _, err := r.receiveWithRetry(4)
+		r.block = blockAfter(r.block, 1, r.rollover)
+		var ll int
+		if r.unacked > 0 && r.unacked < r.window {
+			// expect next block of the window without ACK
+			ll, err = r.receiveWindowed()
+		} else {
+			// send ACK for current block and expect next one
+			ll, _, err = r.receiveWithRetry(4)
+		}
 		if err != nil {
 			r.abort(err)
-			return n, err
+			return n, r.truncated(err)
 		}
 		r.l = ll
 	}
@@ -107,15 +173,54 @@ func (r *receiver) sendOptions() error {
 		if name == "blksize" {
 			err := r.setBlockSize(value)
 			if err != nil {
+				return badOption(name, value)
+			}
+		} else if name == "timeout" {
+			t, err := parseTimeoutOption(value)
+			if err != nil {
+				if r.strict {
+					return badOption(name, value)
+				}
+				delete(r.opts, name)
+				continue
+			}
+			r.timeout = t
+		} else if name == "windowsize" {
+			n, err := parseWindowSizeOption(value)
+			if err != nil && r.strict {
+				return badOption(name, value)
+			}
+			if err != nil || r.maxWindow < 2 {
 				delete(r.opts, name)
 				continue
 			}
+			if n > r.maxWindow {
+				n = r.maxWindow
+				r.opts[name] = strconv.Itoa(n)
+			}
+			r.window = n
+		} else if name == optChecksum {
+			r.crc = crc32.NewIEEE()
+		} else if name == optAppend {
+			if value != "1" && r.strict {
+				return badOption(name, value)
+			}
+			if value != "1" || !r.appendOK {
+				delete(r.opts, name)
+				continue
+			}
+		} else if name == "tsize" {
+			// Known, see Size, but not acknowledged.
+			delete(r.opts, name)
+		} else if r.strict {
+			return badOption(name, value)
 		} else {
 			delete(r.opts, name)
 		}
 	}
 	if len(r.opts) > 0 {
-		m := packOACK(r.send, r.opts)
+		m := packOACK(r.send, r.opts.list(r.optOrder))
+		r.negotiated = r.opts
 		r.block = 1 // expect data block number 1
 		ll, _, err := r.receiveWithRetry(m)
 		if err != nil {
@@ -128,21 +233,15 @@ func (r *receiver) sendOptions() error {
 }
 
 func (r *receiver) setBlockSize(blksize string) error {
-	n, err := strconv.Atoi(blksize)
+	n, err := parseBlockSizeOption(blksize)
 	if err != nil {
 		return err
 	}
-	if n < 512 {
-		return fmt.Errorf("blksize too small: %d", n)
-	}
-	if n > 65464 {
-		return fmt.Errorf("blksize too large: %d", n)
-	}
 	if r.maxBlockLen > 0 && n > r.maxBlockLen {
 		n = r.maxBlockLen
 		r.opts["blksize"] = strconv.Itoa(n)
 	}
-	r.receive = make([]byte, n+4)
+	r.receive = make([]byte, n+4, n+5)
 	return nil
 }
 
@@ -150,8 +249,13 @@ func (r *receiver) receiveWithRetry(l int) (int, *net.UDPAddr, error) {
 	r.retry.reset()
 	for {
 		n, addr, err := r.receiveDatagram(l)
-		if _, ok := err.(net.Error); ok && r.retry.count() < r.retries {
+		if err != nil && r.ctx.Err() != nil {
+			return 0, nil, r.ctx.Err()
+		}
+		if isTimeout(err) && r.retry.count() < r.retries {
+			r.logf("timeout waiting for DATA %d, retransmitting", r.block)
 			r.retry.backoff()
+			r.retransmitted()
 			continue
 		}
 		return n, addr, err
@@ -159,7 +263,8 @@ func (r *receiver) receiveWithRetry(l int) (int, *net.UDPAddr, error) {
 }
 
 func (r *receiver) receiveDatagram(l int) (int, *net.UDPAddr, error) {
-	err := r.conn.setDeadline(r.timeout)
+	r.state.update(r.block, r.retransmits)
+	err := r.conn.setDeadline(r.retry.timeout(r.timeout))
 	if err != nil {
 		return 0, nil, err
 	}
@@ -168,12 +273,14 @@ func (r *receiver) receiveDatagram(l int) (int, *net.UDPAddr, error) {
 		return 0, nil, err
 	}
 	r.datagramsSent++
+	r.unacked = 0
 	for {
-		c, addr, err := r.conn.readFrom(r.receive)
+		c, addr, err := r.conn.readFrom(r.receive[:cap(r.receive)])
 		if err != nil {
 			return 0, nil, err
 		}
 		if !addr.IP.Equal(r.addr.IP) || (r.tid != 0 && addr.Port != r.tid) {
+			rejectTID(r.conn, addr)
 			continue
 		}
 		p, err := parsePacket(r.receive[:c])
@@ -184,36 +291,213 @@ func (r *receiver) receiveDatagram(l int) (int, *net.UDPAddr, error) {
 		switch p := p.(type) {
 		case pDATA:
 			if p.block() == r.block {
+				if c > len(r.receive) {
+					r.addr = addr
+					r.abort(errOversizedDATA)
+					return 0, addr, errOversizedDATA
+				}
 				r.datagramsAcked++
+				r.dataArrived()
 				return c, addr, nil
 			}
-		case pOACK:
-			opts, err := unpackOACK(p)
+		case *OACK:
 			if r.block != 1 {
+				if err := r.violation(addr, unexpectedPacket(r.receive)); err != nil {
+					return 0, addr, err
+				}
 				continue
 			}
-			if err != nil {
-				r.abort(err)
-				return 0, addr, err
-			}
+			opts := p.options()
 			for name, value := range opts {
+				if _, ok := r.opts[name]; !ok && r.strict {
+					r.addr = addr
+					r.abort(badOption(name, value))
+					return 0, addr, badOption(name, value)
+				}
 				if name == "blksize" {
-					err := r.setBlockSize(value)
+					err := checkBlockSizeOffer(r.opts, value)
+					if err == nil {
+						err = r.setBlockSize(value)
+					}
+					if err != nil {
+						r.addr = addr
+						r.abort(badOption(name, value))
+						return 0, addr, err
+					}
+				} else if name == "timeout" {
+					if t, err := parseTimeoutOption(value); err == nil {
+						r.timeout = t
+					}
+				} else if name == "windowsize" {
+					n, err := checkWindowSizeOffer(r.opts, value)
 					if err != nil {
-						continue
+						r.addr = addr
+						r.abort(badOption(name, value))
+						return 0, addr, err
+					}
+					r.window = n
+				} else if name == optChecksum {
+					if _, ok := r.opts[name]; ok {
+						r.crc = crc32.NewIEEE()
 					}
 				}
 			}
 			r.block = 0 // ACK with block number 0
 			r.opts = opts
+			r.negotiated = opts.copy()
 			return 0, addr, nil
 		case pERROR:
-			return 0, addr, fmt.Errorf("code: %d, message: %s",
-				p.code(), p.message())
+			return 0, addr, &TftpError{Code: p.code(), Message: p.message()}
+		default:
+			if err := r.violation(addr, unexpectedPacket(r.receive)); err != nil {
+				return 0, addr, err
+			}
+		}
+	}
+}
+
+// receiveWindowed waits for the next block of a window (RFC 7440) without
+// sending an ACK. On timeout or when a block arrives out of order the last
+// block received in order is acknowledged and the regular retry logic
+// takes over.
+func (r *receiver) receiveWindowed() (int, error) {
+	r.state.update(r.block, r.retransmits)
+	err := r.conn.setDeadline(r.timeout)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		c, addr, err := r.conn.readFrom(r.receive[:cap(r.receive)])
+		if err != nil && r.ctx.Err() != nil {
+			return 0, r.ctx.Err()
+		}
+		if isTimeout(err) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !addr.IP.Equal(r.addr.IP) || (r.tid != 0 && addr.Port != r.tid) {
+			rejectTID(r.conn, addr)
+			continue
+		}
+		p, err := parsePacket(r.receive[:c])
+		if err != nil {
+			return 0, err
+		}
+		if p, ok := p.(pERROR); ok {
+			return 0, &TftpError{Code: p.code(), Message: p.message()}
+		}
+		if p, ok := p.(pDATA); ok {
+			if p.block() == r.block {
+				if c > len(r.receive) {
+					r.abort(errOversizedDATA)
+					return 0, errOversizedDATA
+				}
+				r.datagramsAcked++
+				return c, nil
+			}
+			break
+		}
+		if err := r.violation(addr, unexpectedPacket(r.receive)); err != nil {
+			return 0, err
 		}
 	}
+	ll, _, err := r.receiveWithRetry(4)
+	return ll, err
 }
 
+// truncated returns ErrTruncated wrapping err if the transfer ended with
+// a timeout waiting for the next block rather than being canceled.
+func (r *receiver) truncated(err error) error {
+	var ne net.Error
+	if r.ctx.Err() == nil && errors.As(err, &ne) && ne.Timeout() {
+		return &truncatedError{err: ne}
+	}
+	return err
+}
+
+// ErrChecksumMismatch is returned by WriteTo of an incoming transfer when
+// the checksum sent by the peer with the x-crc32 option does not match the
+// data received.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// verifyChecksum acknowledges the final block, waits for the checksum of
+// the data from the sender and confirms it with an ACK for the block after
+// the last one if it matches.
+func (r *receiver) verifyChecksum() error {
+	binary.BigEndian.PutUint16(r.send[2:4], r.block)
+	r.retry.reset()
+	for {
+		sum, err := r.receiveChecksum()
+		if err != nil && r.ctx.Err() != nil {
+			return r.ctx.Err()
+		}
+		if isTimeout(err) && r.retry.count() < r.retries {
+			r.logf("timeout waiting for checksum, retransmitting ACK %d", r.block)
+			r.retry.backoff()
+			r.retransmitted()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if sum != r.crc.Sum32() {
+			return ErrChecksumMismatch
+		}
+		binary.BigEndian.PutUint16(r.send[2:4], blockAfter(r.block, 1, r.rollover))
+		return r.conn.sendTo(r.send[:4], r.addr)
+	}
+}
+
+func (r *receiver) receiveChecksum() (uint32, error) {
+	err := r.conn.setDeadline(r.retry.timeout(r.timeout))
+	if err != nil {
+		return 0, err
+	}
+	err = r.conn.sendTo(r.send[:4], r.addr)
+	if err != nil {
+		return 0, err
+	}
+	r.datagramsSent++
+	for {
+		c, addr, err := r.conn.readFrom(r.receive[:cap(r.receive)])
+		if err != nil {
+			return 0, err
+		}
+		if !addr.IP.Equal(r.addr.IP) || (r.tid != 0 && addr.Port != r.tid) {
+			rejectTID(r.conn, addr)
+			continue
+		}
+		p, err := parsePacket(r.receive[:c])
+		if err != nil {
+			return 0, err
+		}
+		switch p := p.(type) {
+		case *OACK:
+			value, ok := p.options()[optChecksum]
+			if !ok {
+				continue
+			}
+			sum, err := strconv.ParseUint(value, 16, 32)
+			if err != nil {
+				return 0, &TftpError{Code: codeBadOption,
+					Message: fmt.Sprintf("invalid %s value: %q", optChecksum, value)}
+			}
+			return uint32(sum), nil
+		case pERROR:
+			return 0, &TftpError{Code: p.code(), Message: p.message()}
+		}
+		// Retransmissions of the final block are answered when the read
+		// times out.
+	}
+}
+
+// errOversizedDATA is returned when a DATA packet carries more data than
+// the negotiated block size. The buffer that receives packets has one
+// spare byte beyond the block size to detect that.
+var errOversizedDATA = &TftpError{Code: codeIllegalOperation, Message: "DATA packet exceeds block size"}
+
 func (r *receiver) terminate() error {
 	if r.conn == nil {
 		return nil
@@ -222,25 +506,84 @@ func (r *receiver) terminate() error {
 		if r.hook != nil {
 			r.hook.OnSuccess(r.buildTransferStats())
 		}
+		r.emit(EventCompleted, nil)
 		r.conn.close()
 	}()
-	binary.BigEndian.PutUint16(r.send[2:4], r.block)
-	if r.dally {
-		for i := 0; i < 3; i++ {
-			_, _, err := r.receiveDatagram(4)
-			if err != nil {
-				return nil
-			}
-		}
-		return fmt.Errorf("dallying termination failed")
+	if r.crc != nil {
+		// The final block was acknowledged by verifyChecksum.
+		return nil
 	}
+	binary.BigEndian.PutUint16(r.send[2:4], r.block)
 	err := r.conn.sendTo(r.send[:4], r.addr)
 	if err != nil {
 		return err
 	}
+	if r.dally > 0 {
+		r.dallyFinal()
+	}
 	return nil
 }
 
+// dallyFinal waits for the dally period after the final ACK and answers
+// retransmissions of the final block with the ACK again, in case the
+// sender did not get it (RFC 1350, section 6).
+func (r *receiver) dallyFinal() {
+	end := r.clock.Now().Add(r.dally)
+	for {
+		left := end.Sub(r.clock.Now())
+		if left <= 0 || r.conn.setDeadline(left) != nil {
+			return
+		}
+		c, addr, err := r.conn.readFrom(r.receive[:cap(r.receive)])
+		if err != nil {
+			return
+		}
+		if !addr.IP.Equal(r.addr.IP) || addr.Port != r.addr.Port {
+			rejectTID(r.conn, addr)
+			continue
+		}
+		p, err := parsePacket(r.receive[:c])
+		if err != nil {
+			continue
+		}
+		if d, ok := p.(pDATA); ok && d.block() == r.block {
+			if r.conn.sendTo(r.send[:4], r.addr) != nil {
+				return
+			}
+			r.datagramsSent++
+		}
+	}
+}
+
+// dataArrived calls onData the first time it is called.
+func (r *receiver) dataArrived() {
+	if r.onData != nil {
+		r.onData()
+		r.onData = nil
+	}
+}
+
+// retransmitted counts a retransmission after a timeout and reports it to
+// the function set with SetOnRetransmit.
+func (r *receiver) retransmitted() {
+	r.retransmits++
+	if r.onRetry != nil {
+		r.onRetry(r.block, r.retry.count())
+	}
+}
+
+// violation aborts the transfer with err if the receiver is strict and err
+// is not nil. Otherwise the packet received from addr is ignored and nil
+// is returned.
+func (r *receiver) violation(addr *net.UDPAddr, err error) error {
+	if !r.strict || err == nil {
+		return nil
+	}
+	r.addr = addr
+	r.abort(err)
+	return err
+}
+
 func (r *receiver) buildTransferStats() TransferStats {
 	return TransferStats{
 		RemoteAddr:     r.addr.IP,
@@ -248,9 +591,40 @@ func (r *receiver) buildTransferStats() TransferStats {
 		Tid:            r.tid,
 		Mode:           r.mode,
 		Opts:           r.opts,
-		Duration:       time.Now().Sub(r.startTime),
+		Duration:       r.clock.Now().Sub(r.startTime),
 		DatagramsSent:  r.datagramsSent,
 		DatagramsAcked: r.datagramsAcked,
+		Blocks:         r.blocks,
+		Bytes:          r.bytes,
+		Retransmits:    r.retransmits,
+	}
+}
+
+// emit reports an event of the transfer to the event handler, if any.
+func (r *receiver) emit(t EventType, err error) {
+	switch t {
+	case EventCompleted:
+		r.logf("received %d blocks, %d bytes", r.blocks, r.bytes)
+	case EventFailed:
+		r.logf("transfer failed at block %d: %v", r.block, err)
+	}
+	if r.onEvent == nil {
+		return
+	}
+	r.onEvent(Event{
+		Type:       t,
+		Op:         OpWrite,
+		Filename:   r.filename,
+		RemoteAddr: r.addr,
+		Bytes:      r.bytes,
+		Err:        err,
+	})
+}
+
+// logf writes a line to the transfer logger if there is one.
+func (r *receiver) logf(format string, v ...interface{}) {
+	if r.log != nil {
+		r.log.Printf(format, v...)
 	}
 }
 
@@ -261,7 +635,9 @@ func (r *receiver) abort(err error) error {
 	if r.hook != nil {
 		r.hook.OnFailure(r.buildTransferStats(), err)
 	}
-	n := packERROR(r.send, 1, err.Error())
+	r.emit(EventFailed, err)
+	code, msg := errorCodeMessage(err)
+	n := packERROR(r.send, code, msg)
 	err = r.conn.sendTo(r.send[:n], r.addr)
 	if err != nil {
 		return err
@@ -0,0 +1,44 @@
+package tftp
+
+import (
+	"path"
+	"strings"
+)
+
+type route struct {
+	pattern string
+	handler ReadHandler
+}
+
+// Handle registers handler for read requests of files matching pattern.
+// A pattern ending with a slash matches all filenames with that prefix,
+// e.g. "images/" matches "images/boot/vmlinuz". Other patterns are
+// matched with path.Match, e.g. "config/*.cfg". Patterns are tried in the
+// order they were registered and requests that match no pattern are
+// passed to the read handler given to NewServer. Handle may be called
+// while the server is running.
+func (s *Server) Handle(pattern string, handler ReadHandler) {
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+	s.routes = append(s.routes, route{pattern: pattern, handler: handler})
+}
+
+// readHandlerFor returns the read handler that serves filename.
+func (s *Server) readHandlerFor(filename string) ReadHandler {
+	s.routesMu.RLock()
+	defer s.routesMu.RUnlock()
+	for _, r := range s.routes {
+		if r.match(filename) {
+			return r.handler
+		}
+	}
+	return s.readHandler
+}
+
+func (r route) match(filename string) bool {
+	if strings.HasSuffix(r.pattern, "/") {
+		return strings.HasPrefix(filename, r.pattern)
+	}
+	ok, err := path.Match(r.pattern, filename)
+	return err == nil && ok
+}
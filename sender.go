@@ -1,11 +1,19 @@
 package tftp
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
+	"log"
 	"net"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/pin/tftp/netascii"
@@ -30,9 +38,32 @@ type OutgoingTransfer interface {
 	RemoteAddr() net.UDPAddr
 }
 
+// WindowControl provides methods to inspect and change the window of a
+// running outgoing transfer that negotiated the windowsize option (RFC
+// 7440), e.g. to shrink it when loss is observed. Transfers passed to
+// Server read handlers and returned by Client.Send implement it, and the
+// Transfer returned by Client.PutAsync has the same methods.
+type WindowControl interface {
+	// Window returns the number of blocks sent before waiting for an ACK,
+	// 1 if no windowsize was negotiated.
+	Window() int
+
+	// SetWindow changes the window starting with the next window sent. It
+	// may be called from other goroutines while ReadFrom runs. The window
+	// cannot grow beyond the negotiated windowsize and values less than 1
+	// are ignored.
+	SetWindow(n int)
+}
+
 type sender struct {
+	ctx            context.Context
 	conn           connection
 	addr           *net.UDPAddr
+	mcast          *net.UDPAddr // group offered with the multicast option
+	multicast      bool         // DATA is sent to the mcast group
+	mcastTx        *mcastTransfer
+	mcastSrc       *mcastSource // nil if listeners are not accepted
+	resync         bool         // ACK of a new master may rewind
 	filename       string
 	localIP        net.IP
 	tid            int
@@ -43,18 +74,58 @@ type sender struct {
 	timeout        time.Duration
 	retries        int
 	block          uint16
+	rollover       uint16
 	maxBlockLen    int
+	window         int
+	windowNow      int32 // window in use, accessed atomically
+	windowReq      int32 // window set with SetWindow, 0 if none
+	maxWindow      int
 	mode           string
 	opts           options
+	optOrder       []string // option names in request order
+	negotiated     options
 	hook           Hook
+	onProgress     func(bytes, total int64)
+	onEvent        func(Event)
+	onRetry        func(block uint16, attempt int)
+	progress       *progress
+	rateLimit      int
+	limiter        *rateLimiter
+	crc            hash.Hash32 // checksum of data sent, see x-crc32 option
+	state          *transferState
+	clock          clock
+	log            *log.Logger // transfer logger, may be nil
+	strict         bool
+	peerFailed     bool // ERROR received, it is not answered
 	startTime      time.Time
 	datagramsSent  int
 	datagramsAcked int
+	blocks         int
+	bytes          int64
+	retransmits    int
+	started        bool           // ReadFrom was called
+	pipe           *io.PipeWriter // see Write
+	pipeErr        chan error
 }
 
 func (s *sender) RemoteAddr() net.UDPAddr { return *s.addr }
 func (s *sender) LocalIP() net.IP         { return s.localIP }
 
+func (s *sender) Options() map[string]string { return s.negotiated.copy() }
+
+func (s *sender) Window() int {
+	if n := atomic.LoadInt32(&s.windowNow); n > 0 {
+		return int(n)
+	}
+	return 1
+}
+
+func (s *sender) SetWindow(n int) {
+	if n > 0 {
+		atomic.StoreInt32(&s.windowReq, int32(n))
+	}
+}
+
 func (s *sender) SetSize(n int64) {
 	if s.opts != nil {
 		if _, ok := s.opts["tsize"]; ok {
@@ -64,6 +135,7 @@ func (s *sender) SetSize(n int64) {
 }
 
 func (s *sender) ReadFrom(r io.Reader) (n int64, err error) {
+	s.started = true
 	if s.mode == "netascii" {
 		r = netascii.ToReader(r)
 	}
@@ -96,6 +168,22 @@ func (s *sender) ReadFrom(r io.Reader) (n int64, err error) {
 			return 0, err
 		}
 	}
+	if _, ok := s.negotiated[optEncoding]; ok {
+		r = newGzipReader(r)
+	}
+	if _, ok := s.negotiated[optChecksum]; ok {
+		s.crc = crc32.NewIEEE()
+		r = io.TeeReader(r, s.crc)
+	}
+	if s.multicast && s.mcastTx != nil {
+		s.mcastOpen(r)
+	}
+	s.limiter = newRateLimiter(s.rateLimit, s.clock)
+	s.progress = newProgress(s.onProgress, tsizeTotal(s.opts))
+	defer s.progress.close()
+	if s.window > 1 {
+		return readFromWindow(s, r)
+	}
 	if s.sendA.enabled { /* senderAnticipate */
 		return readFromAnticipate(s, r)
 	}
@@ -108,33 +196,65 @@ func (s *sender) ReadFrom(r io.Reader) (n int64, err error) {
 			if err == io.EOF {
 				binary.BigEndian.PutUint16(s.send[2:4], s.block)
 				_, err = s.sendWithRetry(4)
+				if b, ok := err.(rewindACK); ok {
+					if n, err = s.rewind(uint16(b)); err == nil {
+						continue
+					}
+				}
 				if err != nil {
 					s.abort(err)
 					return n, err
 				}
+				s.blocks++
+				s.emit(EventBlock, nil)
+				if err := s.sendChecksum(s.block); err != nil {
+					s.abort(err)
+					return n, err
+				}
 				if s.hook != nil {
 					s.hook.OnSuccess(s.buildTransferStats())
 				}
+				s.emit(EventCompleted, nil)
 				s.conn.close()
 				return n, nil
 			}
+			// The reader failed, let the peer know the file is incomplete.
+			s.abort(withCode(err, codeNotDefined))
+			return n, err
+		}
+		err = s.limiter.wait(s.ctx, l)
+		if err != nil {
 			s.abort(err)
 			return n, err
 		}
 		binary.BigEndian.PutUint16(s.send[2:4], s.block)
 		_, err = s.sendWithRetry(4 + l)
+		if b, ok := err.(rewindACK); ok {
+			if n, err = s.rewind(uint16(b)); err == nil {
+				continue
+			}
+		}
 		if err != nil {
 			s.abort(err)
 			return n, err
 		}
+		s.blocks++
+		s.bytes += int64(l)
+		s.progress.update(n)
+		s.emit(EventBlock, nil)
 		if l < len(s.send)-4 {
+			if err := s.sendChecksum(s.block); err != nil {
+				s.abort(err)
+				return n, err
+			}
 			if s.hook != nil {
 				s.hook.OnSuccess(s.buildTransferStats())
 			}
+			s.emit(EventCompleted, nil)
 			s.conn.close()
 			return n, nil
 		}
-		s.block++
+		s.block = blockAfter(s.block, 1, s.rollover)
 	}
 }
 
@@ -143,9 +263,51 @@ func (s *sender) sendOptions() error {
 		if name == "blksize" {
 			err := s.setBlockSize(value)
 			if err != nil {
+				return badOption(name, value)
+			}
+		} else if name == "timeout" {
+			t, err := parseTimeoutOption(value)
+			if err != nil {
+				if s.strict {
+					return badOption(name, value)
+				}
+				delete(s.opts, name)
+				continue
+			}
+			s.timeout = t
+		} else if name == "windowsize" {
+			n, err := parseWindowSizeOption(value)
+			if err != nil && s.strict {
+				return badOption(name, value)
+			}
+			if err != nil || s.maxWindow < 2 {
+				delete(s.opts, name)
+				continue
+			}
+			if n > s.maxWindow {
+				n = s.maxWindow
+				s.opts[name] = strconv.Itoa(n)
+			}
+			s.window = n
+		} else if name == "multicast" {
+			if s.mcast == nil {
 				delete(s.opts, name)
 				continue
 			}
+			// The requesting client is the master. Clients requesting
+			// the same data later join as listeners, see mcastJoin, and
+			// promote hands the master role to them.
+			s.opts[name] = mcastOption(s.mcast, true)
+		} else if name == optChecksum {
+			// Always supported, the value is echoed.
+		} else if name == optEncoding {
+			// Netascii translation would apply to the compressed data on
+			// the receiving side.
+			if !strings.EqualFold(value, "gzip") || s.mode == "netascii" {
+				delete(s.opts, name)
+				continue
+			}
+			s.opts[name] = "gzip"
 		} else if name == "tsize" {
 			if value != "0" {
 				s.opts["tsize"] = value
@@ -153,31 +315,33 @@ func (s *sender) sendOptions() error {
 				delete(s.opts, name)
 				continue
 			}
+		} else if s.strict {
+			return badOption(name, value)
 		} else {
 			delete(s.opts, name)
 		}
 	}
+	if _, ok := s.opts[optEncoding]; ok {
+		// The size of the compressed data is not known in advance.
+		delete(s.opts, "tsize")
+	}
 	if len(s.opts) > 0 {
-		m := packOACK(s.send, s.opts)
+		m := packOACK(s.send, s.opts.list(s.optOrder))
 		_, err := s.sendWithRetry(m)
 		if err != nil {
 			return err
 		}
+		s.negotiated = s.opts
+		_, s.multicast = s.opts["multicast"]
 	}
 	return nil
 }
 
 func (s *sender) setBlockSize(blksize string) error {
-	n, err := strconv.Atoi(blksize)
+	n, err := parseBlockSizeOption(blksize)
 	if err != nil {
 		return err
 	}
-	if n < 512 {
-		return fmt.Errorf("blksize too small: %d", n)
-	}
-	if n > 65464 {
-		return fmt.Errorf("blksize too large: %d", n)
-	}
 	if s.maxBlockLen > 0 && n > s.maxBlockLen {
 		n = s.maxBlockLen
 		s.opts["blksize"] = strconv.Itoa(n)
@@ -189,12 +353,106 @@ func (s *sender) setBlockSize(blksize string) error {
 	return nil
 }
 
+// blockAfter returns the block number n blocks after b. Block numbers
+// wrap from 65535 to rollover, which is 0 or 1 depending on the peer.
+func blockAfter(b uint16, n uint, rollover uint16) uint16 {
+	for ; n > 0; n-- {
+		if b == 65535 {
+			b = rollover
+		} else {
+			b++
+		}
+	}
+	return b
+}
+
+// futureBlock reports whether an ACK for block b refers to a block after
+// last, the last block sent. Block numbers up to half of the sequence
+// space ahead are considered to be in the future, older ones are stale.
+func futureBlock(b, last uint16) bool {
+	d := b - last
+	return d != 0 && d < 1<<15
+}
+
+// errFutureACK is returned when the receiver acknowledges a block that was
+// not sent yet. Such a peer is broken or malicious, so the transfer is not
+// continued.
+var errFutureACK = &TftpError{Code: codeIllegalOperation, Message: "ACK for a block that was not sent"}
+
+// gzipReader compresses data read from r with gzip. Compression happens
+// in Read, so r is never read after the transfer is over.
+type gzipReader struct {
+	r     io.Reader
+	zw    *gzip.Writer
+	out   bytes.Buffer // compressed data not read yet
+	chunk []byte
+	eof   bool
+}
+
+func newGzipReader(r io.Reader) *gzipReader {
+	g := &gzipReader{r: r, chunk: make([]byte, 32*1024)}
+	g.zw = gzip.NewWriter(&g.out)
+	return g
+}
+
+func (g *gzipReader) Read(p []byte) (int, error) {
+	for g.out.Len() == 0 && !g.eof {
+		n, err := g.r.Read(g.chunk)
+		if n > 0 {
+			if _, err := g.zw.Write(g.chunk[:n]); err != nil {
+				return 0, err
+			}
+		}
+		if err == io.EOF {
+			if err := g.zw.Close(); err != nil {
+				return 0, err
+			}
+			g.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	if g.out.Len() == 0 {
+		return 0, io.EOF
+	}
+	return g.out.Read(p)
+}
+
+// sendChecksum sends the checksum of the data to the receiver once the
+// final block is acknowledged, if the x-crc32 option was negotiated. The
+// receiver confirms it with an ACK for the block after the last one.
+func (s *sender) sendChecksum(last uint16) error {
+	if s.crc == nil {
+		return nil
+	}
+	s.block = blockAfter(last, 1, s.rollover)
+	m := packOACK(s.send, []Option{{Name: optChecksum, Value: fmt.Sprintf("%08x", s.crc.Sum32())}})
+	_, err := s.sendWithRetry(m)
+	return err
+}
+
+// dataAddr returns the address DATA packets are sent to.
+func (s *sender) dataAddr() *net.UDPAddr {
+	if s.multicast {
+		return s.mcast
+	}
+	return s.addr
+}
+
 func (s *sender) sendWithRetry(l int) (*net.UDPAddr, error) {
 	s.retry.reset()
 	for {
 		addr, err := s.sendDatagram(l)
-		if _, ok := err.(net.Error); ok && s.retry.count() < s.retries {
+		if err != nil && s.ctx.Err() != nil {
+			return nil, s.ctx.Err()
+		}
+		if isTimeout(err) && s.retry.count() < s.retries {
+			s.logf("timeout waiting for ACK %d, retransmitting", s.block)
 			s.retry.backoff()
+			s.retransmitted()
+			continue
+		}
+		if isTimeout(err) && s.promote() {
 			continue
 		}
 		return addr, err
@@ -202,11 +460,12 @@ func (s *sender) sendWithRetry(l int) (*net.UDPAddr, error) {
 }
 
 func (s *sender) sendDatagram(l int) (*net.UDPAddr, error) {
-	err := s.conn.setDeadline(s.timeout)
+	s.state.update(s.block, s.retransmits)
+	err := s.conn.setDeadline(s.retry.timeout(s.timeout))
 	if err != nil {
 		return nil, err
 	}
-	err = s.conn.sendTo(s.send[:l], s.addr)
+	err = s.conn.sendTo(s.send[:l], s.dataAddr())
 	if err != nil {
 		return nil, err
 	}
@@ -218,44 +477,113 @@ func (s *sender) sendDatagram(l int) (*net.UDPAddr, error) {
 		}
 
 		if !addr.IP.Equal(s.addr.IP) || (s.tid != 0 && addr.Port != s.tid) {
+			rejectTID(s.conn, addr)
 			continue
 		}
 		p, err := parsePacket(s.receive[:n])
 		if err != nil {
+			if err := s.violation(addr, errMalformedPacket); err != nil {
+				return addr, err
+			}
 			continue
 		}
 		s.tid = addr.Port
 		switch p := p.(type) {
 		case pACK:
+			resync := s.resync
+			s.resync = false
 			if p.block() == s.block {
 				s.datagramsAcked++
 				return addr, nil
 			}
-		case pOACK:
-			opts, err := unpackOACK(p)
+			if futureBlock(p.block(), s.block) {
+				return addr, errFutureACK
+			}
+			if resync {
+				return addr, rewindACK(p.block())
+			}
+			// Stale or duplicate ACKs are ignored. Retransmitting on them
+			// would cause the Sorcerer's Apprentice Syndrome (RFC 1123).
+		case *OACK:
 			if s.block != 0 {
+				if err := s.violation(addr, unexpectedPacket(s.receive)); err != nil {
+					return addr, err
+				}
 				continue
 			}
-			if err != nil {
-				s.abort(err)
-				return addr, err
-			}
+			opts := p.options()
 			for name, value := range opts {
+				if _, ok := s.opts[name]; !ok && s.strict {
+					s.addr = addr
+					s.abort(badOption(name, value))
+					return addr, badOption(name, value)
+				}
 				if name == "blksize" {
-					err := s.setBlockSize(value)
+					err := checkBlockSizeOffer(s.opts, value)
+					if err == nil {
+						err = s.setBlockSize(value)
+					}
 					if err != nil {
-						continue
+						s.addr = addr
+						s.abort(badOption(name, value))
+						return addr, err
 					}
+				} else if name == "timeout" {
+					if t, err := parseTimeoutOption(value); err == nil {
+						s.timeout = t
+					}
+				} else if name == "windowsize" {
+					n, err := checkWindowSizeOffer(s.opts, value)
+					if err != nil {
+						s.addr = addr
+						s.abort(badOption(name, value))
+						return addr, err
+					}
+					s.window = n
 				}
 			}
+			s.negotiated = opts
 			return addr, nil
 		case pERROR:
-			return nil, fmt.Errorf("sending block %d: code=%d, error: %s",
-				s.block, p.code(), p.message())
+			return nil, s.peerError(p)
+		default:
+			if err := s.violation(addr, unexpectedPacket(s.receive)); err != nil {
+				return addr, err
+			}
 		}
 	}
 }
 
+// retransmitted counts a retransmission after a timeout and reports it to
+// the function set with SetOnRetransmit.
+func (s *sender) retransmitted() {
+	s.retransmits++
+	if s.onRetry != nil {
+		s.onRetry(s.block, s.retry.count())
+	}
+}
+
+// peerError returns the error the peer reported with p. The transfer is
+// closed on abort without an ERROR in reply, as errors are not
+// acknowledged (RFC 1350).
+func (s *sender) peerError(p pERROR) error {
+	s.peerFailed = true
+	return fmt.Errorf("sending block %d: %w",
+		s.block, &TftpError{Code: p.code(), Message: p.message()})
+}
+
+// violation aborts the transfer with err if the sender is strict and err
+// is not nil. Otherwise the packet received from addr is ignored and nil
+// is returned.
+func (s *sender) violation(addr *net.UDPAddr, err error) error {
+	if !s.strict || err == nil {
+		return nil
+	}
+	s.addr = addr
+	s.abort(err)
+	return err
+}
+
 func (s *sender) buildTransferStats() TransferStats {
 	return TransferStats{
 		RemoteAddr:              s.addr.IP,
@@ -264,9 +592,40 @@ func (s *sender) buildTransferStats() TransferStats {
 		SenderAnticipateEnabled: s.sendA.enabled,
 		Mode:                    s.mode,
 		Opts:                    s.opts,
-		Duration:                time.Now().Sub(s.startTime),
+		Duration:                s.clock.Now().Sub(s.startTime),
 		DatagramsSent:           s.datagramsSent,
 		DatagramsAcked:          s.datagramsAcked,
+		Blocks:                  s.blocks,
+		Bytes:                   s.bytes,
+		Retransmits:             s.retransmits,
+	}
+}
+
+// emit reports an event of the transfer to the event handler, if any.
+func (s *sender) emit(t EventType, err error) {
+	switch t {
+	case EventCompleted:
+		s.logf("sent %d blocks, %d bytes", s.blocks, s.bytes)
+	case EventFailed:
+		s.logf("transfer failed at block %d: %v", s.block, err)
+	}
+	if s.onEvent == nil {
+		return
+	}
+	s.onEvent(Event{
+		Type:       t,
+		Op:         OpRead,
+		Filename:   s.filename,
+		RemoteAddr: s.addr,
+		Bytes:      s.bytes,
+		Err:        err,
+	})
+}
+
+// logf writes a line to the transfer logger if there is one.
+func (s *sender) logf(format string, v ...interface{}) {
+	if s.log != nil {
+		s.log.Printf(format, v...)
 	}
 }
 
@@ -277,10 +636,14 @@ func (s *sender) abort(err error) error {
 	if s.hook != nil {
 		s.hook.OnFailure(s.buildTransferStats(), err)
 	}
-	n := packERROR(s.send, 1, err.Error())
-	err = s.conn.sendTo(s.send[:n], s.addr)
-	if err != nil {
-		return err
+	s.emit(EventFailed, err)
+	if !s.peerFailed {
+		code, msg := errorCodeMessage(err)
+		n := packERROR(s.send, code, msg)
+		err = s.conn.sendTo(s.send[:n], s.addr)
+		if err != nil {
+			return err
+		}
 	}
 	s.conn.close()
 	s.conn = nil
@@ -52,6 +52,7 @@ func readFromAnticipate(s *sender, r io.Reader) (n int64, err error) {
 		knum := uint(0)
 		kfillOk := true /* default ok */
 		kfillPartial := false
+		var kerr error /* read error if kfillOk is false */
 		for k := uint(0); k < ksz; k++ {
 			lx, err := io.ReadFull(r, s.sendA.sends[k][4:])
 			nx += int64(lx)
@@ -61,25 +62,26 @@ func readFromAnticipate(s *sender, r io.Reader) (n int64, err error) {
 						break /* short packet already sent in last loop */
 					}
 					binary.BigEndian.PutUint16(s.sendA.sends[k][2:4],
-						s.block+uint16(k))
+						blockAfter(s.block, k, s.rollover))
 					s.sendA.sendslens[k] = 4
 					knum = k + 1
 					kfillPartial = true
 					break
 				}
 				kfillOk = false
+				kerr = err
 				break /* fail */
 			} else if err != nil /* has to be io.ErrUnexpectedEOF now */ {
 				kfillPartial = true /* set the flag and send the packet */
 			}
 			binary.BigEndian.PutUint16(s.sendA.sends[k][2:4],
-				s.block+uint16(k))
+				blockAfter(s.block, k, s.rollover))
 			s.sendA.sendslens[k] = uint(4 + lx)
 			knum = k + 1
 		}
 		if !kfillOk {
-			s.abort(err)
-			return n, err
+			s.abort(withCode(kerr, codeNotDefined))
+			return n, kerr
 		}
 		s.sendA.num = knum
 		n += int64(nx)
@@ -90,16 +92,30 @@ func readFromAnticipate(s *sender, r io.Reader) (n int64, err error) {
 			}
 			fmt.Println("")
 		}
+		err = s.limiter.wait(s.ctx, int(nx))
+		if err != nil {
+			s.abort(err)
+			return n, err
+		}
 		_, err = s.sendWithRetryAnticipate()
 		if err != nil {
 			s.abort(err)
 			return n, err
 		}
+		s.blocks += int(knum)
+		s.bytes += nx
+		s.progress.update(n)
+		s.emit(EventBlock, nil)
 		if kfillPartial {
+			if err := s.sendChecksum(blockAfter(s.block, knum-1, s.rollover)); err != nil {
+				s.abort(err)
+				return n, err
+			}
+			s.emit(EventCompleted, nil)
 			s.conn.close()
 			return n, nil
 		}
-		s.block += uint16(knum)
+		s.block = blockAfter(s.block, knum, s.rollover)
 	}
 }
 
@@ -108,8 +124,13 @@ func (s *sender) sendWithRetryAnticipate() (*net.UDPAddr, error) {
 	s.retry.reset()
 	for {
 		addr, err := s.sendDatagramAnticipate()
-		if _, ok := err.(net.Error); ok && s.retry.count() < s.retries {
+		if err != nil && s.ctx.Err() != nil {
+			return nil, s.ctx.Err()
+		}
+		if isTimeout(err) && s.retry.count() < s.retries {
+			s.logf("timeout waiting for ACK %d, retransmitting", s.block)
 			s.retry.backoff()
+			s.retransmitted()
 			continue
 		}
 		return addr, err
@@ -118,7 +139,7 @@ func (s *sender) sendWithRetryAnticipate() (*net.UDPAddr, error) {
 
 // derived from sendDatagram()
 func (s *sender) sendDatagramAnticipate() (*net.UDPAddr, error) {
-	err1 := s.conn.setDeadline(s.timeout)
+	err1 := s.conn.setDeadline(s.retry.timeout(s.timeout))
 	if err1 != nil {
 		return nil, err1
 	}
@@ -136,7 +157,7 @@ func (s *sender) sendDatagramAnticipate() (*net.UDPAddr, error) {
 			err = fmt.Errorf("lx smaller than 4")
 			break
 		}
-		errx := s.conn.sendTo(s.sendA.sends[k][:lx], s.addr)
+		errx := s.conn.sendTo(s.sendA.sends[k][:lx], s.dataAddr())
 		if errx != nil {
 			err = fmt.Errorf("k %v errx %v", k, errx.Error())
 			break
@@ -152,10 +173,14 @@ func (s *sender) sendDatagramAnticipate() (*net.UDPAddr, error) {
 			return nil, err
 		}
 		if !addr.IP.Equal(s.addr.IP) || (s.tid != 0 && addr.Port != s.tid) {
+			rejectTID(s.conn, addr)
 			continue
 		}
 		p, err := parsePacket(s.receive[:n])
 		if err != nil {
+			if err := s.violation(addr, errMalformedPacket); err != nil {
+				return addr, err
+			}
 			continue
 		}
 		s.tid = addr.Port
@@ -165,21 +190,22 @@ func (s *sender) sendDatagramAnticipate() (*net.UDPAddr, error) {
 				fmt.Printf(" **** pACK p.block %v  s.block %v k %v\n",
 					p.block(), s.block, k)
 			}
-			if p.block() == s.block+uint16(k) {
+			if p.block() == blockAfter(s.block, k, s.rollover) {
 				k++
 				if k == knum {
 					return addr, nil
 				}
+			} else if futureBlock(p.block(), blockAfter(s.block, knum-1, s.rollover)) {
+				return addr, errFutureACK
 			}
-		case pOACK:
-			opts, err := unpackOACK(p)
+		case *OACK:
 			if s.block != 0 {
+				if err := s.violation(addr, unexpectedPacket(s.receive)); err != nil {
+					return addr, err
+				}
 				continue
 			}
-			if err != nil {
-				s.abort(err)
-				return addr, err
-			}
+			opts := p.options()
 			for name, value := range opts {
 				if name == "blksize" {
 					err := s.setBlockSize(value)
@@ -190,8 +216,11 @@ func (s *sender) sendDatagramAnticipate() (*net.UDPAddr, error) {
 			}
 			return addr, nil
 		case pERROR:
-			return nil, fmt.Errorf("sending block %d: code=%d, error: %s",
-				s.block, p.code(), p.message())
+			return nil, s.peerError(p)
+		default:
+			if err := s.violation(addr, unexpectedPacket(s.receive)); err != nil {
+				return addr, err
+			}
 		}
 	}
 }
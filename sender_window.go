@@ -0,0 +1,183 @@
+package tftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// readFromWindow implements ReadFrom for transfers that negotiated the
+// windowsize option (RFC 7440). Up to s.window blocks are sent before
+// waiting for an ACK. An ACK for a block inside the window acknowledges
+// all blocks up to it and transmission continues with the following one.
+func readFromWindow(s *sender, r io.Reader) (n int64, err error) {
+	bufs := make([][]byte, s.window)
+	lens := make([]int, s.window)
+	for i := range bufs {
+		bufs[i] = make([]byte, len(s.send))
+		binary.BigEndian.PutUint16(bufs[i][0:2], opDATA)
+	}
+	s.block = 1 // first block of the window
+	filled := 0
+	eof := false
+	var acked int64 // bytes acknowledged by the receiver
+	limit := s.window
+	atomic.StoreInt32(&s.windowNow, int32(limit))
+	for {
+		if w := int(atomic.SwapInt32(&s.windowReq, 0)); w > 0 {
+			if w > limit {
+				w = limit
+			}
+			s.window = w
+			atomic.StoreInt32(&s.windowNow, int32(w))
+		}
+		fresh := 0 // bytes that were not sent before
+		for filled < s.window && !eof {
+			l, err := io.ReadFull(r, bufs[filled][4:])
+			n += int64(l)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				s.abort(withCode(err, codeNotDefined))
+				return n, err
+			}
+			if l < len(bufs[filled])-4 {
+				eof = true
+			}
+			binary.BigEndian.PutUint16(bufs[filled][2:4],
+				blockAfter(s.block, uint(filled), s.rollover))
+			lens[filled] = 4 + l
+			filled++
+			fresh += l
+		}
+		err := s.limiter.wait(s.ctx, fresh)
+		if err != nil {
+			s.abort(err)
+			return n, err
+		}
+		// Blocks left over from a window larger than the current one.
+		m := filled
+		if m > s.window {
+			m = s.window
+		}
+		k, err := s.sendWindowWithRetry(bufs[:m], lens[:m])
+		if err != nil {
+			s.abort(err)
+			return n, err
+		}
+		for i := 0; i < k; i++ {
+			acked += int64(lens[i] - 4)
+		}
+		s.blocks += k
+		s.bytes = acked
+		s.progress.update(acked)
+		if k > 0 {
+			s.emit(EventBlock, nil)
+		}
+		if eof && k == filled {
+			if err := s.sendChecksum(blockAfter(s.block, uint(k-1), s.rollover)); err != nil {
+				s.abort(err)
+				return n, err
+			}
+			if s.hook != nil {
+				s.hook.OnSuccess(s.buildTransferStats())
+			}
+			s.emit(EventCompleted, nil)
+			s.conn.close()
+			return n, nil
+		}
+		// Move unacknowledged blocks to the start of the window.
+		bufs = append(bufs[k:], bufs[:k]...)
+		lens = append(lens[k:], lens[:k]...)
+		filled -= k
+		s.block = blockAfter(s.block, uint(k), s.rollover)
+	}
+}
+
+// errWindowGap is returned by sendWindow when the receiver reports that
+// the first block of the window was lost, so the window is sent again
+// without waiting for the timeout.
+var errWindowGap = errors.New("first block of window lost")
+
+func (s *sender) sendWindowWithRetry(bufs [][]byte, lens []int) (int, error) {
+	s.retry.reset()
+	for {
+		acked, err := s.sendWindow(bufs, lens)
+		if err != nil && s.ctx.Err() != nil {
+			return 0, s.ctx.Err()
+		}
+		if isTimeout(err) && s.retry.count() < s.retries {
+			s.logf("timeout waiting for ACK of window at block %d, retransmitting", s.block)
+			s.retry.backoff()
+			s.retransmitted()
+			continue
+		}
+		if err == errWindowGap && s.retry.count() < s.retries {
+			s.logf("ACK of block before window at block %d, retransmitting", s.block)
+			s.retry.skip()
+			s.retransmitted()
+			continue
+		}
+		if isTimeout(err) && s.promote() {
+			continue
+		}
+		return acked, err
+	}
+}
+
+// sendWindow transmits the blocks of the window and returns the number of
+// blocks acknowledged by the receiver.
+func (s *sender) sendWindow(bufs [][]byte, lens []int) (int, error) {
+	s.state.update(s.block, s.retransmits)
+	err := s.conn.setDeadline(s.retry.timeout(s.timeout))
+	if err != nil {
+		return 0, err
+	}
+	for i := range bufs {
+		err = s.conn.sendTo(bufs[i][:lens[i]], s.dataAddr())
+		if err != nil {
+			return 0, err
+		}
+		s.datagramsSent++
+	}
+	for {
+		n, addr, err := s.conn.readFrom(s.receive)
+		if err != nil {
+			return 0, err
+		}
+		if !addr.IP.Equal(s.addr.IP) || (s.tid != 0 && addr.Port != s.tid) {
+			rejectTID(s.conn, addr)
+			continue
+		}
+		p, err := parsePacket(s.receive[:n])
+		if err != nil {
+			if err := s.violation(addr, errMalformedPacket); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		switch p := p.(type) {
+		case pACK:
+			// ACKs for blocks outside of the window are stale and ignored.
+			for i := range bufs {
+				if p.block() == blockAfter(s.block, uint(i), s.rollover) {
+					s.datagramsAcked++
+					return i + 1, nil
+				}
+			}
+			if futureBlock(p.block(), blockAfter(s.block, uint(len(bufs)-1), s.rollover)) {
+				return 0, errFutureACK
+			}
+			// The receiver acknowledges the block before the window
+			// when the first block of it went missing.
+			if blockAfter(p.block(), 1, s.rollover) == s.block {
+				return 0, errWindowGap
+			}
+		case pERROR:
+			return 0, s.peerError(p)
+		default:
+			if err := s.violation(addr, unexpectedPacket(s.receive)); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
@@ -1,30 +1,50 @@
 package tftp
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"net"
+	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
 )
 
+// ReadHandler is called when a client starts a file download. It sends
+// the file with rf.ReadFrom.
+type ReadHandler func(filename string, rf io.ReaderFrom) error
+
+// WriteHandler is called when a client starts a file upload. It receives
+// the file with wt.WriteTo.
+type WriteHandler func(filename string, wt io.WriterTo) error
+
 // NewServer creates TFTP server. It requires two functions to handle
 // read and write requests.
 // In case nil is provided for read or write handler the respective
 // operation is disabled.
-func NewServer(readHandler func(filename string, rf io.ReaderFrom) error,
-	writeHandler func(filename string, wt io.WriterTo) error) *Server {
+func NewServer(readHandler ReadHandler, writeHandler WriteHandler) *Server {
 	s := &Server{
-		timeout:           defaultTimeout,
-		retries:           defaultRetries,
+		timeout:           DefaultTimeout,
+		retries:           DefaultRetries,
+		maxWindow:         defaultMaxWindow,
 		runGC:             make(chan []string),
+		stop:              make(chan struct{}),
 		gcThreshold:       100,
 		packetReadTimeout: 100 * time.Millisecond,
 		readHandler:       readHandler,
 		writeHandler:      writeHandler,
+		log:               log.New(ioutil.Discard, "", 0),
+		panicMsg:          "internal server error",
+		clock:             realClock{},
 	}
 	return s
 }
@@ -40,20 +60,85 @@ type RequestPacketInfo interface {
 	LocalIP() net.IP
 }
 
+// AppendRequest provides a method to learn whether the client of a write
+// transfer asked to append to the file rather than to replace it. Transfers
+// passed to Server write handlers implement it.
+type AppendRequest interface {
+	// Append reports whether the request included the non-standard
+	// x-append option and the server accepts it, see EnableAppend. The
+	// option is acknowledged by WriteTo, so the handler must append to the
+	// file if Append reports true.
+	Append() bool
+}
+
+// NegotiatedOptions provides a method to get the options both sides of a
+// transfer agreed on. Transfers returned by Client and passed to Server
+// handlers implement it.
+type NegotiatedOptions interface {
+	// Options returns a copy of the options acknowledged with the OACK
+	// packet, nil if no options were acknowledged. In server handlers the
+	// OACK is sent by ReadFrom and WriteTo, so Options returns nil before.
+	Options() map[string]string
+}
+
 // Server is an instance of a TFTP server
 type Server struct {
-	readHandler  func(filename string, rf io.ReaderFrom) error
-	writeHandler func(filename string, wt io.WriterTo) error
+	readHandler  ReadHandler
+	routes       []route
+	routesMu     sync.RWMutex
+	writeHandler WriteHandler
 	hook         Hook
+	onProgress   func(bytes, total int64)
+	onEvent      func(Event)
+	onRetransmit func(block uint16, attempt int)
+	onError      func(err error)
+	onRequest    func(op Op, filename string, addr *net.UDPAddr)
+	rateLimit    int
+	expTimeout   bool
+	jitter       float64
+	maxWriteSize int64
+	authorizer   func(op Op, filename string, addr *net.UDPAddr) error
+	rewriter     func(filename string, addr *net.UDPAddr) (string, error)
+	bindIP       net.IP
+	mcastGroup   *net.UDPAddr
+	mcastTx      map[mcastKey]*mcastTransfer // running multicast transfers
+	mcastPorts   map[int]bool                // group ports of running ones
+	mcastMu      sync.Mutex
+	broadcast    bool
+	network      string // of ListenAndServe, "udp" if empty
+	strict       bool
+	append       bool // x-append is acknowledged
+	clock        clock
+	log          *log.Logger
 	backoff      backoffFunc
+	panicMsg     string
 	conn         net.PacketConn
+	connMu       sync.Mutex // guards conn for Addr
 	conn6        *ipv6.PacketConn
 	conn4        *ipv4.PacketConn
 	quit         chan chan struct{}
 	wg           sync.WaitGroup
 	timeout      time.Duration
 	retries      int
+	totalTimeout time.Duration
+	dally        time.Duration
+	readBuf      int // socket buffer sizes if positive
+	writeBuf     int
+	dscp         int
+	portMin      int // range of transfer ports if portMax is not zero
+	portMax      int
 	maxBlockLen  int
+	rollover     uint16
+	maxWindow    int
+	maxTransfers int // limit of concurrent transfers if positive
+	active       int32
+	queueDepth   int
+	queued       []*waiter // requests waiting for a slot, oldest first
+	queueMu      sync.Mutex
+	stop         chan struct{}   // closed by Shutdown
+	stopOnce     sync.Once       // closes stop just once
+	writes       map[string]*wrq // WRQs of write transfers without DATA
+	writesMu     sync.Mutex
 	sendAEnable  bool /* senderAnticipate enable by server */
 	sendAWinSz   uint
 	// Single port fields
@@ -77,6 +162,29 @@ type TransferStats struct {
 	Duration                time.Duration
 	DatagramsSent           int
 	DatagramsAcked          int
+	Blocks                  int   // data blocks transferred
+	Bytes                   int64 // data bytes transferred
+	Retransmits             int   // packets sent again after a timeout
+}
+
+// Op is the kind of transfer requested by a client.
+type Op int
+
+const (
+	// OpRead is a read request (RRQ), the client downloads a file.
+	OpRead Op = iota + 1
+	// OpWrite is a write request (WRQ), the client uploads a file.
+	OpWrite
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpRead:
+		return "read"
+	case OpWrite:
+		return "write"
+	}
+	return fmt.Sprintf("Op(%d)", int(op))
 }
 
 // Hook is an interface used to provide the server with success and failure hooks
@@ -109,6 +217,70 @@ func (s *Server) SetHook(hook Hook) {
 	s.hook = hook
 }
 
+// SetOnProgress sets a function that is called as data blocks of a
+// transfer are confirmed. It receives the number of bytes transferred so
+// far and the transfer size from the tsize option, or -1 when the size is
+// not known. The function is called from a separate goroutine and does not
+// block the transfer; intermediate updates may be skipped if it is slow.
+func (s *Server) SetOnProgress(f func(bytes, total int64)) {
+	s.onProgress = f
+}
+
+// SetEventHandler sets a function that receives an Event for each step of
+// every transfer: request received, transfer started, data block
+// transferred, transfer completed or failed. It can be used to collect
+// metrics or produce structured logs, the logger set with SetLogger is
+// used independently. The function is called synchronously from the
+// goroutine serving the transfer and should return quickly.
+func (s *Server) SetEventHandler(f func(Event)) {
+	s.onEvent = f
+}
+
+// SetOnRetransmit sets a function that is called each time a transfer
+// retransmits a packet after a timeout, to diagnose lossy links. It
+// receives the DATA block the transfer waits for to be acknowledged, or to
+// arrive in write transfers, and the number of the retransmission, 1 for
+// the first one. The function is called synchronously from the goroutine
+// serving the transfer and should return quickly.
+func (s *Server) SetOnRetransmit(f func(block uint16, attempt int)) {
+	s.onRetransmit = f
+}
+
+// SetOnRequest sets a function that is called for every read and write
+// request as soon as it is parsed, before it is authorized or validated,
+// so it also sees requests that are rejected later. It receives the
+// filename sent by the client, before any rewriting.
+func (s *Server) SetOnRequest(f func(op Op, filename string, addr *net.UDPAddr)) {
+	s.onRequest = f
+}
+
+// SetErrorHandler sets a function that is called when the server fails to
+// process a request, e.g. it is malformed, denied or no socket could be
+// opened for the transfer. Errors of transfers that were started are
+// reported by the handlers and the Hook.
+func (s *Server) SetErrorHandler(f func(err error)) {
+	s.onError = f
+}
+
+// SetPanicMessage sets the message of the ERROR packet sent to the client
+// when a read or write handler panics. The panic is recovered and logged
+// with the stack trace, other transfers are not affected. The default
+// message is "internal server error".
+func (s *Server) SetPanicMessage(msg string) {
+	s.panicMsg = msg
+}
+
+// SetLogger sets the logger used to report incoming requests, timeouts and
+// the outcome of transfers. Lines about a transfer are prefixed with the
+// client address and the TID of the transfer, its local port. By default
+// nothing is logged. Passing nil disables logging.
+func (s *Server) SetLogger(l *log.Logger) {
+	if l == nil {
+		l = log.New(ioutil.Discard, "", 0)
+	}
+	s.log = l
+}
+
 // EnableSinglePort enables an experimental mode where the server will
 // serve all connections on port 69 only. There will be no random TIDs
 // on the server side.
@@ -131,22 +303,114 @@ func (s *Server) EnableSinglePort() {
 
 // SetTimeout sets maximum time server waits for single network
 // round-trip to succeed.
-// Default is 5 seconds.
+// Default is DefaultTimeout, 5 seconds.
 func (s *Server) SetTimeout(t time.Duration) {
 	if t <= 0 {
-		s.timeout = defaultTimeout
+		s.timeout = DefaultTimeout
 	} else {
 		s.timeout = t
 	}
 }
 
+// SetTotalTimeout limits the time a whole transfer may take regardless of
+// retransmissions, counted from receipt of the request. A transfer that
+// takes longer is aborted and ReadFrom or WriteTo in the handler returns
+// context.DeadlineExceeded. Zero, the default, means no limit.
+func (s *Server) SetTotalTimeout(t time.Duration) {
+	s.totalTimeout = t
+}
+
+// SetDally sets the time a write transfer lingers after the final ACK to
+// acknowledge the final block again if the client resends it because the
+// ACK was lost. The write handler is not blocked by it, but Shutdown waits
+// for the period to end. Zero, the default, disables it.
+func (s *Server) SetDally(d time.Duration) {
+	s.dally = d
+}
+
+// EnableAppend makes the server acknowledge the non-standard x-append
+// option of write requests. TFTP has no notion of appending, with the
+// option a client asks for the data to be added to the end of an existing
+// file. Write handlers learn about it with AppendRequest and must honor
+// it: the client is told the data is appended once the option is
+// acknowledged. Without EnableAppend the option is ignored.
+func (s *Server) EnableAppend() {
+	s.append = true
+}
+
+// SetStrict makes transfers reject peers that break the protocol instead
+// of tolerating them. Requests with an unknown option or an option value
+// that cannot be parsed are answered with error code 8 (RFC 2347), and a
+// malformed packet or one not expected at that point of a transfer, such
+// as DATA sent to a read transfer or a late OACK, aborts it with error
+// code 4. Strict mode is off by default. An invalid blksize value is
+// rejected with error code 8 either way.
+func (s *Server) SetStrict(strict bool) {
+	s.strict = strict
+}
+
+// SetReadBuffer sets the size of the operating system receive buffer of
+// the server socket and of the sockets of transfers. A larger buffer helps
+// to avoid dropped packets under heavy load. Serve fails if the size
+// cannot be set.
+func (s *Server) SetReadBuffer(bytes int) {
+	s.readBuf = bytes
+}
+
+// SetWriteBuffer sets the size of the operating system transmit buffer of
+// the server socket and of the sockets of transfers, see SetReadBuffer.
+func (s *Server) SetWriteBuffer(bytes int) {
+	s.writeBuf = bytes
+}
+
+// SetDSCP sets the DSCP value, 0 to 63, that marks the packets of the
+// server socket and of the sockets of transfers for networks with QoS
+// policies. Serve fails if it cannot be set. Zero, the default, leaves the
+// system default.
+func (s *Server) SetDSCP(value int) {
+	s.dscp = value
+}
+
+// SetPortRange restricts the local ports of the sockets of transfers to
+// the range from min to max, e.g. to match firewall rules. Requests that
+// arrive while all ports of the range are in use are rejected. It has no
+// effect in single port mode. Zero for both, the default, lets the system
+// choose the port; other invalid ranges are ignored.
+func (s *Server) SetPortRange(min, max int) {
+	if min == 0 && max == 0 || validPortRange(min, max) {
+		s.portMin, s.portMax = min, max
+	}
+}
+
+// listenTransfer opens the socket of a transfer with remoteAddr.
+func (s *Server) listenTransfer(remoteAddr, listenAddr *net.UDPAddr) (*net.UDPConn, error) {
+	conn, err := listenUDP(udpNetwork(remoteAddr), listenAddr, s.portMin, s.portMax)
+	if err != nil {
+		if errors.Is(err, ErrPortRangeExhausted) {
+			s.reject(remoteAddr, errServerBusy.Code, errServerBusy.Message)
+		}
+		return nil, err
+	}
+	if err := setBuffers(conn, s.readBuf, s.writeBuf); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := setDSCP(conn, s.dscp); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
 // SetBlockSize sets the maximum size of an individual data block.
 // This must be a value between 512 (the default block size for TFTP)
-// and 65456 (the max size a UDP packet payload can be).
+// and 65464 (the largest blksize allowed by RFC 2348).
 //
 // This is an advisory value -- it will be clamped to the smaller of
 // the block size the client wants and the MTU of the interface being
-// communicated over munis overhead.
+// communicated over munis overhead. A requested block size outside the
+// 8..65464 range is not clamped: the request is rejected with error
+// code 8.
 func (s *Server) SetBlockSize(i int) {
 	if i > 512 && i < 65465 {
 		s.maxBlockLen = i
@@ -155,35 +419,164 @@ func (s *Server) SetBlockSize(i int) {
 
 // SetRetries sets maximum number of attempts server made to transmit a
 // packet.
-// Default is 5 attempts.
+// Default is DefaultRetries, 5 attempts. Counts less than 1 restore the
+// default; unlike a client the server always retransmits.
 func (s *Server) SetRetries(count int) {
 	if count < 1 {
-		s.retries = defaultRetries
+		s.retries = DefaultRetries
 	} else {
 		s.retries = count
 	}
 }
 
+// SetExponentialTimeout makes the server double the time it waits for
+// a reply with each retransmission of a packet, up to one minute. By
+// default the same timeout is used for all attempts.
+func (s *Server) SetExponentialTimeout(enabled bool) {
+	s.expTimeout = enabled
+}
+
+// SetJitter makes the server vary every retransmission timeout randomly
+// by up to fraction of it, see Client.SetJitter.
+func (s *Server) SetJitter(fraction float64) {
+	s.jitter = clampJitter(fraction)
+}
+
 // SetBackoff sets a user provided function that is called to provide a
 // backoff duration prior to retransmitting an unacknowledged packet.
 func (s *Server) SetBackoff(h backoffFunc) {
 	s.backoff = h
 }
 
+// SetRateLimit limits the rate of data sent by the server in each read
+// transfer to bytesPerSec. Zero, the default, means no limit.
+func (s *Server) SetRateLimit(bytesPerSec int) {
+	s.rateLimit = bytesPerSec
+}
+
+// SetAuthorizer sets a function that is called for every request before
+// a transfer is started. If it returns an error the request is rejected
+// with an access violation error carrying the error text and the handler
+// is not called.
+func (s *Server) SetAuthorizer(f func(op Op, filename string, addr *net.UDPAddr) error) {
+	s.authorizer = f
+}
+
+// SetFilenameRewriter sets a function that maps the filename of every
+// request, for example to strip a prefix or to add a per-client directory.
+// It is called after the request is reported, see SetOnRequest, and before
+// it is authorized and routed, which see the new name. If it returns an
+// error the request is rejected with an access violation error, or with
+// the code of a *TftpError, and the handler is not called.
+func (s *Server) SetFilenameRewriter(f func(filename string, addr *net.UDPAddr) (string, error)) {
+	s.rewriter = f
+}
+
+// SetTransmissionBind sets the local IP address the sockets of transfers
+// are bound to. By default they are bound to the address the request was
+// received on, if the operating system reports it, so that replies come
+// from the address the client talked to. Passing nil restores the
+// default. It has no effect in single port mode.
+func (s *Server) SetTransmissionBind(ip net.IP) {
+	s.bindIP = ip
+}
+
+// EnableMulticast makes the server accept the multicast option (RFC 2090)
+// in read requests. DATA packets of such transfers are sent to group, so
+// that other clients that joined the group receive the file too. Each
+// running multicast transfer has a port of its own, the lowest free one
+// counting up from the port of group, so that clients can tell the
+// transfers of different files apart. Only the requesting client, the
+// master, acknowledges blocks. Clients requesting the same file with the
+// option, the same mode and the same x-encoding while the transfer runs
+// are told they are not the master and become listeners; if the master
+// stops acknowledging blocks the server makes the first listener the
+// master, which acknowledges the last block it received in order and is
+// sent the file again from there. Listeners miss the blocks sent before
+// they joined, so they are only accepted if the read handler passes an
+// io.Seeker to ReadFrom and neither windowsize nor sender anticipation is
+// used; otherwise every request gets a transfer of its own. Multicast is
+// not supported in single port mode.
+func (s *Server) EnableMulticast(group *net.UDPAddr) {
+	s.mcastGroup = group
+}
+
+// SetMaxWriteSize limits the size of files clients may upload. A write
+// transfer that exceeds n bytes is aborted with "disk full" error and
+// WriteTo in the write handler returns an error. Transfers that announce
+// a larger size with the tsize option are rejected before any data is
+// received. Zero, the default, means no limit.
+func (s *Server) SetMaxWriteSize(n int64) {
+	s.maxWriteSize = n
+}
+
+// SetMaxConcurrent limits the number of transfers the server handles at
+// the same time. Requests received while n transfers are in progress are
+// answered with an error and no handler is called, unless they are
+// queued, see SetQueueDepth. Zero, the default, means no limit.
+func (s *Server) SetMaxConcurrent(n int) {
+	s.maxTransfers = n
+}
+
+// SetWindowSize sets the maximum number of blocks the server agrees to
+// send or receive before an ACK when a client requests the windowsize
+// option (RFC 7440). Default is 64. Values less than 2 disable the option.
+func (s *Server) SetWindowSize(n int) {
+	s.maxWindow = n
+}
+
+// SetBlockRollover sets the block number that follows block 65535 in
+// transfers of more than 65535 blocks. Most implementations wrap to 0,
+// which is the default, some expect 1. Other values are ignored.
+func (s *Server) SetBlockRollover(block uint16) {
+	if block <= 1 {
+		s.rollover = block
+	}
+}
+
 // ListenAndServe binds to address provided and start the server.
 // ListenAndServe returns when Shutdown is called.
 func (s *Server) ListenAndServe(addr string) error {
-	a, err := net.ResolveUDPAddr("udp", addr)
+	a, err := net.ResolveUDPAddr(s.listenNetwork(), addr)
 	if err != nil {
 		return err
 	}
-	conn, err := net.ListenUDP("udp", a)
+	conn, err := s.listenPacket(a)
 	if err != nil {
 		return err
 	}
 	return s.Serve(conn)
 }
 
+// SetNetwork sets the network ListenAndServe listens on: "udp4" or "udp6"
+// to serve a single IP version only, or "udp", the default, to pick it
+// from the address, which on most systems makes ":69" serve both. Serve
+// uses the connection it is given as is.
+func (s *Server) SetNetwork(network string) {
+	s.network = network
+}
+
+// listenNetwork returns the network of ListenAndServe.
+func (s *Server) listenNetwork() string {
+	if s.network == "" {
+		return "udp"
+	}
+	return s.network
+}
+
+// Addr returns the address the server listens on, which includes the port
+// chosen by the system when the server was started with port 0. It returns
+// nil before Serve or ListenAndServe has bound the connection.
+func (s *Server) Addr() *net.UDPAddr {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	addr, _ := s.conn.LocalAddr().(*net.UDPAddr)
+	return addr
+}
+
 // Serve starts server provided already opened UDP connecton. It is
 // useful for the case when you want to run server in separate goroutine
 // but still want to be able to handle any errors opening connection.
@@ -195,7 +588,17 @@ func (s *Server) Serve(conn net.PacketConn) error {
 	if err != nil {
 		return err
 	}
+	if conn, ok := conn.(*net.UDPConn); ok {
+		if err := setBuffers(conn, s.readBuf, s.writeBuf); err != nil {
+			return err
+		}
+		if err := setDSCP(conn, s.dscp); err != nil {
+			return err
+		}
+	}
+	s.connMu.Lock()
 	s.conn = conn
+	s.connMu.Unlock()
 	// Having seperate control paths for IP4 and IP6 is annoying,
 	// but necessary at this point.
 	addr := net.ParseIP(host)
@@ -227,6 +630,9 @@ func (s *Server) Serve(conn net.PacketConn) error {
 				q <- struct{}{}
 				return nil
 			default:
+				// Wake up periodically to notice Shutdown even when no
+				// packets arrive.
+				s.conn.SetReadDeadline(time.Now().Add(s.packetReadTimeout))
 				var err error
 				if s.conn4 != nil {
 					err = s.processRequest4()
@@ -235,10 +641,8 @@ func (s *Server) Serve(conn net.PacketConn) error {
 				} else {
 					err = s.processRequest()
 				}
-				if err != nil && s.hook != nil {
-					s.hook.OnFailure(TransferStats{
-						SenderAnticipateEnabled: s.sendAEnable,
-					}, err)
+				if err != nil && !isTimeout(err) {
+					s.requestFailed(err)
 				}
 			}
 		}
@@ -258,7 +662,7 @@ func (s *Server) processRequest4() error {
 	buf := make([]byte, datagramLength)
 	cnt, control, srcAddr, err := s.conn4.ReadFrom(buf)
 	if err != nil {
-		return fmt.Errorf("reading UDP: %v", err)
+		return fmt.Errorf("reading UDP: %w", err)
 	}
 	maxSz := blockLength
 	var localAddr net.IP
@@ -276,7 +680,7 @@ func (s *Server) processRequest6() error {
 	buf := make([]byte, datagramLength)
 	cnt, control, srcAddr, err := s.conn6.ReadFrom(buf)
 	if err != nil {
-		return fmt.Errorf("reading UDP: %v", err)
+		return fmt.Errorf("reading UDP: %w", err)
 	}
 	maxSz := blockLength
 	var localAddr net.IP
@@ -295,7 +699,7 @@ func (s *Server) processRequest() error {
 	buf := make([]byte, datagramLength)
 	cnt, srcAddr, err := s.conn.ReadFrom(buf)
 	if err != nil {
-		return fmt.Errorf("reading UDP: %v", err)
+		return fmt.Errorf("reading UDP: %w", err)
 	}
 	return s.handlePacket(nil, srcAddr.(*net.UDPAddr), buf, cnt, blockLength, nil)
 }
@@ -303,8 +707,15 @@ func (s *Server) processRequest() error {
 // Shutdown make server stop listening for new requests, allows
 // server to finish outstanding transfers and stops server.
 func (s *Server) Shutdown() {
+	s.stopOnce.Do(func() { close(s.stop) })
 	if !s.singlePort {
 		s.conn.Close()
+	} else {
+		// In single port mode transfers receive their packets from the
+		// request loop, so let them finish first and then wake up the
+		// loop if it is waiting for a packet.
+		s.wg.Wait()
+		s.conn.SetReadDeadline(time.Unix(1, 0))
 	}
 	q := make(chan struct{})
 	s.quit <- q
@@ -324,31 +735,73 @@ func (s *Server) handlePacket(localAddr net.IP, remoteAddr *net.UDPAddr, buffer
 		return err
 	}
 	listenAddr := &net.UDPAddr{IP: localAddr}
+	if isBroadcast(localAddr) {
+		// Reply from a unicast address chosen by the system.
+		listenAddr.IP = net.IPv4zero
+	}
+	if s.bindIP != nil {
+		listenAddr.IP = s.bindIP
+	}
 	switch p := p.(type) {
 	case pWRQ:
 		filename, mode, opts, err := unpackRQ(p)
 		if err != nil {
-			return fmt.Errorf("unpack WRQ: %v", err)
+			var e *TftpError
+			if errors.As(err, &e) {
+				s.reject(remoteAddr, e.Code, e.Message)
+			}
+			return fmt.Errorf("unpack WRQ: %w", err)
 		}
-		//fmt.Printf("got WRQ (filename=%s, mode=%s, opts=%v)\n", filename, mode, opts)
-		if err != nil {
-			return fmt.Errorf("open transmission: %v", err)
+		s.log.Printf("WRQ from %v (filename=%s, mode=%s, opts=%v)", remoteAddr, filename, mode, opts)
+		if !s.singlePort && s.writing(remoteAddr, p) {
+			// The client retransmitted its WRQ because our reply was
+			// lost, the running transfer retransmits the reply.
+			s.log.Printf("duplicate WRQ from %v ignored", remoteAddr)
+			return nil
+		}
+		if s.isQueued(remoteAddr) {
+			s.log.Printf("duplicate WRQ from %v ignored, request is queued", remoteAddr)
+			return nil
+		}
+		s.request(OpWrite, filename, remoteAddr)
+		mode = s.normalizeMode(mode, remoteAddr)
+		if filename, err = s.rewrite(OpWrite, filename, remoteAddr); err != nil {
+			return err
+		}
+		if err := s.authorize(OpWrite, filename, remoteAddr); err != nil {
+			return err
 		}
 		wt := &receiver{
 			send:        make([]byte, datagramLength),
-			receive:     make([]byte, datagramLength),
-			retry:       &backoff{handler: s.backoff},
+			receive:     make([]byte, datagramLength, datagramLength+1),
+			retry:       &backoff{handler: s.backoff, exponential: s.expTimeout, jitter: s.jitter, clock: s.clock},
 			timeout:     s.timeout,
 			retries:     s.retries,
 			addr:        remoteAddr,
 			localIP:     localAddr,
 			mode:        mode,
 			opts:        opts,
+			optOrder:    optionOrder(p),
 			maxBlockLen: maxBlockLen,
+			rollover:    s.rollover,
+			maxWindow:   s.maxWindow,
 			hook:        s.hook,
+			onProgress:  s.onProgress,
+			onEvent:     s.onEvent,
+			onRetry:     s.onRetransmit,
 			filename:    filename,
-			startTime:   time.Now(),
+			startTime:   s.clock.Now(),
+			clock:       s.clock,
+			maxSize:     s.maxWriteSize,
+			dally:       s.dally,
+			strict:      s.strict,
+			appendOK:    s.append,
+		}
+		queued, err := s.admit("WRQ", remoteAddr)
+		if err != nil {
+			return err
 		}
+		forget := func() {}
 		if s.singlePort {
 			wt.conn = &chanConnection{
 				srcAddr:  listenAddr,
@@ -357,20 +810,40 @@ func (s *Server) handlePacket(localAddr net.IP, remoteAddr *net.UDPAddr, buffer
 				timeout:  s.timeout,
 				sendConn: s.conn,
 				complete: s.gcCollect,
+				clock:    s.clock,
 			}
 			wt.singlePort = true
 		} else {
-			conn, err := net.ListenUDP("udp", listenAddr)
+			conn, err := s.listenTransfer(remoteAddr, listenAddr)
 			if err != nil {
+				if queued == nil || !s.unqueue(queued) {
+					s.release()
+				}
 				return err
 			}
 			wt.conn = &connConnection{conn: conn}
+			forget = s.trackWrite(remoteAddr, p)
+			wt.onData = forget
 		}
+		wt.log = s.transferLogger(remoteAddr, wt.conn)
+		wt.ctx = s.transferContext(wt.conn)
 		s.wg.Add(1)
 		go func() {
-			if s.writeHandler != nil {
-				err := s.writeHandler(filename, wt)
+			if queued != nil && !s.dequeue(queued) {
+				wt.abort(errServerBusy)
+				forget()
+				s.wg.Done()
+				return
+			}
+			if err := checkMode(mode); err != nil {
+				wt.abort(err)
+			} else if s.writeHandler != nil {
+				s.emit(EventStarted, OpWrite, filename, remoteAddr)
+				err := s.safeCall(OpWrite, filename, remoteAddr, func() error {
+					return s.writeHandler(filename, wt)
+				})
 				if err != nil {
+					wt.log.Printf("write handler for %s: %v", filename, err)
 					wt.abort(err)
 				} else {
 					wt.terminate()
@@ -378,30 +851,67 @@ func (s *Server) handlePacket(localAddr net.IP, remoteAddr *net.UDPAddr, buffer
 			} else {
 				wt.abort(fmt.Errorf("server does not support write requests"))
 			}
+			forget()
+			s.release()
 			s.wg.Done()
 		}()
 	case pRRQ:
 		filename, mode, opts, err := unpackRQ(p)
 		if err != nil {
-			return fmt.Errorf("unpack RRQ: %v", err)
+			var e *TftpError
+			if errors.As(err, &e) {
+				s.reject(remoteAddr, e.Code, e.Message)
+			}
+			return fmt.Errorf("unpack RRQ: %w", err)
+		}
+		s.log.Printf("RRQ from %v (filename=%s, mode=%s, opts=%v)", remoteAddr, filename, mode, opts)
+		if s.isQueued(remoteAddr) {
+			s.log.Printf("duplicate RRQ from %v ignored, request is queued", remoteAddr)
+			return nil
+		}
+		s.request(OpRead, filename, remoteAddr)
+		mode = s.normalizeMode(mode, remoteAddr)
+		if filename, err = s.rewrite(OpRead, filename, remoteAddr); err != nil {
+			return err
+		}
+		if err := s.authorize(OpRead, filename, remoteAddr); err != nil {
+			return err
+		}
+		_, mcast := opts["multicast"]
+		mcast = mcast && s.mcastGroup != nil && !s.singlePort
+		mkey := transferKey(filename, mode, opts)
+		if mcast && s.mcastJoin(mkey, remoteAddr) {
+			return nil
 		}
-		//fmt.Printf("got RRQ (filename=%s, mode=%s, opts=%v)\n", filename, mode, opts)
 		rf := &sender{
 			send:        make([]byte, datagramLength),
 			sendA:       senderAnticipate{enabled: false},
 			receive:     make([]byte, datagramLength),
 			tid:         remoteAddr.Port,
-			retry:       &backoff{handler: s.backoff},
+			retry:       &backoff{handler: s.backoff, exponential: s.expTimeout, jitter: s.jitter, clock: s.clock},
 			timeout:     s.timeout,
 			retries:     s.retries,
 			addr:        remoteAddr,
 			localIP:     localAddr,
 			mode:        mode,
 			opts:        opts,
+			optOrder:    optionOrder(p),
 			maxBlockLen: maxBlockLen,
+			rollover:    s.rollover,
+			maxWindow:   s.maxWindow,
 			hook:        s.hook,
+			onProgress:  s.onProgress,
+			onEvent:     s.onEvent,
+			onRetry:     s.onRetransmit,
+			rateLimit:   s.rateLimit,
 			filename:    filename,
-			startTime:   time.Now(),
+			startTime:   s.clock.Now(),
+			clock:       s.clock,
+			strict:      s.strict,
+		}
+		queued, err := s.admit("RRQ", remoteAddr)
+		if err != nil {
+			return err
 		}
 		if s.singlePort {
 			rf.conn = &chanConnection{
@@ -411,28 +921,57 @@ func (s *Server) handlePacket(localAddr net.IP, remoteAddr *net.UDPAddr, buffer
 				timeout:  s.timeout,
 				sendConn: s.conn,
 				complete: s.gcCollect,
+				clock:    s.clock,
 			}
 		} else {
-			conn, err := net.ListenUDP("udp", listenAddr)
+			conn, err := s.listenTransfer(remoteAddr, listenAddr)
 			if err != nil {
+				if queued == nil || !s.unqueue(queued) {
+					s.release()
+				}
 				return err
 			}
 			rf.conn = &connConnection{conn: conn}
+			if mcast {
+				if rf.mcastTx = s.mcastStart(mkey, rf.conn); rf.mcastTx != nil {
+					rf.mcast = rf.mcastTx.group
+				}
+			}
 		}
+		rf.log = s.transferLogger(remoteAddr, rf.conn)
+		rf.ctx = s.transferContext(rf.conn)
 		if s.sendAEnable { /* senderAnticipate if enabled in server */
 			rf.sendA.enabled = true /* pass enable from server to sender */
 			sendAInit(&rf.sendA, datagramLength, s.sendAWinSz)
 		}
 		s.wg.Add(1)
 		go func() {
-			if s.readHandler != nil {
-				err := s.readHandler(filename, rf)
+			if queued != nil && !s.dequeue(queued) {
+				rf.abort(errServerBusy)
+				if rf.mcastTx != nil {
+					s.mcastEnd(mkey, rf.mcastTx)
+				}
+				s.wg.Done()
+				return
+			}
+			if err := checkMode(mode); err != nil {
+				rf.abort(err)
+			} else if h := s.readHandlerFor(filename); h != nil {
+				s.emit(EventStarted, OpRead, filename, remoteAddr)
+				err := s.safeCall(OpRead, filename, remoteAddr, func() error {
+					return h(filename, rf)
+				})
 				if err != nil {
+					rf.log.Printf("read handler for %s: %v", filename, err)
 					rf.abort(err)
 				}
 			} else {
 				rf.abort(fmt.Errorf("server does not support read requests"))
 			}
+			if rf.mcastTx != nil {
+				s.mcastEnd(mkey, rf.mcastTx)
+			}
+			s.release()
 			s.wg.Done()
 		}()
 	default:
@@ -440,3 +979,218 @@ func (s *Server) handlePacket(localAddr net.IP, remoteAddr *net.UDPAddr, buffer
 	}
 	return nil
 }
+
+// transferContext returns context of a transfer over conn. With a total
+// timeout set the context expires after it and interrupts conn.
+func (s *Server) transferContext(conn connection) context.Context {
+	if s.totalTimeout <= 0 {
+		return context.Background()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.totalTimeout)
+	switch c := conn.(type) {
+	case *connConnection:
+		c.cancel = cancel
+		c.cancelOn(ctx)
+	case *chanConnection:
+		c.cancel = cancel
+		c.done = ctx.Done()
+	default:
+		cancel()
+		return context.Background()
+	}
+	return ctx
+}
+
+// normalizeMode lowercases the transfer mode of a request. Some minimal
+// clients send an empty mode, which is treated as octet.
+func (s *Server) normalizeMode(mode string, addr *net.UDPAddr) string {
+	mode = strings.ToLower(mode)
+	if mode == "" {
+		s.log.Printf("empty mode from %v, assuming octet", addr)
+		return "octet"
+	}
+	return mode
+}
+
+// checkMode returns an error unless mode is octet or netascii. The mail
+// mode of RFC 1350 is obsolete and rejected as well. Mode must already
+// be in lower case.
+func checkMode(mode string) error {
+	switch mode {
+	case "octet", "netascii":
+		return nil
+	case "mail":
+		return &TftpError{Code: codeIllegalOperation,
+			Message: "mail transfer mode is obsolete and not supported"}
+	}
+	return &TftpError{Code: codeIllegalOperation,
+		Message: fmt.Sprintf("unsupported transfer mode: %s", mode)}
+}
+
+// requestFailed reports an error returned by handlePacket.
+func (s *Server) requestFailed(err error) {
+	s.log.Printf("processing request: %v", err)
+	if s.hook != nil {
+		s.hook.OnFailure(TransferStats{
+			SenderAnticipateEnabled: s.sendAEnable,
+		}, err)
+	}
+	if s.onError != nil {
+		s.onError(err)
+	}
+}
+
+// request reports a request to the request hook and the event handler.
+func (s *Server) request(op Op, filename string, addr *net.UDPAddr) {
+	if s.onRequest != nil {
+		s.onRequest(op, filename, addr)
+	}
+	s.emit(EventRequest, op, filename, addr)
+}
+
+// emit reports an event that is not bound to a running transfer.
+func (s *Server) emit(t EventType, op Op, filename string, addr *net.UDPAddr) {
+	if s.onEvent != nil {
+		s.onEvent(Event{Type: t, Op: op, Filename: filename, RemoteAddr: addr})
+	}
+}
+
+// authorize runs the authorizer and rejects the request if it fails.
+func (s *Server) authorize(op Op, filename string, addr *net.UDPAddr) error {
+	if s.authorizer == nil {
+		return nil
+	}
+	err := s.authorizer(op, filename, addr)
+	if err != nil {
+		s.reject(addr, codeAccessViolation, err.Error())
+		return fmt.Errorf("%s of %s by %v denied: %v", op, filename, addr, err)
+	}
+	return nil
+}
+
+// transferLogger returns a logger for a transfer with addr over conn. The
+// prefix with the client address and the local port of the transfer, its
+// TID, tells the lines of concurrent transfers apart.
+func (s *Server) transferLogger(addr *net.UDPAddr, conn connection) *log.Logger {
+	var local net.Addr
+	switch c := conn.(type) {
+	case *connConnection:
+		local = c.conn.LocalAddr()
+	case *chanConnection:
+		local = c.sendConn.LocalAddr()
+	}
+	tid := 0
+	if a, ok := local.(*net.UDPAddr); ok {
+		tid = a.Port
+	}
+	prefix := fmt.Sprintf("%s%v tid=%d: ", s.log.Prefix(), addr, tid)
+	return log.New(s.log.Writer(), prefix, s.log.Flags())
+}
+
+// rewrite runs the filename rewriter and rejects the request if it fails.
+func (s *Server) rewrite(op Op, filename string, addr *net.UDPAddr) (string, error) {
+	if s.rewriter == nil {
+		return filename, nil
+	}
+	name, err := s.rewriter(filename, addr)
+	if err != nil {
+		code, msg := codeAccessViolation, err.Error()
+		var e *TftpError
+		if errors.As(err, &e) {
+			code, msg = e.Code, e.Message
+		}
+		s.reject(addr, code, msg)
+		return "", fmt.Errorf("%s of %s by %v rejected: %v", op, filename, addr, err)
+	}
+	if name != filename {
+		s.log.Printf("%s of %s by %v rewritten to %s", op, filename, addr, name)
+	}
+	return name, nil
+}
+
+// acquire reserves a slot for a new transfer. It returns false if the
+// maximum number of concurrent transfers is reached.
+func (s *Server) acquire() bool {
+	for {
+		n := atomic.LoadInt32(&s.active)
+		if s.maxTransfers > 0 && int(n) >= s.maxTransfers {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&s.active, n, n+1) {
+			return true
+		}
+	}
+}
+
+// release frees the slot of a transfer that ended. If requests are
+// queued the slot passes on to the oldest one.
+func (s *Server) release() {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	if len(s.queued) > 0 {
+		w := s.queued[0]
+		s.queued = s.queued[1:]
+		close(w.ready)
+		return
+	}
+	atomic.AddInt32(&s.active, -1)
+}
+
+// safeCall calls handler f and turns a panic in it into an error.
+func (s *Server) safeCall(op Op, filename string, addr *net.UDPAddr, f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.log.Printf("panic in %v handler for %s from %v: %v\n%s",
+				op, filename, addr, r, debug.Stack())
+			err = &TftpError{Code: codeNotDefined, Message: s.panicMsg}
+		}
+	}()
+	return f()
+}
+
+// wrq is the request that started a write transfer, see trackWrite.
+type wrq struct {
+	packet []byte
+}
+
+// writing reports whether p, a WRQ from addr, is a retransmission of the
+// one that started a write transfer which has not received DATA yet.
+func (s *Server) writing(addr *net.UDPAddr, p []byte) bool {
+	s.writesMu.Lock()
+	defer s.writesMu.Unlock()
+	w, ok := s.writes[addr.String()]
+	return ok && bytes.Equal(w.packet, p)
+}
+
+// trackWrite records the WRQ p from addr that starts a write transfer, so
+// that retransmissions of it do not start another one. The client stops
+// retransmitting once it sends DATA, so the returned function forgets the
+// WRQ again when the first block arrives or when the transfer ends first.
+// New requests from the same port, e.g. of a Session, are not held up by
+// the rest of the transfer or by the dally period.
+func (s *Server) trackWrite(addr *net.UDPAddr, p []byte) func() {
+	w := &wrq{packet: append([]byte(nil), p...)}
+	key := addr.String()
+	s.writesMu.Lock()
+	defer s.writesMu.Unlock()
+	if s.writes == nil {
+		s.writes = make(map[string]*wrq)
+	}
+	s.writes[key] = w
+	return func() {
+		s.writesMu.Lock()
+		defer s.writesMu.Unlock()
+		// A later transfer from addr may have replaced it.
+		if s.writes[key] == w {
+			delete(s.writes, key)
+		}
+	}
+}
+
+// reject answers a request with an ERROR packet sent from the server port.
+func (s *Server) reject(addr *net.UDPAddr, code uint16, msg string) error {
+	b := make([]byte, datagramLength)
+	n := packERROR(b, code, msg)
+	_, err := s.conn.WriteTo(b[:n], addr)
+	return err
+}
@@ -0,0 +1,79 @@
+package tftp
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+)
+
+// Session runs sequential transfers with a server over a single local
+// socket. Each transfer still gets its own TID on the server side, only
+// the client port is reused. This saves a socket per transfer when many
+// small files are fetched from the same server. Transfers of a session
+// are serialized, use several sessions or a Client to run them in
+// parallel.
+type Session struct {
+	c    *Client
+	conn *net.UDPConn
+	mu   sync.Mutex
+	last *net.UDPAddr // server TID of the previous transfer
+}
+
+// NewSession opens a socket for a new session with the server of c. The
+// session uses the settings of c at the time each transfer is started.
+// It must be closed once it is no longer needed.
+func (c *Client) NewSession() (*Session, error) {
+	cc, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	return &Session{c: c, conn: cc.conn}, nil
+}
+
+// LocalAddr returns the address of the session socket.
+func (s *Session) LocalAddr() *net.UDPAddr {
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// connection returns a connection for the next transfer. Late packets of
+// the previous transfer are dropped, unless they come from the request
+// port as with servers in single port mode.
+func (s *Session) connection() *connConnection {
+	cc := &connConnection{conn: s.conn, shared: true}
+	if s.last != nil && !(s.last.Port == s.c.addr.Port && s.last.IP.Equal(s.c.addr.IP)) {
+		cc.stale = s.last
+	}
+	return cc
+}
+
+// PutFile is like Client.PutFile but runs the upload over the session
+// socket.
+func (s *Session) PutFile(filename string, mode string, src io.Reader) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rf, err := s.c.send(context.Background(), s.connection(), filename, mode, -1, nil)
+	if err != nil {
+		return 0, err
+	}
+	s.last = rf.(*sender).addr
+	return rf.ReadFrom(src)
+}
+
+// GetFile is like Client.GetFile but runs the download over the session
+// socket.
+func (s *Session) GetFile(filename string, mode string, dst io.Writer) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wt, err := s.c.receive(context.Background(), s.connection(), filename, mode, nil)
+	if err != nil {
+		return 0, err
+	}
+	s.last = wt.(*receiver).addr
+	return wt.WriteTo(dst)
+}
+
+// Close closes the session socket.
+func (s *Session) Close() error {
+	return s.conn.Close()
+}
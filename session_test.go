@@ -0,0 +1,101 @@
+package tftp
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSession(t *testing.T) {
+	var mu sync.Mutex
+	ports := map[int]bool{}
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		addr := rf.(OutgoingTransfer).RemoteAddr()
+		mu.Lock()
+		ports[addr.Port] = true
+		mu.Unlock()
+		_, err := rf.ReadFrom(strings.NewReader(strings.Repeat(filename, 300)))
+		return err
+	}, nil)
+	c, _ := startTestServer(t, s)
+
+	sess, err := c.NewSession()
+	if err != nil {
+		t.Fatalf("creating session: %v", err)
+	}
+	defer sess.Close()
+	for _, name := range []string{"a", "bb", "ccc"} {
+		buf := &bytes.Buffer{}
+		n, err := sess.GetFile(name, "octet", buf)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if expected := strings.Repeat(name, 300); buf.String() != expected || n != int64(len(expected)) {
+			t.Errorf("%s: %d bytes received, %d expected", name, n, len(expected))
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ports) != 1 || !ports[sess.LocalAddr().Port] {
+		t.Errorf("all transfers from port %d expected, got %v", sess.LocalAddr().Port, ports)
+	}
+}
+
+func TestSessionPut(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	sess, err := c.NewSession()
+	if err != nil {
+		t.Fatalf("creating session: %v", err)
+	}
+	defer sess.Close()
+	for _, name := range []string{"one", "two", "three"} {
+		if _, err := sess.PutFile(name, "octet", strings.NewReader(name)); err != nil {
+			t.Fatalf("putting %s: %v", name, err)
+		}
+	}
+	for _, name := range []string{"one", "two", "three"} {
+		buf := &bytes.Buffer{}
+		if _, err := sess.GetFile(name, "octet", buf); err != nil || buf.String() != name {
+			t.Errorf("getting %s: %v, %q", name, err, buf)
+		}
+	}
+}
+
+func TestSessionPutDally(t *testing.T) {
+	var mu sync.Mutex
+	var files []string
+	s := NewServer(nil, func(filename string, wt io.WriterTo) error {
+		buf := &bytes.Buffer{}
+		_, err := wt.WriteTo(buf)
+		mu.Lock()
+		files = append(files, filename+"="+buf.String())
+		mu.Unlock()
+		return err
+	})
+	s.SetDally(time.Second)
+	c, _ := startTestServer(t, s)
+	c.SetTimeout(200 * time.Millisecond)
+	c.SetRetries(1)
+
+	sess, err := c.NewSession()
+	if err != nil {
+		t.Fatalf("creating session: %v", err)
+	}
+	defer sess.Close()
+	// The same upload twice, the second one while the server still
+	// dallies after the first.
+	for i := 0; i < 2; i++ {
+		if _, err := sess.PutFile("same", "octet", strings.NewReader("data")); err != nil {
+			t.Fatalf("upload %d: %v", i+1, err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(files) != 2 || files[0] != "same=data" || files[1] != "same=data" {
+		t.Errorf("uploads received: %v", files)
+	}
+}
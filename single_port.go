@@ -2,6 +2,7 @@ package tftp
 
 import (
 	"net"
+	"time"
 )
 
 func (s *Server) singlePortProcessRequests() error {
@@ -19,10 +20,9 @@ func (s *Server) singlePortProcessRequests() error {
 			s.handlers[srcAddr.String()] = make(chan []byte, 1)
 			go func(localAddr net.IP, remoteAddr *net.UDPAddr, buffer []byte, n, maxBlockLen int, listener chan []byte) {
 				err := s.handlePacket(localAddr, remoteAddr, buffer, n, maxBlockLen, listener)
-				if err != nil && s.hook != nil {
-					s.hook.OnFailure(TransferStats{
-						SenderAnticipateEnabled: s.sendAEnable,
-					}, err)
+				if err != nil {
+					s.requestFailed(err)
+					s.dropHandler(remoteAddr.String())
 				}
 
 			}(localAddr, srcAddr.(*net.UDPAddr), buf, cnt, maxSz, s.handlers[srcAddr.String()])
@@ -40,9 +40,10 @@ func (s *Server) singlePortProcessRequests() error {
 			}
 		default:
 			buf = s.bufPool.Get().([]byte)
+			s.conn.SetReadDeadline(time.Now().Add(s.packetReadTimeout))
 			cnt, localAddr, srcAddr, maxSz, err = s.getPacket(buf)
 			if err != nil || cnt == 0 {
-				if s.hook != nil {
+				if !isTimeout(err) && s.hook != nil {
 					s.hook.OnFailure(TransferStats{
 						SenderAnticipateEnabled: s.sendAEnable,
 					}, err)
@@ -60,10 +61,9 @@ func (s *Server) singlePortProcessRequests() error {
 				s.handlers[srcAddr.String()] = make(chan []byte, 1)
 				go func(localAddr net.IP, remoteAddr *net.UDPAddr, buffer []byte, n, maxBlockLen int, listener chan []byte) {
 					err := s.handlePacket(localAddr, remoteAddr, buffer, n, maxBlockLen, listener)
-					if err != nil && s.hook != nil {
-						s.hook.OnFailure(TransferStats{
-							SenderAnticipateEnabled: s.sendAEnable,
-						}, err)
+					if err != nil {
+						s.requestFailed(err)
+						s.dropHandler(remoteAddr.String())
 					}
 
 				}(localAddr, srcAddr.(*net.UDPAddr), buf, cnt, maxSz, s.handlers[srcAddr.String()])
@@ -112,6 +112,17 @@ func (s *Server) getPacket(buf []byte) (int, net.IP, *net.UDPAddr, int, error) {
 	}
 }
 
+// dropHandler makes the main loop remove the handler of packets from addr
+// right away. It is for requests that fail before their transfer starts:
+// no connection reports them to internalGC, and until the handler is gone
+// the retransmitted or next requests from addr would be swallowed by it.
+func (s *Server) dropHandler(addr string) {
+	select {
+	case s.runGC <- []string{addr}:
+	case <-s.stop:
+	}
+}
+
 // internalGC collects all the finished signals from each connection's goroutine
 // The main loop is sent the key to be nil'ed after the gcInterval has passed
 func (s *Server) internalGC() {
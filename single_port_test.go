@@ -1,7 +1,13 @@
 package tftp
 
 import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestZeroLengthSinglePort(t *testing.T) {
@@ -28,11 +34,134 @@ func TestSendReceiveSinglePortWithBlockSize(t *testing.T) {
 }
 
 func TestServerSendTimeoutSinglePort(t *testing.T) {
-	s, c := makeTestServer(true)
-	serverTimeoutSendTest(s, c, t)
+	clock := newFakeClock()
+	serverErr := make(chan error, 1)
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		r := io.LimitReader(newRandReader(rand.NewSource(42)), 80000)
+		_, err := rf.ReadFrom(r)
+		serverErr <- err
+		return err
+	}, nil)
+	s.clock = clock
+	s.SetTimeout(time.Second)
+	s.SetRetries(2)
+	s.EnableSinglePort()
+	_, serverAddr := startTestServer(t, s)
+
+	p := newRawPeer(t)
+	defer p.close()
+	req := make([]byte, datagramLength)
+	n := packRQ(req, opRRQ, "test-server-send-timeout", "octet", nil)
+	p.send(req[:n], serverAddr)
+	// Never ACK and let the fake time run until the server gives up.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+				clock.Advance(time.Second)
+			}
+		}
+	}()
+	sent := 0
+	for {
+		reply, _ := p.receive()
+		pkt, err := parsePacket(reply)
+		if err != nil {
+			t.Fatalf("parsing reply: %v", err)
+		}
+		if _, ok := pkt.(pERROR); ok {
+			break
+		}
+		if d, ok := pkt.(pDATA); !ok || d.block() != 1 {
+			t.Fatalf("DATA for block 1 expected, got %v", reply[:4])
+		}
+		sent++
+	}
+	if sent != 3 {
+		t.Errorf("block 1 expected to be sent 3 times, sent %d", sent)
+	}
+	err := <-serverErr
+	netErr, ok := err.(net.Error)
+	if !ok || !netErr.Timeout() {
+		t.Fatalf("timeout error expected: %v", err)
+	}
 }
 
 func TestServerReceiveTimeoutSinglePort(t *testing.T) {
 	s, c := makeTestServer(true)
 	serverReceiveTimeoutTest(s, c, t)
 }
+
+func TestRejectedRequestSinglePort(t *testing.T) {
+	b := &testBackend{m: map[string][]byte{"allowed": []byte("data")}}
+	s := NewServer(b.handleRead, nil)
+	s.SetAuthorizer(func(op Op, filename string, addr *net.UDPAddr) error {
+		if filename != "allowed" {
+			return errors.New("denied")
+		}
+		return nil
+	})
+	s.EnableSinglePort()
+	_, serverAddr := startTestServer(t, s)
+	p := newRawPeer(t)
+	defer p.close()
+	req := make([]byte, datagramLength)
+	p.send(req[:packRQ(req, opRRQ, "denied", "octet", nil)], serverAddr)
+	p.expectError(codeAccessViolation)
+
+	// A request from the same address is served, if not the one sent
+	// right away then one retransmitted like a client would.
+	n := packRQ(req, opRRQ, "allowed", "octet", nil)
+	for i := 0; ; i++ {
+		if i == 10 {
+			t.Fatal("no reply to the request after the rejected one")
+		}
+		p.send(req[:n], serverAddr)
+		p.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		m, tid, err := p.conn.ReadFromUDP(p.buf)
+		if err != nil {
+			continue
+		}
+		if d := p.checkDATA(p.buf[:m], 1); string(d[4:]) != "data" {
+			t.Fatalf("DATA of allowed expected, got %q", d[4:])
+		}
+		p.send(NewACK(1).Pack(), tid)
+		break
+	}
+}
+
+func TestShutdownSinglePort(t *testing.T) {
+	started := make(chan struct{})
+	proceed := make(chan struct{})
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		close(started)
+		<-proceed
+		_, err := rf.ReadFrom(io.LimitReader(newRandReader(rand.NewSource(42)), 5000))
+		return err
+	}, nil)
+	s.SetTimeout(200 * time.Millisecond)
+	s.EnableSinglePort()
+	c, _ := runTestServer(t, s)
+	received := make(chan error, 1)
+	go func() {
+		_, err := c.GetFile("file", "octet", ioutil.Discard)
+		received <- err
+	}()
+	<-started
+	done := make(chan struct{})
+	go func() {
+		s.Shutdown()
+		close(done)
+	}()
+	// The running transfer still receives its ACKs.
+	time.Sleep(50 * time.Millisecond)
+	close(proceed)
+	if err := <-received; err != nil {
+		t.Errorf("transfer running at shutdown: %v", err)
+	}
+	<-done
+}
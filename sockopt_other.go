@@ -0,0 +1,18 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris && !windows
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris,!windows
+
+package tftp
+
+import "syscall"
+
+// broadcastControl leaves socket options at the system defaults on
+// platforms without SO_BROADCAST support in package syscall.
+func broadcastControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+// addrInUse reports whether err is the error of binding a port in use.
+// Without a way to tell, every error counts as one.
+func addrInUse(err error) bool {
+	return true
+}
@@ -0,0 +1,30 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package tftp
+
+import (
+	"errors"
+	"syscall"
+)
+
+// broadcastControl sets SO_BROADCAST and SO_REUSEADDR on a socket before
+// it is bound.
+func broadcastControl(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+		if err == nil {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// addrInUse reports whether err is the error of binding a port in use.
+func addrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE)
+}
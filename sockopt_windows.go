@@ -0,0 +1,20 @@
+package tftp
+
+import (
+	"errors"
+	"syscall"
+)
+
+// wsaeaddrinuse is the Winsock error of binding a port in use. Package
+// syscall has no name for it.
+const wsaeaddrinuse = syscall.Errno(10048)
+
+// broadcastControl leaves socket options at the system defaults.
+func broadcastControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+// addrInUse reports whether err is the error of binding a port in use.
+func addrInUse(err error) bool {
+	return errors.Is(err, wsaeaddrinuse)
+}
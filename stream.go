@@ -0,0 +1,65 @@
+package tftp
+
+import "io"
+
+// Write makes an outgoing transfer an io.Writer, so it can be the
+// destination of io.Copy. The data written is sent by ReadFrom running in
+// the background. Close must be called once all data is written to send
+// the final block. Do not call ReadFrom on a transfer Write was used on.
+func (s *sender) Write(p []byte) (int, error) {
+	s.startPipe()
+	return s.pipe.Write(p)
+}
+
+// Close ends an outgoing transfer fed with Write. It returns once the
+// final block is acknowledged with the error of the transfer, if any. It
+// does nothing if the transfer was run with ReadFrom, as io.Copy does for
+// sources that do not implement io.WriterTo.
+func (s *sender) Close() error {
+	if s.started && s.pipe == nil {
+		return nil
+	}
+	s.startPipe()
+	s.pipe.Close()
+	return <-s.pipeErr
+}
+
+func (s *sender) startPipe() {
+	if s.pipe != nil {
+		return
+	}
+	pr, pw := io.Pipe()
+	s.pipe = pw
+	s.pipeErr = make(chan error, 1)
+	go func() {
+		_, err := s.ReadFrom(pr)
+		// Fail pending and later writes if the transfer ended early.
+		pr.CloseWithError(err)
+		s.pipeErr <- err
+	}()
+}
+
+// Read makes an incoming transfer an io.Reader, so it can be the source
+// of io.Copy. The data is received by WriteTo running in the background.
+// Read returns io.EOF after the final block. Do not call WriteTo on a
+// transfer Read was used on.
+func (r *receiver) Read(p []byte) (int, error) {
+	if r.pipe == nil {
+		pr, pw := io.Pipe()
+		r.pipe = pr
+		go func() {
+			_, err := r.WriteTo(pw)
+			pw.CloseWithError(err)
+		}()
+	}
+	return r.pipe.Read(p)
+}
+
+// Close aborts an incoming transfer read with Read before its end. It
+// does nothing if Read was not used or the whole file was read.
+func (r *receiver) Close() error {
+	if r.pipe != nil {
+		r.pipe.Close()
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package tftp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+)
+
+// onlyReader hides io.WriterTo of the wrapped reader from io.Copy.
+type onlyReader struct {
+	io.Reader
+}
+
+func TestStreamCopy(t *testing.T) {
+	var mu sync.Mutex
+	files := map[string][]byte{}
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		mu.Lock()
+		data := files[filename]
+		mu.Unlock()
+		_, err := rf.ReadFrom(bytes.NewReader(data))
+		return err
+	}, func(filename string, wt io.WriterTo) error {
+		buf := &bytes.Buffer{}
+		_, err := wt.WriteTo(buf)
+		mu.Lock()
+		files[filename] = buf.Bytes()
+		mu.Unlock()
+		return err
+	})
+	c, _ := startTestServer(t, s)
+
+	data := bytes.Repeat([]byte("0123456789"), 250)
+	for name, src := range map[string]io.Reader{
+		"writer-to": bytes.NewReader(data),             // io.Copy calls Write
+		"reader":    onlyReader{bytes.NewReader(data)}, // io.Copy calls ReadFrom
+		"empty":     onlyReader{&bytes.Buffer{}},
+	} {
+		rf, err := c.Send(name, "octet")
+		if err != nil {
+			t.Fatalf("%s: requesting write: %v", name, err)
+		}
+		wc := rf.(io.WriteCloser)
+		if _, err := io.Copy(wc, src); err != nil {
+			t.Fatalf("%s: copying to transfer: %v", name, err)
+		}
+		if err := wc.Close(); err != nil {
+			t.Fatalf("%s: closing transfer: %v", name, err)
+		}
+
+		want := data
+		if name == "empty" {
+			want = nil
+		}
+		wt, err := c.Receive(name, "octet")
+		if err != nil {
+			t.Fatalf("%s: requesting read: %v", name, err)
+		}
+		buf := &bytes.Buffer{}
+		if _, err := io.Copy(buf, wt.(io.Reader)); err != nil {
+			t.Fatalf("%s: copying from transfer: %v", name, err)
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("%s: %d bytes copied, want %d", name, buf.Len(), len(want))
+		}
+
+		wt, err = c.Receive(name, "octet")
+		if err != nil {
+			t.Fatalf("%s: requesting read: %v", name, err)
+		}
+		got, err := ioutil.ReadAll(onlyReader{wt.(io.Reader)})
+		if err != nil {
+			t.Fatalf("%s: reading transfer: %v", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: %d bytes read, want %d", name, len(got), len(want))
+		}
+	}
+}
@@ -2,20 +2,31 @@ package tftp
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"log"
 	"math/rand"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"testing/iotest"
 	"time"
 
 	"github.com/stretchr/testify/mock"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 var localhost = determineLocalhost()
@@ -116,6 +127,50 @@ func TestZeroLength(t *testing.T) {
 	testSendReceive(t, c, 0)
 }
 
+func TestEmptyFile(t *testing.T) {
+	setups := map[string]func(s *Server, c *Client){
+		"default":    func(s *Server, c *Client) {},
+		"window":     func(s *Server, c *Client) { c.SetWindowSize(4) },
+		"anticipate": func(s *Server, c *Client) { s.SetAnticipate(4) },
+		"options":    func(s *Server, c *Client) { c.SetBlockSize(1024); c.RequestTSize(true) },
+	}
+	for _, singlePort := range []bool{false, true} {
+		for name, setup := range setups {
+			s, c := makeTestServer(singlePort)
+			setup(s, c)
+			n, err := c.PutFile("empty", "octet", bytes.NewReader(nil))
+			if n != 0 || err != nil {
+				t.Errorf("%s, single port %v: put returned %d, %v", name, singlePort, n, err)
+			}
+			buf := &bytes.Buffer{}
+			n, err = c.GetFile("empty", "octet", buf)
+			if n != 0 || err != nil || buf.Len() != 0 {
+				t.Errorf("%s, single port %v: get returned %d, %v, %d bytes",
+					name, singlePort, n, err, buf.Len())
+			}
+			s.Shutdown()
+		}
+	}
+
+	// The file is sent as a single empty DATA block.
+	b := &testBackend{m: map[string][]byte{"empty": nil}}
+	s := NewServer(b.handleRead, nil)
+	_, serverAddr := startTestServer(t, s)
+	p := newRawPeer(t)
+	defer p.close()
+	req := make([]byte, datagramLength)
+	p.send(req[:packRQ(req, opRRQ, "empty", "octet", nil)], serverAddr)
+	d, tid := p.expectDATA(1)
+	if len(d) != 4 {
+		t.Fatalf("empty DATA block 1 expected, got %v", d)
+	}
+	p.send(NewACK(1).Pack(), tid)
+	p.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, _, err := p.conn.ReadFromUDP(p.buf); err == nil {
+		t.Errorf("unexpected packet after final ACK: %v", p.buf[:n])
+	}
+}
+
 func Test900(t *testing.T) {
 	s, c := makeTestServer(false)
 	defer s.Shutdown()
@@ -232,6 +287,21 @@ func TestBlockWrapsAround(t *testing.T) {
 	}
 }
 
+func TestBlockRollover(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	// 40 MB takes more than 65535 blocks of 512 bytes.
+	testSendReceive(t, c, 40*1024*1024)
+}
+
+func TestBlockRolloverToOne(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	s.SetBlockRollover(1)
+	c.SetBlockRollover(1)
+	testSendReceive(t, c, 65536*512+100)
+}
+
 func TestRandomLength(t *testing.T) {
 	s, c := makeTestServer(false)
 	defer s.Shutdown()
@@ -447,6 +517,41 @@ func makeTestServer(singlePort bool) (*Server, *Client) {
 	return s, c
 }
 
+// startTestServer runs s on a new socket until the test ends and returns
+// a client for it along with its address.
+func startTestServer(t *testing.T, s *Server) (*Client, *net.UDPAddr) {
+	t.Helper()
+	c, addr := runTestServer(t, s)
+	t.Cleanup(s.Shutdown)
+	return c, addr
+}
+
+// runTestServer is startTestServer for tests that shut the server down
+// themselves.
+func runTestServer(t *testing.T, s *Server) (*Client, *net.UDPAddr) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatalf("listen UDP: %v", err)
+	}
+	return serveTestConn(t, s, conn)
+}
+
+// serveTestConn is runTestServer serving on conn.
+func serveTestConn(t *testing.T, s *Server, conn *net.UDPConn) (*Client, *net.UDPAddr) {
+	t.Helper()
+	go s.Serve(conn)
+	addr, err := net.ResolveUDPAddr("udp", localSystem(conn))
+	if err != nil {
+		t.Fatalf("resolving server address: %v", err)
+	}
+	c, err := NewClient(addr.String())
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	return c, addr
+}
+
 func TestNoHandlers(t *testing.T) {
 	s := NewServer(nil, nil)
 
@@ -502,7 +607,7 @@ func (b *testBackend) handleRead(filename string, rf io.ReaderFrom) error {
 	bs, ok := b.m[filename]
 	if !ok {
 		fmt.Fprintf(os.Stderr, "File %s not found\n", filename)
-		return fmt.Errorf("file not found")
+		return ErrFileNotFound
 	}
 	if t, ok := rf.(OutgoingTransfer); ok {
 		t.SetSize(int64(len(bs)))
@@ -646,6 +751,32 @@ func TestClientReceiveTimeout(t *testing.T) {
 	}
 }
 
+func TestTruncated(t *testing.T) {
+	p := newRawPeer(t)
+	defer p.close()
+	c, err := NewClient(localSystem(p.conn))
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	c.SetTimeout(100 * time.Millisecond)
+	c.SetRetries(1)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.GetFile("truncated", "octet", ioutil.Discard)
+		errc <- err
+	}()
+	_, addr := p.receive()
+	// Sender dies after the first full block.
+	p.send(NewDATA(1, make([]byte, blockLength)).Pack(), addr)
+	err = <-errc
+	if !errors.Is(err, ErrTruncated) {
+		t.Fatalf("%v expected, got %v", ErrTruncated, err)
+	}
+	if !isTimeout(err) {
+		t.Errorf("timeout expected: %v", err)
+	}
+}
+
 func TestClientSendTimeout(t *testing.T) {
 	s, c := makeTestServer(false)
 	c.SetTimeout(time.Second)
@@ -764,13 +895,14 @@ func TestRequestPacketInfo(t *testing.T) {
 	}
 
 	// Start server
-	go func() {
-		err := s.Serve(conn)
-		if err != nil {
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(conn) }()
+	defer func() {
+		s.Shutdown()
+		if err := <-served; err != nil {
 			t.Fatalf("serve: %v", err)
 		}
 	}()
-	defer s.Shutdown()
 
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
@@ -885,13 +1017,14 @@ func TestReadWriteErrors(t *testing.T) {
 	}
 
 	// Start server
-	go func() {
-		err := s.Serve(conn)
-		if err != nil {
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(conn) }()
+	defer func() {
+		s.Shutdown()
+		if err := <-served; err != nil {
 			t.Fatalf("running serve: %v", err)
 		}
 	}()
-	defer s.Shutdown()
 
 	// Create client
 	c, err := NewClient(net.JoinHostPort(localhost, port))
@@ -931,3 +1064,4117 @@ var errWrite = errors.New("write error")
 func (r *failingWriter) Write(_ []byte) (int, error) {
 	return 0, errWrite
 }
+
+// rawPeer is a bare UDP socket used to talk to the server packet by packet.
+type rawPeer struct {
+	t    *testing.T
+	conn *net.UDPConn
+	buf  []byte
+}
+
+func newRawPeer(t *testing.T) *rawPeer {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatalf("listen UDP: %v", err)
+	}
+	return &rawPeer{t: t, conn: conn, buf: make([]byte, 65536)}
+}
+
+func (p *rawPeer) send(b []byte, addr *net.UDPAddr) {
+	if _, err := p.conn.WriteToUDP(b, addr); err != nil {
+		p.t.Fatalf("sending to %v: %v", addr, err)
+	}
+}
+
+func (p *rawPeer) receive() ([]byte, *net.UDPAddr) {
+	p.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, addr, err := p.conn.ReadFromUDP(p.buf)
+	if err != nil {
+		p.t.Fatalf("receiving: %v", err)
+	}
+	return p.buf[:n], addr
+}
+
+func (p *rawPeer) close() {
+	p.conn.Close()
+}
+
+// expectOACK receives a packet and fails the test unless it is an OACK.
+func (p *rawPeer) expectOACK() (*OACK, *net.UDPAddr) {
+	p.t.Helper()
+	reply, addr := p.receive()
+	pkt, err := parsePacket(reply)
+	if err != nil {
+		p.t.Fatalf("parsing reply: %v", err)
+	}
+	oack, ok := pkt.(*OACK)
+	if !ok {
+		p.t.Fatalf("OACK expected, got %v", reply)
+	}
+	return oack, addr
+}
+
+// expectDATA receives a packet and fails the test unless it is DATA for
+// block.
+func (p *rawPeer) expectDATA(block uint16) (pDATA, *net.UDPAddr) {
+	p.t.Helper()
+	reply, addr := p.receive()
+	return p.checkDATA(reply, block), addr
+}
+
+// checkDATA fails the test unless b is DATA for block.
+func (p *rawPeer) checkDATA(b []byte, block uint16) pDATA {
+	p.t.Helper()
+	pkt, err := parsePacket(b)
+	if err != nil {
+		p.t.Fatalf("parsing reply: %v", err)
+	}
+	d, ok := pkt.(pDATA)
+	if !ok || d.block() != block {
+		p.t.Fatalf("DATA %d expected, got %v", block, b[:4])
+	}
+	return d
+}
+
+// expectWindow receives DATA for each of blocks in turn.
+func (p *rawPeer) expectWindow(blocks ...uint16) {
+	p.t.Helper()
+	for _, block := range blocks {
+		p.expectDATA(block)
+	}
+}
+
+// expectACK receives a packet and fails the test unless it is an ACK for
+// block.
+func (p *rawPeer) expectACK(block uint16) *net.UDPAddr {
+	p.t.Helper()
+	reply, addr := p.receive()
+	pkt, err := parsePacket(reply)
+	if err != nil {
+		p.t.Fatalf("parsing reply: %v", err)
+	}
+	if ack, ok := pkt.(pACK); !ok || ack.block() != block {
+		p.t.Fatalf("ACK %d expected, got %v", block, reply)
+	}
+	return addr
+}
+
+// expectError receives a packet and fails the test unless it is an ERROR
+// with code.
+func (p *rawPeer) expectError(code uint16) pERROR {
+	p.t.Helper()
+	reply, _ := p.receive()
+	pkt, err := parsePacket(reply)
+	if err != nil {
+		p.t.Fatalf("parsing reply: %v", err)
+	}
+	e, ok := pkt.(pERROR)
+	if !ok || e.code() != code {
+		p.t.Fatalf("ERROR(%d) expected, got %v", code, reply)
+	}
+	return e
+}
+
+func TestServerBlockSizeOption(t *testing.T) {
+	b := &testBackend{m: make(map[string][]byte)}
+	s := NewServer(b.handleRead, b.handleWrite)
+	_, serverAddr := runTestServer(t, s)
+
+	p := newRawPeer(t)
+	defer p.close()
+	req := make([]byte, datagramLength)
+	n := packRQ(req, opWRQ, "blksize-1428", "octet", options{"blksize": "1428"})
+	p.send(req[:n], serverAddr)
+
+	oack, addr := p.expectOACK()
+	opts := oack.options()
+	if opts["blksize"] != "1428" {
+		t.Fatalf("blksize 1428 expected in OACK: %v", opts)
+	}
+
+	payload, _ := ioutil.ReadAll(io.LimitReader(
+		newRandReader(rand.NewSource(42)), 2*1428+100))
+	data := make([]byte, 1428+4)
+	for block, off := uint16(1), 0; off <= len(payload); block, off = block+1, off+1428 {
+		end := off + 1428
+		if end > len(payload) {
+			end = len(payload)
+		}
+		binary.BigEndian.PutUint16(data[0:2], opDATA)
+		binary.BigEndian.PutUint16(data[2:4], block)
+		l := copy(data[4:], payload[off:end])
+		p.send(data[:4+l], addr)
+		p.expectACK(block)
+	}
+	s.Shutdown()
+	if !bytes.Equal(b.m["blksize-1428"], payload) {
+		t.Errorf("received data mismatch")
+	}
+}
+
+func TestClientBlockSize8192(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	c.SetBlockSize(8192)
+	testSendReceive(t, c, 1<<20)
+}
+
+func TestClientRejectsLargerBlockSize(t *testing.T) {
+	p := newRawPeer(t)
+	defer p.close()
+	c, err := NewClient(localSystem(p.conn))
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	c.SetTimeout(time.Second)
+	c.SetBlockSize(8192)
+
+	// Fake server offers a bigger block size than client requested.
+	oack := make([]byte, datagramLength)
+	n := packOACK(oack, []Option{{Name: "blksize", Value: "16384"}})
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Send("upload", "octet")
+		errc <- err
+	}()
+	_, addr := p.receive()
+	p.send(oack[:n], addr)
+	p.expectError(codeBadOption)
+	if err := <-errc; err == nil {
+		t.Errorf("send: error expected")
+	}
+
+	go func() {
+		_, err := c.Receive("download", "octet")
+		errc <- err
+	}()
+	_, addr = p.receive()
+	p.send(oack[:n], addr)
+	p.expectError(codeBadOption)
+	if err := <-errc; err == nil {
+		t.Errorf("receive: error expected")
+	}
+}
+
+func TestClientAcceptsSmallerBlockSize(t *testing.T) {
+	p := newRawPeer(t)
+	defer p.close()
+	c, err := NewClient(localSystem(p.conn))
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	c.SetTimeout(time.Second)
+	c.SetBlockSize(maxBlockLength)
+
+	// Fake server accepts the option with a smaller block size.
+	const blksize = 1000
+	oack := make([]byte, datagramLength)
+	n := packOACK(oack, []Option{{Name: "blksize", Value: strconv.Itoa(blksize)}})
+
+	payload := make([]byte, blksize+10)
+	rand.Read(payload)
+	buf := &bytes.Buffer{}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.GetFile("download", "octet", buf)
+		errc <- err
+	}()
+	_, addr := p.receive()
+	p.send(oack[:n], addr)
+	p.expectACK(0)
+	p.send(NewDATA(1, payload[:blksize]).Pack(), addr)
+	p.expectACK(1)
+	p.send(NewDATA(2, payload[blksize:]).Pack(), addr)
+	p.expectACK(2)
+	if err := <-errc; err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), payload) {
+		t.Errorf("received %d bytes, data mismatch", buf.Len())
+	}
+
+	go func() {
+		_, err := c.PutFile("upload", "octet", bytes.NewReader(payload))
+		errc <- err
+	}()
+	_, addr = p.receive()
+	p.send(oack[:n], addr)
+	for block, l := range []int{blksize, 10} {
+		data, _ := p.expectDATA(uint16(block + 1))
+		if len(data) != 4+l {
+			t.Fatalf("block %d: DATA of %d bytes expected, got %d", block+1, 4+l, len(data))
+		}
+		p.send(NewACK(uint16(block+1)).Pack(), addr)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	// Blocks larger than the accepted size are rejected.
+	go func() {
+		_, err := c.GetFile("download", "octet", ioutil.Discard)
+		errc <- err
+	}()
+	_, addr = p.receive()
+	p.send(oack[:n], addr)
+	p.expectACK(0)
+	p.send(NewDATA(1, make([]byte, blksize+1)).Pack(), addr)
+	p.expectError(codeIllegalOperation)
+	if err := <-errc; err == nil {
+		t.Errorf("receive: error expected")
+	}
+}
+
+func TestServerTimeoutOption(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	s.SetBackoff(func(int) time.Duration { return 0 })
+	s.SetRetries(1)
+	testSendReceive(t, c, 100)
+
+	p := newRawPeer(t)
+	defer p.close()
+	req := make([]byte, datagramLength)
+	n := packRQ(req, opRRQ, "length-100-bytes", "octet", options{"timeout": "1"})
+	p.send(req[:n], c.addr)
+
+	// Do not acknowledge OACK and measure retransmission interval.
+	oack, _ := p.expectOACK()
+	start := time.Now()
+	opts := oack.options()
+	if opts["timeout"] != "1" {
+		t.Fatalf("timeout 1 expected in OACK: %v", opts)
+	}
+	p.receive()
+	if d := time.Since(start); d < 900*time.Millisecond || d > 3*time.Second {
+		t.Errorf("OACK retransmitted after %v, expected about 1s", d)
+	}
+}
+
+func TestClientTimeoutOption(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	c.SetTimeout(1500 * time.Millisecond)
+	c.RequestTimeout(true)
+	testSendReceive(t, c, 3000)
+
+	wt, err := c.Receive("length-3000-bytes", "octet")
+	if err != nil {
+		t.Fatalf("requesting read: %v", err)
+	}
+	if r := wt.(*receiver); r.timeout != 2*time.Second {
+		t.Errorf("negotiated timeout 2s expected, got %v", r.timeout)
+	}
+	wt.WriteTo(ioutil.Discard)
+}
+
+func TestServerLogger(t *testing.T) {
+	s, c := makeTestServer(false)
+	buf := &bytes.Buffer{}
+	s.SetLogger(log.New(buf, "tftp: ", 0))
+	testSendReceive(t, c, 1000)
+	s.Shutdown()
+	out := buf.String()
+	for _, want := range []string{"WRQ from", "RRQ from", "length-1000-bytes"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log output does not contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestClientSetters(t *testing.T) {
+	c, err := NewClient("127.0.0.1:69")
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	c.SetRetries(7)
+	if n := c.Retries(); n != 7 {
+		t.Errorf("retries: %d, expected 7", n)
+	}
+	c.SetTimeout(2 * time.Second)
+	if d := c.Timeout(); d != 2*time.Second {
+		t.Errorf("timeout: %v, expected 2s", d)
+	}
+	c.SetTimeout(0)
+	if d := c.Timeout(); d != defaultTimeout {
+		t.Errorf("timeout: %v, expected default %v", d, defaultTimeout)
+	}
+}
+
+func TestSetRetries(t *testing.T) {
+	c, err := NewClient("127.0.0.1:69")
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	for _, tc := range []struct{ count, want int }{
+		{3, 3},
+		{0, 0},
+		{-1, DefaultRetries},
+	} {
+		c.SetRetries(tc.count)
+		if c.retries != tc.want {
+			t.Errorf("SetRetries(%d): %d retries, want %d", tc.count, c.retries, tc.want)
+		}
+	}
+}
+
+func TestClientReceiveSuccess(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	testSendReceive(t, c, 100)
+	wt, err := c.Receive("length-100-bytes", "octet")
+	if err != nil {
+		t.Fatalf("requesting read: %v", err)
+	}
+	n, err := wt.WriteTo(ioutil.Discard)
+	if err != nil {
+		t.Errorf("receiving: %v", err)
+	}
+	if n != 100 {
+		t.Errorf("received %d bytes, expected 100", n)
+	}
+}
+
+func TestClientSendServerError(t *testing.T) {
+	p := newRawPeer(t)
+	defer p.close()
+	c, err := NewClient(localSystem(p.conn))
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Send("upload", "octet")
+		errc <- err
+	}()
+	_, addr := p.receive()
+	b := make([]byte, datagramLength)
+	n := packERROR(b, 3, "disk full")
+	p.send(b[:n], addr)
+	err = <-errc
+	if err == nil {
+		t.Fatalf("error expected")
+	}
+	if !strings.Contains(err.Error(), "code: 3") ||
+		!strings.Contains(err.Error(), "disk full") {
+		t.Errorf("error code and message expected: %q", err)
+	}
+}
+
+func TestTftpError(t *testing.T) {
+	p := newRawPeer(t)
+	defer p.close()
+	c, err := NewClient(localSystem(p.conn))
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	for i, code := range []uint16{1, 2} {
+		errc := make(chan error, 1)
+		go func() {
+			var err error
+			if i%2 == 0 {
+				_, err = c.Receive("download", "octet")
+			} else {
+				_, err = c.Send("upload", "octet")
+			}
+			errc <- err
+		}()
+		_, addr := p.receive()
+		b := make([]byte, datagramLength)
+		n := packERROR(b, code, "failed")
+		p.send(b[:n], addr)
+		err = <-errc
+		var tftpErr *TftpError
+		if !errors.As(err, &tftpErr) {
+			t.Fatalf("TftpError expected: %v", err)
+		}
+		if tftpErr.Code != code || tftpErr.Message != "failed" {
+			t.Errorf("code %d expected, got %v", code, tftpErr)
+		}
+	}
+}
+
+func TestClientReceiveContextCancel(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	s.readHandler = func(filename string, rf io.ReaderFrom) error {
+		r := &slowReader{
+			r:     io.LimitReader(newRandReader(rand.NewSource(42)), 80000),
+			n:     3,
+			delay: 2 * time.Second,
+		}
+		_, err := rf.ReadFrom(r)
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	wt, err := c.ReceiveContext(ctx, "test-cancel", "octet")
+	if err != nil {
+		t.Fatalf("requesting read: %v", err)
+	}
+	time.AfterFunc(200*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = wt.WriteTo(ioutil.Discard)
+	if err != context.Canceled {
+		t.Errorf("context.Canceled expected, got: %v", err)
+	}
+	if d := time.Since(start); d > 1500*time.Millisecond {
+		t.Errorf("cancelled transfer returned after %v", d)
+	}
+}
+
+func TestClientSendContextCancel(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	s.writeHandler = func(filename string, wt io.WriterTo) error {
+		w := &slowWriter{
+			n:     3,
+			delay: 2 * time.Second,
+		}
+		_, err := wt.WriteTo(w)
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	rf, err := c.SendContext(ctx, "test-cancel", "octet")
+	if err != nil {
+		t.Fatalf("requesting write: %v", err)
+	}
+	time.AfterFunc(200*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = rf.ReadFrom(io.LimitReader(newRandReader(rand.NewSource(42)), 80000))
+	if err != context.Canceled {
+		t.Errorf("context.Canceled expected, got: %v", err)
+	}
+	if d := time.Since(start); d > 1500*time.Millisecond {
+		t.Errorf("cancelled transfer returned after %v", d)
+	}
+}
+
+func TestShutdownStopsServe(t *testing.T) {
+	b := &testBackend{m: make(map[string][]byte)}
+	s := NewServer(b.handleRead, b.handleWrite)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatalf("listen UDP: %v", err)
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- s.Serve(conn) }()
+	c, err := NewClient(localSystem(conn))
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	testSendReceive(t, c, 1000)
+	s.Shutdown()
+	select {
+	case err := <-serveErr:
+		if err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("serve did not return after shutdown")
+	}
+}
+
+func TestHandlerRemoteAddr(t *testing.T) {
+	var mu sync.Mutex
+	var readAddr, writeAddr net.UDPAddr
+	s := NewServer(
+		func(_ string, rf io.ReaderFrom) error {
+			mu.Lock()
+			readAddr = rf.(OutgoingTransfer).RemoteAddr()
+			mu.Unlock()
+			_, err := rf.ReadFrom(bytes.NewReader([]byte("data")))
+			return err
+		},
+		func(_ string, wt io.WriterTo) error {
+			mu.Lock()
+			writeAddr = wt.(IncomingTransfer).RemoteAddr()
+			mu.Unlock()
+			_, err := wt.WriteTo(ioutil.Discard)
+			return err
+		},
+	)
+	_, serverAddr := startTestServer(t, s)
+
+	p := newRawPeer(t)
+	defer p.close()
+	clientPort := p.conn.LocalAddr().(*net.UDPAddr).Port
+	b := make([]byte, datagramLength)
+
+	n := packRQ(b, opWRQ, "upload", "octet", nil)
+	p.send(b[:n], serverAddr)
+	_, addr := p.receive() // ACK 0
+	binary.BigEndian.PutUint16(b[0:2], opDATA)
+	binary.BigEndian.PutUint16(b[2:4], 1)
+	p.send(b[:4], addr)
+	p.receive() // ACK 1
+
+	n = packRQ(b, opRRQ, "download", "octet", nil)
+	p.send(b[:n], serverAddr)
+	_, addr = p.receive() // DATA 1
+	binary.BigEndian.PutUint16(b[0:2], opACK)
+	binary.BigEndian.PutUint16(b[2:4], 1)
+	p.send(b[:4], addr)
+
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	for _, a := range []net.UDPAddr{readAddr, writeAddr} {
+		if !a.IP.Equal(serverAddr.IP) || a.Port != clientPort {
+			t.Errorf("handler remote address %v, expected %v port %d",
+				&a, serverAddr.IP, clientPort)
+		}
+	}
+}
+
+func TestUnknownTID(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	const length = 3000
+	testSendReceive(t, c, length)
+
+	wt, err := c.Receive(fmt.Sprintf("length-%d-bytes", length), "octet")
+	if err != nil {
+		t.Fatalf("requesting read: %v", err)
+	}
+	// Spoof ACK for the first block from a different port.
+	p := newRawPeer(t)
+	defer p.close()
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint16(b[0:2], opACK)
+	binary.BigEndian.PutUint16(b[2:4], 1)
+	p.send(b, wt.(*receiver).addr)
+	p.expectError(codeUnknownTID)
+
+	buf := &bytes.Buffer{}
+	n, err := wt.WriteTo(buf)
+	if err != nil {
+		t.Fatalf("receiving: %v", err)
+	}
+	bs, _ := ioutil.ReadAll(io.LimitReader(
+		newRandReader(rand.NewSource(42)), length))
+	if n != length || !bytes.Equal(bs, buf.Bytes()) {
+		t.Errorf("received data mismatch")
+	}
+}
+
+func TestNetasciiBlockBoundary(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	// Each payload places a CR LF or CR NUL pair so that it is split
+	// between two DATA packets on the wire.
+	for i, text := range []string{
+		strings.Repeat("a", 511) + "\n" + strings.Repeat("b", 600),
+		strings.Repeat("a", 511) + "\r" + strings.Repeat("b", 600),
+		strings.Repeat("a", 1023) + "\n\r\n\r" + strings.Repeat("b", 10),
+		strings.Repeat("\n", 512) + strings.Repeat("\r", 513),
+		strings.Repeat("a", 510) + "\n",
+	} {
+		filename := fmt.Sprintf("netascii-%d", i)
+		wt, err := c.Send(filename, "netascii")
+		if err != nil {
+			t.Fatalf("requesting write %s: %v", filename, err)
+		}
+		_, err = wt.ReadFrom(strings.NewReader(text))
+		if err != nil {
+			t.Fatalf("%s write error: %v", filename, err)
+		}
+		rt, err := c.Receive(filename, "netascii")
+		if err != nil {
+			t.Fatalf("requesting read %s: %v", filename, err)
+		}
+		buf := &bytes.Buffer{}
+		_, err = rt.WriteTo(buf)
+		if err != nil {
+			t.Fatalf("%s read error: %v", filename, err)
+		}
+		if buf.String() != text {
+			t.Errorf("%s: round trip mismatch\nsent: %q\nrcvd: %q", filename, text, buf.String())
+		}
+	}
+}
+
+func TestUnsupportedMode(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	p := newRawPeer(t)
+	defer p.close()
+	req := make([]byte, datagramLength)
+	for _, op := range []uint16{opRRQ, opWRQ} {
+		n := packRQ(req, op, "test", "binary", nil)
+		p.send(req[:n], c.addr)
+		p.expectError(codeIllegalOperation)
+	}
+
+	// Mode names are case-insensitive.
+	wt, err := c.Send("upper-case-mode", "OCTET")
+	if err != nil {
+		t.Fatalf("requesting write: %v", err)
+	}
+	_, err = wt.ReadFrom(strings.NewReader("test"))
+	if err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+}
+
+func TestMailModeRejected(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	p := newRawPeer(t)
+	defer p.close()
+	req := make([]byte, datagramLength)
+	n := packRQ(req, opWRQ, "root", "mail", nil)
+	p.send(req[:n], c.addr)
+	if e := p.expectError(codeIllegalOperation); !strings.Contains(e.message(), "mail") {
+		t.Errorf("mail mode rejection expected, got %s", e.message())
+	}
+}
+
+func TestDuplicateACK(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	const length = 1300
+	testSendReceive(t, c, length)
+
+	p := newRawPeer(t)
+	defer p.close()
+	req := make([]byte, datagramLength)
+	n := packRQ(req, opRRQ, fmt.Sprintf("length-%d-bytes", length), "octet", nil)
+	p.send(req[:n], c.addr)
+	ack := func(block uint16, addr *net.UDPAddr) {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint16(b[0:2], opACK)
+		binary.BigEndian.PutUint16(b[2:4], block)
+		p.send(b, addr)
+	}
+
+	_, addr := p.expectDATA(1)
+	ack(1, addr)
+	p.expectDATA(2)
+	// Duplicate ACK for block 1 must not trigger retransmission of block 2.
+	ack(1, addr)
+	p.conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if n, _, err := p.conn.ReadFromUDP(p.buf); err == nil {
+		t.Fatalf("unexpected packet after duplicate ACK: %v", p.buf[:n])
+	}
+	ack(2, addr)
+	p.expectDATA(3)
+	ack(3, addr)
+}
+
+func TestFutureACK(t *testing.T) {
+	for _, window := range []int{1, 2} {
+		t.Run(fmt.Sprintf("window-%d", window), func(t *testing.T) {
+			errs := make(chan error, 1)
+			s := NewServer(func(filename string, rf io.ReaderFrom) error {
+				_, err := rf.ReadFrom(bytes.NewReader(make([]byte, 5000)))
+				select {
+				case errs <- err:
+				default:
+				}
+				return err
+			}, nil)
+			_, serverAddr := startTestServer(t, s)
+
+			p := newRawPeer(t)
+			defer p.close()
+			var opts options
+			if window > 1 {
+				opts = options{"windowsize": strconv.Itoa(window)}
+			}
+			req := make([]byte, datagramLength)
+			n := packRQ(req, opRRQ, "file", "octet", opts)
+			p.send(req[:n], serverAddr)
+			var addr *net.UDPAddr
+			if window > 1 {
+				_, addr = p.expectOACK()
+				p.send(NewACK(0).Pack(), addr)
+			}
+			for i := 1; i <= window; i++ {
+				_, addr = p.expectDATA(uint16(i))
+			}
+			p.send(NewACK(uint16(window+5)).Pack(), addr)
+			p.expectError(codeIllegalOperation)
+			select {
+			case err := <-errs:
+				if err != errFutureACK {
+					t.Errorf("errFutureACK expected, got %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("read handler did not return")
+			}
+		})
+	}
+}
+
+type statsHook struct {
+	mu    sync.Mutex
+	stats []TransferStats
+}
+
+func (h *statsHook) OnSuccess(stats TransferStats) {
+	h.mu.Lock()
+	h.stats = append(h.stats, stats)
+	h.mu.Unlock()
+}
+
+func (h *statsHook) OnFailure(stats TransferStats, err error) {}
+
+func TestWindowSize(t *testing.T) {
+	const length = 100*512 + 100
+	for _, window := range []int{0, 8} {
+		s, c := makeTestServer(false)
+		h := &statsHook{}
+		s.SetHook(h)
+		c.SetWindowSize(window)
+		testSendReceive(t, c, length)
+		s.Shutdown()
+		if len(h.stats) != 2 {
+			t.Fatalf("window %d: 2 transfers expected, got %d", window, len(h.stats))
+		}
+		for _, st := range h.stats {
+			// The server sends DATA and receives ACKs for read requests
+			// and the other way around for write requests, ACKs are
+			// always the smaller number.
+			acks := st.DatagramsSent
+			if st.DatagramsAcked < acks {
+				acks = st.DatagramsAcked
+			}
+			if window == 0 {
+				if acks < 101 {
+					t.Errorf("ACK for each block expected, got %d ACKs", acks)
+				}
+				continue
+			}
+			if opt := st.Opts["windowsize"]; opt != "8" {
+				t.Errorf("windowsize 8 expected, got %q", opt)
+			}
+			if acks > 15 {
+				t.Errorf("ACK for every %d blocks expected, got %d ACKs", window, acks)
+			}
+		}
+	}
+}
+
+func TestWindowSizeRewind(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	const length = 10 * 512
+	testSendReceive(t, c, length)
+
+	p := newRawPeer(t)
+	defer p.close()
+	req := make([]byte, datagramLength)
+	n := packRQ(req, opRRQ, fmt.Sprintf("length-%d-bytes", length), "octet",
+		options{"windowsize": "4"})
+	p.send(req[:n], c.addr)
+	_, addr := p.expectOACK()
+	ack := func(block uint16) {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint16(b[0:2], opACK)
+		binary.BigEndian.PutUint16(b[2:4], block)
+		p.send(b, addr)
+	}
+	ack(0)
+	p.expectWindow(1, 2, 3, 4)
+	// Pretend block 3 was lost: the next window starts from block 3.
+	ack(2)
+	p.expectWindow(3, 4, 5, 6)
+	ack(6)
+	p.expectWindow(7, 8, 9, 10)
+	ack(10)
+	p.expectWindow(11)
+	ack(11)
+}
+
+func TestWindowSizeGap(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	const length = 10 * 512
+	testSendReceive(t, c, length)
+
+	p := newRawPeer(t)
+	defer p.close()
+	req := make([]byte, datagramLength)
+	n := packRQ(req, opRRQ, fmt.Sprintf("length-%d-bytes", length), "octet",
+		options{"windowsize": "4"})
+	p.send(req[:n], c.addr)
+	_, addr := p.expectOACK()
+	p.send(NewACK(0).Pack(), addr)
+	p.expectWindow(1, 2, 3, 4)
+	p.send(NewACK(4).Pack(), addr)
+	p.expectWindow(5, 6, 7, 8)
+	// Pretend block 5 was lost: the window is sent again without waiting
+	// for the timeout.
+	start := time.Now()
+	p.send(NewACK(4).Pack(), addr)
+	p.expectWindow(5, 6, 7, 8)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("window resent after %v", d)
+	}
+	p.send(NewACK(8).Pack(), addr)
+	p.expectWindow(9, 10, 11)
+	p.send(NewACK(11).Pack(), addr)
+}
+
+func TestClientRejectsLargerWindowSize(t *testing.T) {
+	p := newRawPeer(t)
+	defer p.close()
+	c, err := NewClient(localSystem(p.conn))
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	c.SetTimeout(time.Second)
+	c.SetWindowSize(4)
+
+	// Fake server offers a bigger window than client requested.
+	oack := make([]byte, datagramLength)
+	n := packOACK(oack, []Option{{Name: "windowsize", Value: "64"}})
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.PutFile("upload", "octet", bytes.NewReader(make([]byte, 100)))
+		errc <- err
+	}()
+	_, addr := p.receive()
+	p.send(oack[:n], addr)
+	p.expectError(codeBadOption)
+	if err := <-errc; err == nil {
+		t.Errorf("send: error expected")
+	}
+
+	go func() {
+		_, err := c.Receive("download", "octet")
+		errc <- err
+	}()
+	_, addr = p.receive()
+	p.send(oack[:n], addr)
+	p.expectError(codeBadOption)
+	if err := <-errc; err == nil {
+		t.Errorf("receive: error expected")
+	}
+}
+
+func TestOnProgress(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	const length = 10*512 + 100
+	var mu sync.Mutex
+	var calls int
+	var last, lastTotal int64
+	c.SetOnProgress(func(bytes, total int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		if bytes < last {
+			t.Errorf("progress went backwards: %d < %d", bytes, last)
+		}
+		calls++
+		last, lastTotal = bytes, total
+	})
+	wt, err := c.Send(fmt.Sprintf("length-%d-bytes", length), "octet")
+	if err != nil {
+		t.Fatalf("requesting write: %v", err)
+	}
+	_, err = wt.ReadFrom(io.LimitReader(newRandReader(rand.NewSource(42)), length))
+	if err != nil {
+		t.Fatalf("sending: %v", err)
+	}
+	mu.Lock()
+	if calls == 0 || last != length || lastTotal != -1 {
+		t.Errorf("final progress %d/%d after %d calls, %d/-1 expected",
+			last, lastTotal, calls, length)
+	}
+	calls, last = 0, 0
+	mu.Unlock()
+
+	c.RequestTSize(true)
+	rt, err := c.Receive(fmt.Sprintf("length-%d-bytes", length), "octet")
+	if err != nil {
+		t.Fatalf("requesting read: %v", err)
+	}
+	_, err = rt.WriteTo(ioutil.Discard)
+	if err != nil {
+		t.Fatalf("receiving: %v", err)
+	}
+	mu.Lock()
+	if calls == 0 || last != length || lastTotal != length {
+		t.Errorf("final progress %d/%d after %d calls, %d/%d expected",
+			last, lastTotal, calls, length, length)
+	}
+	mu.Unlock()
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	started := make(chan struct{}, 1)
+	proceed := make(chan struct{})
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		started <- struct{}{}
+		<-proceed
+		_, err := rf.ReadFrom(strings.NewReader(filename))
+		return err
+	}, nil)
+	s.SetMaxConcurrent(1)
+	c, _ := startTestServer(t, s)
+
+	done := make(chan error)
+	go func() {
+		wt, err := c.Receive("slow", "octet")
+		if err == nil {
+			_, err = wt.WriteTo(ioutil.Discard)
+		}
+		done <- err
+	}()
+	<-started
+	_, err := c.Receive("rejected", "octet")
+	var e *TftpError
+	if !errors.As(err, &e) || e.Code != codeNotDefined {
+		t.Errorf("ERROR(0) expected while another transfer is active, got %v", err)
+	}
+	close(proceed)
+	if err := <-done; err != nil {
+		t.Fatalf("slow transfer: %v", err)
+	}
+
+	// The slot is released after the transfer is finished.
+	for i := 0; i < 50; i++ {
+		if atomic.LoadInt32(&s.active) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	wt, err := c.Receive("accepted", "octet")
+	if err != nil {
+		t.Fatalf("request after transfer is finished: %v", err)
+	}
+	<-started
+	_, err = wt.WriteTo(ioutil.Discard)
+	if err != nil {
+		t.Errorf("receiving: %v", err)
+	}
+}
+
+func TestIPv6(t *testing.T) {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	conn.Close()
+	for _, tc := range []struct {
+		listen  string
+		clients []string
+	}{
+		{"[::1]:0", []string{"::1"}},
+		// dual-stack socket serves both native and v4-mapped clients
+		{"[::]:0", []string{"::1", "127.0.0.1"}},
+	} {
+		b := &testBackend{m: make(map[string][]byte)}
+		s := NewServer(b.handleRead, b.handleWrite)
+		addr, _ := net.ResolveUDPAddr("udp", tc.listen)
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			t.Fatalf("listen %s: %v", tc.listen, err)
+		}
+		go s.Serve(conn)
+		_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+		for i, host := range tc.clients {
+			c, err := NewClient(net.JoinHostPort(host, port))
+			if err != nil {
+				t.Fatalf("creating client: %v", err)
+			}
+			testSendReceive(t, c, int64(1000+i))
+		}
+		s.Shutdown()
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	const (
+		length = 10000
+		rate   = 20000
+	)
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	s.SetRateLimit(rate)
+	c.SetRateLimit(rate)
+	start := time.Now()
+	testSendReceive(t, c, length)
+	// Both upload and download are limited.
+	min := 2 * time.Duration(length) * time.Second / rate
+	if d := time.Since(start); d < min {
+		t.Errorf("transfers took %v, at least %v expected", d, min)
+	}
+}
+
+func TestTransferStatsRetransmit(t *testing.T) {
+	p := newRawPeer(t)
+	defer p.close()
+	c, err := NewClient(localSystem(p.conn))
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	c.SetTimeout(100 * time.Millisecond)
+	c.SetBackoff(func(int) time.Duration { return 0 })
+	h := &statsHook{}
+	c.SetHook(h)
+
+	done := make(chan error)
+	go func() {
+		rf, err := c.Send("stats", "octet")
+		if err == nil {
+			_, err = rf.ReadFrom(strings.NewReader("hello"))
+		}
+		done <- err
+	}()
+	// Ignore the first WRQ to make the client retransmit it.
+	p.receive()
+	_, addr := p.receive()
+	ack := []byte{0, byte(opACK), 0, 0}
+	p.send(ack, addr)
+	data, _ := p.receive()
+	if string(data[4:]) != "hello" {
+		t.Fatalf("unexpected DATA: %q", data)
+	}
+	ack[3] = 1
+	p.send(ack, addr)
+	if err := <-done; err != nil {
+		t.Fatalf("sending: %v", err)
+	}
+
+	if len(h.stats) != 1 {
+		t.Fatalf("1 transfer expected, got %d", len(h.stats))
+	}
+	st := h.stats[0]
+	if st.Retransmits != 1 || st.Blocks != 1 || st.Bytes != 5 {
+		t.Errorf("unexpected stats: %d retransmits, %d blocks, %d bytes",
+			st.Retransmits, st.Blocks, st.Bytes)
+	}
+	if st.Duration <= 0 || st.Duration > time.Minute {
+		t.Errorf("unexpected duration: %v", st.Duration)
+	}
+}
+
+func TestExponentialTimeout(t *testing.T) {
+	b := &backoff{exponential: true, handler: func(int) time.Duration { return 0 }}
+	for _, expected := range []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		16 * time.Second, 32 * time.Second, time.Minute, time.Minute,
+	} {
+		if d := b.timeout(time.Second); d != expected {
+			t.Errorf("attempt %d: timeout %v expected, got %v", b.count(), expected, d)
+		}
+		b.backoff()
+	}
+
+	p := newRawPeer(t)
+	defer p.close()
+	c, err := NewClient(localSystem(p.conn))
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	c.SetTimeout(50 * time.Millisecond)
+	c.SetRetries(3)
+	c.SetBackoff(func(int) time.Duration { return 0 })
+	c.SetExponentialTimeout(true)
+	done := make(chan error)
+	go func() {
+		_, err := c.Send("unanswered", "octet")
+		done <- err
+	}()
+	var times []time.Time
+	for i := 0; i < 4; i++ {
+		p.receive()
+		times = append(times, time.Now())
+	}
+	if err := <-done; err == nil {
+		t.Errorf("error expected")
+	}
+	for i := 1; i < len(times); i++ {
+		min := 50 * time.Millisecond << uint(i-1)
+		if d := times[i].Sub(times[i-1]); d < min {
+			t.Errorf("retransmission %d after %v, at least %v expected", i, d, min)
+		}
+	}
+}
+
+// fakeClock is a clock that only moves forward when Advance is called.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1000000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), c: ch})
+	return ch
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiters = append(waiters, w)
+		} else {
+			w.c <- c.now
+		}
+	}
+	c.waiters = waiters
+}
+
+func TestOversizedDATA(t *testing.T) {
+	p := newRawPeer(t)
+	defer p.close()
+	c, err := NewClient(localSystem(p.conn))
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := c.Receive("oversized", "octet")
+		done <- err
+	}()
+	_, addr := p.receive()
+	data := make([]byte, 4+blockLength+1)
+	binary.BigEndian.PutUint16(data[0:2], opDATA)
+	binary.BigEndian.PutUint16(data[2:4], 1)
+	p.send(data, addr)
+
+	p.expectError(codeIllegalOperation)
+	err = <-done
+	var e *TftpError
+	if !errors.As(err, &e) || e.Code != codeIllegalOperation {
+		t.Errorf("transfer error with code 4 expected, got %v", err)
+	}
+}
+
+func TestReaderFailure(t *testing.T) {
+	for _, anticipate := range []uint{0, 4} {
+		for _, length := range []int{100, 512, 1000} {
+			errSource := errors.New("source failed")
+			s := NewServer(func(filename string, rf io.ReaderFrom) error {
+				pr, pw := io.Pipe()
+				go func() {
+					pw.Write(make([]byte, length))
+					pw.CloseWithError(errSource)
+				}()
+				_, err := rf.ReadFrom(pr)
+				if err != errSource {
+					t.Errorf("ReadFrom: %v expected, got %v", errSource, err)
+				}
+				return err
+			}, nil)
+			s.SetAnticipate(anticipate)
+			c, _ := runTestServer(t, s)
+			wt, err := c.Receive("failing", "octet")
+			if err == nil {
+				_, err = wt.WriteTo(ioutil.Discard)
+			}
+			var e *TftpError
+			if !errors.As(err, &e) || e.Code != codeNotDefined || e.Message != "source failed" {
+				t.Errorf("%d bytes: ERROR(0) with reader error expected, got %v", length, err)
+			}
+			s.Shutdown()
+		}
+	}
+}
+
+func TestMaxWriteSize(t *testing.T) {
+	type result struct {
+		n   int
+		err error
+	}
+	results := make(chan result, 1)
+	s := NewServer(nil, func(filename string, wt io.WriterTo) error {
+		buf := &bytes.Buffer{}
+		_, err := wt.WriteTo(buf)
+		results <- result{buf.Len(), err}
+		return err
+	})
+	s.SetMaxWriteSize(1000)
+	c, _ := startTestServer(t, s)
+	for _, length := range []int{1000, 2000} {
+		rf, err := c.Send("upload", "octet")
+		if err != nil {
+			t.Fatalf("requesting write: %v", err)
+		}
+		_, err = rf.ReadFrom(bytes.NewReader(make([]byte, length)))
+		res := <-results
+		if length <= 1000 {
+			if err != nil || res.err != nil || res.n != length {
+				t.Errorf("%d bytes: upload failed: %v, %v, %d bytes written",
+					length, err, res.err, res.n)
+			}
+			continue
+		}
+		var e *TftpError
+		if !errors.As(err, &e) || e.Code != codeDiskFull {
+			t.Errorf("%d bytes: ERROR(3) expected, got %v", length, err)
+		}
+		if res.err == nil || res.n > 1000 {
+			t.Errorf("%d bytes: handler got %d bytes and %v", length, res.n, res.err)
+		}
+	}
+}
+
+func TestAuthorizer(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	type request struct {
+		op       Op
+		filename string
+	}
+	requests := make(chan request, 4)
+	s.SetAuthorizer(func(op Op, filename string, addr *net.UDPAddr) error {
+		requests <- request{op, filename}
+		if !addr.IP.IsLoopback() {
+			t.Errorf("unexpected client address: %v", addr)
+		}
+		if strings.HasPrefix(filename, "secret") {
+			return fmt.Errorf("%s is not allowed", filename)
+		}
+		return nil
+	})
+
+	testSendReceive(t, c, 1000)
+	for _, expected := range []request{
+		{OpWrite, "length-1000-bytes"},
+		{OpRead, "length-1000-bytes"},
+	} {
+		if r := <-requests; r != expected {
+			t.Errorf("%v expected, got %v", expected, r)
+		}
+	}
+
+	rf, err := c.Send("secret-upload", "octet")
+	if err == nil {
+		_, err = rf.ReadFrom(strings.NewReader("data"))
+	}
+	var e *TftpError
+	if !errors.As(err, &e) || e.Code != codeAccessViolation ||
+		e.Message != "secret-upload is not allowed" {
+		t.Errorf("access violation expected, got %v", err)
+	}
+	_, err = c.Receive("secret-download", "octet")
+	if !errors.As(err, &e) || e.Code != codeAccessViolation {
+		t.Errorf("access violation expected, got %v", err)
+	}
+	if r := <-requests; r.op != OpWrite {
+		t.Errorf("%v expected, got %v", OpWrite, r.op)
+	}
+	if r := <-requests; r.op != OpRead {
+		t.Errorf("%v expected, got %v", OpRead, r.op)
+	}
+}
+
+func TestEventHandler(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	events := make(chan Event, 64)
+	s.SetEventHandler(func(e Event) {
+		events <- e
+	})
+	const length = 3000
+	testSendReceive(t, c, length)
+	// Events of the upload and the download may interleave.
+	types := map[Op][]EventType{}
+	for completed := 0; completed < 2; {
+		select {
+		case e := <-events:
+			if e.Filename != "length-3000-bytes" || e.RemoteAddr == nil {
+				t.Errorf("%v: unexpected transfer details: %+v", e.Type, e)
+			}
+			switch e.Type {
+			case EventCompleted:
+				if e.Bytes != length {
+					t.Errorf("%v: %d bytes expected, got %d", e.Op, length, e.Bytes)
+				}
+				completed++
+			case EventFailed:
+				t.Fatalf("%v failed: %v", e.Op, e.Err)
+			}
+			types[e.Op] = append(types[e.Op], e.Type)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("transfers did not complete, got events %v", types)
+		}
+	}
+	for _, op := range []Op{OpWrite, OpRead} {
+		seq := types[op]
+		if len(seq) < 4 || seq[0] != EventRequest || seq[1] != EventStarted ||
+			seq[2] != EventBlock || seq[len(seq)-1] != EventCompleted {
+			t.Errorf("%v: unexpected event sequence %v", op, seq)
+		}
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	for _, singlePort := range []bool{false, true} {
+		s, c := makeTestServer(singlePort)
+		errs := make(chan error, 1)
+		s.SetErrorHandler(func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		})
+		serverAddr, err := net.ResolveUDPAddr("udp", c.addr.String())
+		if err != nil {
+			t.Fatalf("resolving server address: %v", err)
+		}
+		p := newRawPeer(t)
+		// ACK is not a valid request.
+		ack := make([]byte, 4)
+		binary.BigEndian.PutUint16(ack[0:2], opACK)
+		p.send(ack, serverAddr)
+		select {
+		case err := <-errs:
+			if !strings.Contains(err.Error(), "unexpected") {
+				t.Errorf("single port %v: unexpected error: %v", singlePort, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("single port %v: error handler was not called", singlePort)
+		}
+		p.close()
+		s.Shutdown()
+	}
+}
+
+// countingConn counts reads that ended because of the read deadline.
+type countingConn struct {
+	net.PacketConn
+	timeouts int32
+}
+
+func (c *countingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if isTimeout(err) {
+		atomic.AddInt32(&c.timeouts, 1)
+	}
+	return n, addr, err
+}
+
+func TestServeReadDeadline(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatalf("listen UDP: %v", err)
+	}
+	cc := &countingConn{PacketConn: conn}
+	s := NewServer(nil, nil)
+	s.packetReadTimeout = 10 * time.Millisecond
+	errs := make(chan error, 1)
+	s.SetErrorHandler(func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+	go s.Serve(cc)
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&cc.timeouts); n < 2 {
+		t.Errorf("serve loop woke up %d times without packets", n)
+	}
+	select {
+	case err := <-errs:
+		t.Errorf("read timeout reported as error: %v", err)
+	default:
+	}
+	s.Shutdown()
+}
+
+func TestTransmissionBind(t *testing.T) {
+	second := net.ParseIP("127.0.0.2")
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: second})
+	if err != nil {
+		t.Skipf("host has no second loopback address: %v", err)
+	}
+	probe.Close()
+	b := &testBackend{m: map[string][]byte{"file": []byte("data")}}
+	s := NewServer(b.handleRead, b.handleWrite)
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		t.Fatalf("listen UDP: %v", err)
+	}
+	go s.Serve(conn)
+	defer s.Shutdown()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	// Bind the peer to one address so that the server sees the same
+	// source address whichever address it talks to.
+	pc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen UDP: %v", err)
+	}
+	p := &rawPeer{t: t, conn: pc, buf: make([]byte, 65536)}
+	defer p.close()
+	req := make([]byte, datagramLength)
+	n := packRQ(req, opRRQ, "file", "octet", nil)
+	request := func(ip net.IP) net.IP {
+		p.send(req[:n], &net.UDPAddr{IP: ip, Port: port})
+		reply, addr := p.receive()
+		if _, err := parsePacket(reply); err != nil {
+			t.Fatalf("parsing reply: %v", err)
+		}
+		// The file fits into one block, acknowledge it to end the transfer.
+		ack := make([]byte, 4)
+		binary.BigEndian.PutUint16(ack[0:2], opACK)
+		binary.BigEndian.PutUint16(ack[2:4], 1)
+		p.send(ack, addr)
+		return addr.IP
+	}
+
+	if ip := request(second); s.conn4 != nil && !ip.Equal(second) {
+		t.Errorf("reply to request for %v came from %v", second, ip)
+	}
+	s.SetTransmissionBind(second)
+	if ip := request(net.IPv4(127, 0, 0, 1)); !ip.Equal(second) {
+		t.Errorf("reply expected from %v, got %v", second, ip)
+	}
+}
+
+func TestNegotiatedOptions(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	s.SetBlockSize(1024)
+	c.SetBlockSize(8192)
+
+	rf, err := c.Send("negotiated", "octet")
+	if err != nil {
+		t.Fatalf("requesting write: %v", err)
+	}
+	opts := rf.(NegotiatedOptions).Options()
+	if opts["blksize"] != "1024" {
+		t.Errorf("blksize 1024 expected in write options: %v", opts)
+	}
+	_, err = rf.ReadFrom(bytes.NewReader(make([]byte, 3000)))
+	if err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+
+	wt, err := c.Receive("negotiated", "octet")
+	if err != nil {
+		t.Fatalf("requesting read: %v", err)
+	}
+	opts = wt.(NegotiatedOptions).Options()
+	if opts["blksize"] != "1024" {
+		t.Errorf("blksize 1024 expected in read options: %v", opts)
+	}
+	n, err := wt.WriteTo(ioutil.Discard)
+	if err != nil || n != 3000 {
+		t.Fatalf("read %d bytes: %v", n, err)
+	}
+	if opts := wt.(NegotiatedOptions).Options(); opts["blksize"] != "1024" {
+		t.Errorf("blksize 1024 expected after transfer: %v", opts)
+	}
+}
+
+func TestPutGetFile(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	src := bytes.NewBuffer(make([]byte, 5000))
+	rand.Read(src.Bytes())
+	want := append([]byte(nil), src.Bytes()...)
+	n, err := c.PutFile("put-get", "octet", src)
+	if err != nil || n != int64(len(want)) {
+		t.Fatalf("put %d bytes: %v", n, err)
+	}
+	var dst bytes.Buffer
+	n, err = c.GetFile("put-get", "octet", &dst)
+	if err != nil || n != int64(len(want)) {
+		t.Fatalf("get %d bytes: %v", n, err)
+	}
+	if !bytes.Equal(dst.Bytes(), want) {
+		t.Errorf("received data mismatch")
+	}
+	_, err = c.GetFile("missing", "octet", &dst)
+	var e *TftpError
+	if !errors.As(err, &e) || e.Code != codeFileNotFound {
+		t.Errorf("file not found error expected, got %v", err)
+	}
+}
+
+func TestPutGetFileCount(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	s.SetWindowSize(4)
+	c.SetBlockSize(1024)
+	for _, window := range []int{1, 4} {
+		c.SetWindowSize(window)
+		for _, size := range []int{0, 1, 1023, 1024, 1025, 4096, 10000} {
+			name := fmt.Sprintf("count-%d-%d", window, size)
+			n, err := c.PutFile(name, "octet", bytes.NewReader(make([]byte, size)))
+			if err != nil || n != int64(size) {
+				t.Errorf("%s: put %d bytes: %v", name, n, err)
+				continue
+			}
+			n, err = c.GetFile(name, "octet", ioutil.Discard)
+			if err != nil || n != int64(size) {
+				t.Errorf("%s: get %d bytes: %v", name, n, err)
+			}
+		}
+	}
+}
+
+func TestHandle(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	serve := func(content string) ReadHandler {
+		return func(filename string, rf io.ReaderFrom) error {
+			_, err := rf.ReadFrom(strings.NewReader(content + ":" + filename))
+			return err
+		}
+	}
+	s.Handle("config/*.cfg", serve("config"))
+	s.Handle("images/", serve("images"))
+
+	for filename, expected := range map[string]string{
+		"config/pxe.cfg":      "config:config/pxe.cfg",
+		"images/boot/vmlinuz": "images:images/boot/vmlinuz",
+	} {
+		var b bytes.Buffer
+		if _, err := c.GetFile(filename, "octet", &b); err != nil {
+			t.Fatalf("%s: %v", filename, err)
+		}
+		if b.String() != expected {
+			t.Errorf("%s: %q expected, got %q", filename, expected, b.String())
+		}
+	}
+
+	// Requests that do not match any pattern go to the default handler.
+	testSendReceive(t, c, 100)
+	_, err := c.GetFile("config/sub/pxe.cfg", "octet", ioutil.Discard)
+	var e *TftpError
+	if !errors.As(err, &e) || e.Code != codeFileNotFound {
+		t.Errorf("file not found error expected, got %v", err)
+	}
+}
+
+func TestTotalTimeout(t *testing.T) {
+	errs := make(chan error, 1)
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		_, err := rf.ReadFrom(bytes.NewReader(make([]byte, 100*blockLength)))
+		errs <- err
+		return err
+	}, nil)
+	s.SetTotalTimeout(300 * time.Millisecond)
+	_, serverAddr := startTestServer(t, s)
+
+	// The peer acknowledges every block but slowly, so that no single
+	// packet times out yet the transfer would take five seconds.
+	p := newRawPeer(t)
+	defer p.close()
+	req := make([]byte, datagramLength)
+	n := packRQ(req, opRRQ, "slow", "octet", nil)
+	p.send(req[:n], serverAddr)
+	start := time.Now()
+	for {
+		reply, addr := p.receive()
+		pkt, err := parsePacket(reply)
+		if err != nil {
+			t.Fatalf("parsing reply: %v", err)
+		}
+		if _, ok := pkt.(pERROR); ok {
+			break
+		}
+		d, ok := pkt.(pDATA)
+		if !ok {
+			t.Fatalf("DATA expected, got %T", pkt)
+		}
+		time.Sleep(50 * time.Millisecond)
+		p.send(NewACK(d.block()).Pack(), addr)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("transfer aborted after %v", d)
+	}
+	if err := <-errs; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("deadline exceeded error expected, got %v", err)
+	}
+}
+
+func TestSubSecondTimeout(t *testing.T) {
+	p := newRawPeer(t)
+	defer p.close()
+	c, err := NewClient(localSystem(p.conn))
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	c.SetTimeout(250 * time.Millisecond)
+	c.SetRetries(3)
+	c.SetBackoff(func(int) time.Duration { return 0 })
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Send("unanswered", "octet")
+		done <- err
+	}()
+	// The request is sent once and retransmitted three times.
+	var last time.Time
+	for i := 0; i < 4; i++ {
+		p.receive()
+		now := time.Now()
+		if i > 0 {
+			if d := now.Sub(last); d < 200*time.Millisecond || d > 600*time.Millisecond {
+				t.Errorf("retransmission %d after %v, 250ms expected", i, d)
+			}
+		}
+		last = now
+	}
+	if err := <-done; err == nil {
+		t.Errorf("timeout error expected")
+	}
+	// The timeout option is in whole seconds on the wire.
+	if v := timeoutOption(250 * time.Millisecond); v != "1" {
+		t.Errorf("timeout option 1 expected, got %s", v)
+	}
+}
+
+func TestNewClientAddress(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"127.0.0.1:69": "127.0.0.1:69",
+		"[::1]:6969":   "[::1]:6969",
+	} {
+		c, err := NewClient(addr)
+		if err != nil {
+			t.Errorf("%s: %v", addr, err)
+			continue
+		}
+		if c.addr.String() != expected {
+			t.Errorf("%s: resolved to %v", addr, c.addr)
+		}
+	}
+	for _, addr := range []string{"127.0.0.1", "127.0.0.1:tftp-nonexistent", "host.invalid:69"} {
+		if _, err := NewClient(addr); err == nil {
+			t.Errorf("%s: error expected", addr)
+		}
+	}
+}
+
+// refusingConn is a connection whose reads fail like after an ICMP port
+// unreachable message. Linux does not report those on unconnected UDP
+// sockets, so the error is simulated.
+type refusingConn struct {
+	sends int
+}
+
+func (c *refusingConn) sendTo([]byte, *net.UDPAddr) error {
+	c.sends++
+	return nil
+}
+
+func (c *refusingConn) readFrom([]byte) (int, *net.UDPAddr, error) {
+	return 0, nil, &net.OpError{Op: "read", Net: "udp", Err: syscall.ECONNREFUSED}
+}
+
+func (c *refusingConn) setDeadline(time.Duration) error { return nil }
+func (c *refusingConn) close()                          {}
+
+func TestConnectionRefused(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 69}
+	c := &refusingConn{}
+	s := &sender{
+		ctx:     context.Background(),
+		conn:    c,
+		addr:    addr,
+		send:    make([]byte, datagramLength),
+		receive: make([]byte, datagramLength),
+		retry:   &backoff{},
+		timeout: time.Second,
+		retries: 5,
+		block:   1,
+	}
+	_, err := s.sendWithRetry(4)
+	if !errors.Is(err, syscall.ECONNREFUSED) || c.sends != 1 {
+		t.Errorf("sender: connection refused after 1 send expected, got %v after %d", err, c.sends)
+	}
+
+	c = &refusingConn{}
+	r := &receiver{
+		ctx:     context.Background(),
+		conn:    c,
+		addr:    addr,
+		send:    make([]byte, datagramLength),
+		receive: make([]byte, datagramLength, datagramLength+1),
+		retry:   &backoff{},
+		timeout: time.Second,
+		retries: 5,
+		block:   1,
+	}
+	_, _, err = r.receiveWithRetry(4)
+	if !errors.Is(err, syscall.ECONNREFUSED) || c.sends != 1 {
+		t.Errorf("receiver: connection refused after 1 send expected, got %v after %d", err, c.sends)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	b := &backoff{}
+	if d := b.timeout(time.Second); d != time.Second {
+		t.Errorf("timeout without jitter changed to %v", d)
+	}
+	c, err := NewClient("127.0.0.1:69")
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	c.SetJitter(0.2)
+	b = &backoff{jitter: c.jitter}
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		d := b.timeout(time.Second)
+		if d < 800*time.Millisecond || d > 1200*time.Millisecond {
+			t.Fatalf("timeout %v outside of ±20%% band", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 10 {
+		t.Errorf("timeouts do not vary: %v", seen)
+	}
+	for fraction, expected := range map[float64]float64{-1: 0, 0.5: 0.5, 2: 0.99} {
+		c.SetJitter(fraction)
+		if c.jitter != expected {
+			t.Errorf("jitter %v: %v expected, got %v", fraction, expected, c.jitter)
+		}
+	}
+}
+
+func TestHandlerErrorCodes(t *testing.T) {
+	errs := map[string]error{
+		"missing":   fmt.Errorf("opening file: %w", ErrFileNotFound),
+		"forbidden": ErrAccessViolation,
+		"full":      fmt.Errorf("writing: %w", ErrDiskFull),
+		"other":     errors.New("something went wrong"),
+	}
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		return errs[filename]
+	}, nil)
+	c, _ := startTestServer(t, s)
+	for filename, code := range map[string]uint16{
+		"missing":   codeFileNotFound,
+		"forbidden": codeAccessViolation,
+		"full":      codeDiskFull,
+		"other":     codeNotDefined,
+	} {
+		_, err := c.Receive(filename, "octet")
+		var e *TftpError
+		if !errors.As(err, &e) || e.Code != code {
+			t.Errorf("%s: error code %d expected, got %v", filename, code, err)
+		}
+		if filename == "missing" && !errors.Is(err, ErrFileNotFound) {
+			t.Errorf("%s: ErrFileNotFound expected, got %v", filename, err)
+		}
+		if filename == "other" && e != nil && e.Message != "something went wrong" {
+			t.Errorf("%s: unexpected message %q", filename, e.Message)
+		}
+	}
+}
+
+func TestOnRequest(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	var mu sync.Mutex
+	requests := map[Op][]string{}
+	s.SetOnRequest(func(op Op, filename string, addr *net.UDPAddr) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests[op] = append(requests[op], filename)
+	})
+	s.SetAuthorizer(func(op Op, filename string, addr *net.UDPAddr) error {
+		if filename == "denied" {
+			return errors.New("denied")
+		}
+		return nil
+	})
+
+	testSendReceive(t, c, 100)
+	if _, err := c.Receive("denied", "octet"); err == nil {
+		t.Errorf("denied request succeeded")
+	}
+	if _, err := c.Receive("bad-mode", "binary"); err == nil {
+		t.Errorf("request with invalid mode succeeded")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if n := len(requests[OpWrite]); n != 1 {
+		t.Errorf("1 write request expected, got %d", n)
+	}
+	if n := len(requests[OpRead]); n != 3 {
+		t.Errorf("3 read requests expected, got %v", requests[OpRead])
+	}
+}
+
+func TestMaxBlockSize(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	s.SetBlockSize(maxBlockLength)
+	c.SetBlockSize(maxBlockLength)
+	c.RequestTSize(true)
+	// Full blocks and a short last one.
+	testSendReceive(t, c, 3*maxBlockLength+100)
+	// Exact multiple of the block size ends with an empty block.
+	testSendReceive(t, c, 2*maxBlockLength)
+
+	wt, err := c.Receive(fmt.Sprintf("length-%d-bytes", 2*maxBlockLength), "octet")
+	if err != nil {
+		t.Fatalf("requesting read: %v", err)
+	}
+	if opts := wt.(NegotiatedOptions).Options(); opts["blksize"] != strconv.Itoa(maxBlockLength) {
+		t.Errorf("blksize %d expected, got %v", maxBlockLength, opts)
+	}
+	if n, err := wt.WriteTo(ioutil.Discard); err != nil || n != 2*maxBlockLength {
+		t.Errorf("read %d bytes: %v", n, err)
+	}
+}
+
+func TestHandlerTypes(t *testing.T) {
+	var rh ReadHandler = func(filename string, rf io.ReaderFrom) error {
+		_, err := rf.ReadFrom(strings.NewReader(filename))
+		return err
+	}
+	var wh WriteHandler = func(filename string, wt io.WriterTo) error {
+		_, err := wt.WriteTo(ioutil.Discard)
+		return err
+	}
+	s := NewServer(rh, wh)
+	c, _ := startTestServer(t, s)
+	if got, err := receiveString(c, "named"); err != nil || got != "named" {
+		t.Errorf("read handler: %q, %v", got, err)
+	}
+	if _, err := c.PutFile("named", "octet", strings.NewReader("data")); err != nil {
+		t.Errorf("write handler: %v", err)
+	}
+}
+
+// multicastInterface returns an interface and its IPv4 address suitable
+// for sending and receiving multicast packets.
+func multicastInterface() (*net.Interface, net.IP) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, nil
+	}
+	for i := range ifaces {
+		iface := &ifaces[i]
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil {
+				return iface, n.IP.To4()
+			}
+		}
+	}
+	return nil, nil
+}
+
+func TestMulticast(t *testing.T) {
+	iface, ip := multicastInterface()
+	if iface == nil {
+		t.Skip("no multicast capable interface")
+	}
+	group := &net.UDPAddr{IP: net.IPv4(239, 255, 69, 69), Port: 6969}
+	payload := make([]byte, 5*blockLength+10)
+	rand.Read(payload)
+	b := &testBackend{m: map[string][]byte{"image": payload}}
+	s := NewServer(b.handleRead, nil)
+	s.EnableMulticast(group)
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Fatalf("listen UDP: %v", err)
+	}
+	go s.Serve(conn)
+	defer s.Shutdown()
+
+	master := newRawPeer(t)
+	defer master.close()
+	req := make([]byte, datagramLength)
+	n := packRQ(req, opRRQ, "image", "octet", options{"multicast": ""})
+	master.send(req[:n], conn.LocalAddr().(*net.UDPAddr))
+	oack, tid := master.expectOACK()
+	mc := strings.Split(oack.options()["multicast"], ",")
+	if len(mc) != 3 || !net.ParseIP(mc[0]).Equal(group.IP) || mc[2] != "1" {
+		t.Fatalf("unexpected multicast option: %v", oack.options())
+	}
+	if mc[1] != strconv.Itoa(group.Port) {
+		t.Fatalf("unexpected multicast port: %v", mc[1])
+	}
+
+	// Both receivers join the group before the transfer starts.
+	var receivers []*net.UDPConn
+	for i := 0; i < 2; i++ {
+		c, err := net.ListenMulticastUDP("udp4", iface, group)
+		if err != nil {
+			t.Skipf("joining multicast group: %v", err)
+		}
+		defer c.Close()
+		receivers = append(receivers, c)
+	}
+	received := make(chan []byte, 1)
+	go func() {
+		// The second receiver only listens.
+		buf := make([]byte, datagramLength)
+		var data []byte
+		for {
+			receivers[1].SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _, err := receivers[1].ReadFromUDP(buf)
+			if err != nil {
+				break
+			}
+			data = append(data, buf[4:n]...)
+			if n < datagramLength {
+				break
+			}
+		}
+		received <- data
+	}()
+
+	master.send(NewACK(0).Pack(), tid)
+	buf := make([]byte, datagramLength)
+	var data []byte
+	for {
+		receivers[0].SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := receivers[0].ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("master receiving: %v", err)
+		}
+		pkt, err := parsePacket(buf[:n])
+		if err != nil {
+			t.Fatalf("parsing DATA: %v", err)
+		}
+		d, ok := pkt.(pDATA)
+		if !ok {
+			t.Fatalf("DATA expected, got %T", pkt)
+		}
+		data = append(data, buf[4:n]...)
+		master.send(NewACK(d.block()).Pack(), tid)
+		if n < datagramLength {
+			break
+		}
+	}
+	if !bytes.Equal(data, payload) {
+		t.Errorf("master received %d bytes, data mismatch", len(data))
+	}
+	if other := <-received; !bytes.Equal(other, payload) {
+		t.Errorf("second receiver got %d bytes, data mismatch", len(other))
+	}
+}
+
+func TestMulticastConcurrent(t *testing.T) {
+	iface, ip := multicastInterface()
+	if iface == nil {
+		t.Skip("no multicast capable interface")
+	}
+	group := &net.UDPAddr{IP: net.IPv4(239, 255, 69, 71), Port: 6971}
+	files := map[string][]byte{}
+	for _, name := range []string{"kernel", "initrd"} {
+		files[name] = make([]byte, 3*blockLength+10)
+		rand.Read(files[name])
+	}
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		_, err := rf.ReadFrom(bytes.NewReader(files[filename]))
+		return err
+	}, nil)
+	s.EnableMulticast(group)
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Fatalf("listen UDP: %v", err)
+	}
+	go s.Serve(conn)
+	defer s.Shutdown()
+
+	type transfer struct {
+		name     string
+		master   *rawPeer
+		tid      *net.UDPAddr
+		listener *net.UDPConn
+		data     []byte
+		done     bool
+	}
+	var transfers []*transfer
+	ports := map[int]bool{}
+	for _, name := range []string{"kernel", "initrd"} {
+		tr := &transfer{name: name, master: newRawPeer(t)}
+		defer tr.master.close()
+		req := make([]byte, datagramLength)
+		n := packRQ(req, opRRQ, name, "octet", options{"multicast": ""})
+		tr.master.send(req[:n], conn.LocalAddr().(*net.UDPAddr))
+		var oack *OACK
+		oack, tr.tid = tr.master.expectOACK()
+		mc := strings.Split(oack.options()["multicast"], ",")
+		port, _ := strconv.Atoi(mc[1])
+		if len(mc) != 3 || mc[2] != "1" || ports[port] {
+			t.Fatalf("%s: unexpected multicast option: %v", name, oack.options())
+		}
+		ports[port] = true
+		tr.listener, err = net.ListenMulticastUDP("udp4", iface, &net.UDPAddr{IP: group.IP, Port: port})
+		if err != nil {
+			t.Skipf("joining multicast group: %v", err)
+		}
+		defer tr.listener.Close()
+		transfers = append(transfers, tr)
+	}
+	if !ports[group.Port] || !ports[group.Port+1] {
+		t.Errorf("ports %v, want %d and %d", ports, group.Port, group.Port+1)
+	}
+
+	// Both transfers run at the same time, one block each in turn.
+	for _, tr := range transfers {
+		tr.master.send(NewACK(0).Pack(), tr.tid)
+	}
+	buf := make([]byte, datagramLength)
+	for !transfers[0].done || !transfers[1].done {
+		for _, tr := range transfers {
+			if tr.done {
+				continue
+			}
+			tr.listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _, err := tr.listener.ReadFromUDP(buf)
+			if err != nil {
+				t.Fatalf("%s: receiving: %v", tr.name, err)
+			}
+			d := pDATA(buf[:n])
+			if want := uint16(len(tr.data)/blockLength + 1); d.block() != want {
+				t.Fatalf("%s: DATA %d expected, got %d", tr.name, want, d.block())
+			}
+			tr.data = append(tr.data, buf[4:n]...)
+			tr.master.send(NewACK(d.block()).Pack(), tr.tid)
+			tr.done = n < datagramLength
+		}
+	}
+	for _, tr := range transfers {
+		if !bytes.Equal(tr.data, files[tr.name]) {
+			t.Errorf("%s: received %d bytes, data mismatch", tr.name, len(tr.data))
+		}
+	}
+}
+
+func TestMulticastJoinMode(t *testing.T) {
+	iface, ip := multicastInterface()
+	if iface == nil {
+		t.Skip("no multicast capable interface")
+	}
+	group := &net.UDPAddr{IP: net.IPv4(239, 255, 69, 72), Port: 6973}
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		_, err := rf.ReadFrom(strings.NewReader(strings.Repeat("line\n", 1000)))
+		return err
+	}, nil)
+	s.EnableMulticast(group)
+	s.SetTimeout(300 * time.Millisecond)
+	s.SetRetries(1)
+	s.SetBackoff(func(int) time.Duration { return 0 })
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Fatalf("listen UDP: %v", err)
+	}
+	go s.Serve(conn)
+	defer s.Shutdown()
+
+	// request returns the multicast option the server answers with. A
+	// master acknowledges the OACK.
+	request := func(mode string, opts options) string {
+		p := newRawPeer(t)
+		t.Cleanup(p.close)
+		req := make([]byte, datagramLength)
+		n := packRQ(req, opRRQ, "motd", mode, opts)
+		p.send(req[:n], conn.LocalAddr().(*net.UDPAddr))
+		oack, tid := p.expectOACK()
+		mc := oack.options()["multicast"]
+		if strings.HasSuffix(mc, ",1") {
+			p.send(NewACK(0).Pack(), tid)
+		}
+		return mc
+	}
+	mc := func(port int, master int) string {
+		return fmt.Sprintf("%s,%d,%d", group.IP, port, master)
+	}
+	if got := request("octet", options{"multicast": ""}); got != mc(group.Port, 1) {
+		t.Fatalf("octet master: %s", got)
+	}
+	// The transfer is ready for listeners once the master acknowledged
+	// the OACK.
+	time.Sleep(50 * time.Millisecond)
+	if got := request("netascii", options{"multicast": ""}); got != mc(group.Port+1, 1) {
+		t.Errorf("netascii request joined the octet transfer: %s", got)
+	}
+	if got := request("octet", options{"multicast": "", optEncoding: "gzip"}); got != mc(group.Port+2, 1) {
+		t.Errorf("gzip request joined the octet transfer: %s", got)
+	}
+	if got := request("octet", options{"multicast": ""}); got != mc(group.Port, 0) {
+		t.Errorf("octet request did not join: %s", got)
+	}
+}
+
+func TestMulticastMasterTakeover(t *testing.T) {
+	iface, ip := multicastInterface()
+	if iface == nil {
+		t.Skip("no multicast capable interface")
+	}
+	group := &net.UDPAddr{IP: net.IPv4(239, 255, 69, 70), Port: 6970}
+	payload := make([]byte, 5*blockLength+10)
+	rand.Read(payload)
+	results := make(chan error, 1)
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		_, err := rf.ReadFrom(bytes.NewReader(payload))
+		results <- err
+		return err
+	}, nil)
+	s.EnableMulticast(group)
+	s.SetTimeout(200 * time.Millisecond)
+	s.SetRetries(1)
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Fatalf("listen UDP: %v", err)
+	}
+	go s.Serve(conn)
+	defer s.Shutdown()
+	serverAddr := conn.LocalAddr().(*net.UDPAddr)
+
+	listener, err := net.ListenMulticastUDP("udp4", iface, group)
+	if err != nil {
+		t.Skipf("joining multicast group: %v", err)
+	}
+	defer listener.Close()
+	blocks := map[uint16][]byte{}
+	buf := make([]byte, datagramLength)
+	// readGroup reads DATA sent to the group until block b arrives.
+	readGroup := func(b uint16) {
+		for {
+			listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _, err := listener.ReadFromUDP(buf)
+			if err != nil {
+				t.Fatalf("waiting for DATA %d: %v", b, err)
+			}
+			pkt, err := parsePacket(buf[:n])
+			if err != nil {
+				t.Fatalf("parsing DATA: %v", err)
+			}
+			d, ok := pkt.(pDATA)
+			if !ok {
+				t.Fatalf("DATA expected, got %T", pkt)
+			}
+			blocks[d.block()] = append([]byte(nil), buf[4:n]...)
+			if d.block() == b {
+				return
+			}
+		}
+	}
+	expectOACK := func(p *rawPeer, master string) *net.UDPAddr {
+		oack, addr := p.expectOACK()
+		if mc := strings.Split(oack.options()["multicast"], ","); len(mc) != 3 || mc[2] != master {
+			t.Fatalf("multicast option with master=%s expected: %v", master, oack.options())
+		}
+		return addr
+	}
+
+	master := newRawPeer(t)
+	defer master.close()
+	req := make([]byte, datagramLength)
+	n := packRQ(req, opRRQ, "image", "octet", options{"multicast": ""})
+	master.send(req[:n], serverAddr)
+	tid := expectOACK(master, "1")
+	master.send(NewACK(0).Pack(), tid)
+	readGroup(1)
+	master.send(NewACK(1).Pack(), tid)
+
+	second := newRawPeer(t)
+	defer second.close()
+	second.send(req[:n], serverAddr)
+	if addr := expectOACK(second, "0"); addr.Port != tid.Port {
+		t.Fatalf("listener OACK from %v, transfer runs on %v", addr, tid)
+	}
+	// The master drops out, the listener is promoted once block 2 times
+	// out and acknowledges the rest of the file.
+	expectOACK(second, "1")
+	for b := uint16(2); b <= 6; b++ {
+		readGroup(b)
+		second.send(NewACK(b).Pack(), tid)
+	}
+	select {
+	case err := <-results:
+		if err != nil {
+			t.Errorf("transfer failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("transfer is not finished")
+	}
+	var data []byte
+	for b := uint16(1); b <= 6; b++ {
+		data = append(data, blocks[b]...)
+	}
+	if !bytes.Equal(data, payload) {
+		t.Errorf("listener received %d bytes, data mismatch", len(data))
+	}
+}
+
+func TestMulticastLateJoin(t *testing.T) {
+	iface, ip := multicastInterface()
+	if iface == nil {
+		t.Skip("no multicast capable interface")
+	}
+	group := &net.UDPAddr{IP: net.IPv4(239, 255, 69, 73), Port: 6974}
+	payload := make([]byte, 5*blockLength+10)
+	rand.Read(payload)
+	results := make(chan error, 1)
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		_, err := rf.ReadFrom(bytes.NewReader(payload))
+		results <- err
+		return err
+	}, nil)
+	s.EnableMulticast(group)
+	s.SetTimeout(200 * time.Millisecond)
+	s.SetRetries(1)
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Fatalf("listen UDP: %v", err)
+	}
+	go s.Serve(conn)
+	defer s.Shutdown()
+	serverAddr := conn.LocalAddr().(*net.UDPAddr)
+
+	expectOACK := func(p *rawPeer, master string) *net.UDPAddr {
+		oack, addr := p.expectOACK()
+		if mc := strings.Split(oack.options()["multicast"], ","); len(mc) != 3 || mc[2] != master {
+			t.Fatalf("multicast option with master=%s expected: %v", master, oack.options())
+		}
+		return addr
+	}
+	// readBlock reads DATA sent to the group from c until block b arrives.
+	buf := make([]byte, datagramLength)
+	readBlock := func(c *net.UDPConn, b uint16) []byte {
+		for {
+			c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _, err := c.ReadFromUDP(buf)
+			if err != nil {
+				t.Fatalf("waiting for DATA %d: %v", b, err)
+			}
+			pkt, err := parsePacket(buf[:n])
+			if err != nil {
+				t.Fatalf("parsing DATA: %v", err)
+			}
+			if d, ok := pkt.(pDATA); ok && d.block() == b {
+				return append([]byte(nil), buf[4:n]...)
+			}
+		}
+	}
+	listen := func() *net.UDPConn {
+		c, err := net.ListenMulticastUDP("udp4", iface, group)
+		if err != nil {
+			t.Skipf("joining multicast group: %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+
+	// The master receives two blocks and drops out.
+	master := newRawPeer(t)
+	defer master.close()
+	masterGroup := listen()
+	req := make([]byte, datagramLength)
+	n := packRQ(req, opRRQ, "image", "octet", options{"multicast": ""})
+	master.send(req[:n], serverAddr)
+	tid := expectOACK(master, "1")
+	master.send(NewACK(0).Pack(), tid)
+	for b := uint16(1); b <= 2; b++ {
+		readBlock(masterGroup, b)
+		master.send(NewACK(b).Pack(), tid)
+	}
+
+	// The listener joins the group only now. Once promoted it has no
+	// block in order and is sent the file from block 1.
+	late := newRawPeer(t)
+	defer late.close()
+	late.send(req[:n], serverAddr)
+	expectOACK(late, "0")
+	lateGroup := listen()
+	expectOACK(late, "1")
+	late.send(NewACK(0).Pack(), tid)
+	var data []byte
+	for b := uint16(1); ; b++ {
+		d := readBlock(lateGroup, b)
+		data = append(data, d...)
+		late.send(NewACK(b).Pack(), tid)
+		if len(d) < blockLength {
+			break
+		}
+	}
+	select {
+	case err := <-results:
+		if err != nil {
+			t.Errorf("transfer failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("transfer is not finished")
+	}
+	if !bytes.Equal(data, payload) {
+		t.Errorf("late listener received %d bytes, data mismatch", len(data))
+	}
+}
+
+func TestMulticastJoinUnseekable(t *testing.T) {
+	iface, ip := multicastInterface()
+	if iface == nil {
+		t.Skip("no multicast capable interface")
+	}
+	group := &net.UDPAddr{IP: net.IPv4(239, 255, 69, 74), Port: 6976}
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		// Not an io.Seeker, the blocks sent cannot be read again.
+		r := struct{ io.Reader }{strings.NewReader(strings.Repeat("x", 10000))}
+		_, err := rf.ReadFrom(r)
+		return err
+	}, nil)
+	s.EnableMulticast(group)
+	s.SetTimeout(300 * time.Millisecond)
+	s.SetRetries(1)
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Fatalf("listen UDP: %v", err)
+	}
+	go s.Serve(conn)
+	defer s.Shutdown()
+
+	req := make([]byte, datagramLength)
+	n := packRQ(req, opRRQ, "file", "octet", options{"multicast": ""})
+	for i := 0; i < 2; i++ {
+		p := newRawPeer(t)
+		defer p.close()
+		p.send(req[:n], conn.LocalAddr().(*net.UDPAddr))
+		oack, tid := p.expectOACK()
+		mc := strings.Split(oack.options()["multicast"], ",")
+		if len(mc) != 3 || mc[1] != strconv.Itoa(group.Port+i) || mc[2] != "1" {
+			t.Errorf("request %d: multicast option %v, want own transfer on port %d", i+1, mc, group.Port+i)
+		}
+		p.send(NewACK(0).Pack(), tid)
+		// Let the transfer start sending DATA.
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestAbortAsync(t *testing.T) {
+	p := newRawPeer(t)
+	defer p.close()
+	c, err := NewClient(fmt.Sprintf("127.0.0.1:%d", p.conn.LocalAddr().(*net.UDPAddr).Port))
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	buf := &bytes.Buffer{}
+	tr := c.GetAsync("test", "octet", buf)
+
+	_, addr := p.receive() // RRQ
+	data := make([]byte, 4+blockLength)
+	copy(data, NewDATA(1, nil).Pack())
+	p.send(data, addr)
+	p.expectACK(1)
+
+	tr.Abort()
+	if err := tr.Wait(); !errors.Is(err, context.Canceled) {
+		t.Errorf("Wait returned %v, want %v", err, context.Canceled)
+	}
+	p.expectError(codeNotDefined)
+	if buf.Len() != blockLength {
+		t.Errorf("received %d bytes, want %d", buf.Len(), blockLength)
+	}
+}
+
+func TestDuplicateWRQ(t *testing.T) {
+	var handlers int32
+	s := NewServer(nil, func(filename string, wt io.WriterTo) error {
+		atomic.AddInt32(&handlers, 1)
+		_, err := wt.WriteTo(ioutil.Discard)
+		return err
+	})
+	s.SetTimeout(500 * time.Millisecond)
+	s.SetRetries(1)
+	_, serverAddr := runTestServer(t, s)
+
+	p := newRawPeer(t)
+	defer p.close()
+	req := make([]byte, datagramLength)
+	n := packRQ(req, opWRQ, "upload", "octet", nil)
+	p.send(req[:n], serverAddr)
+	p.send(req[:n], serverAddr)
+	tid := p.expectACK(0)
+	p.send(NewDATA(1, []byte("hello")).Pack(), tid)
+	p.expectACK(1)
+	s.Shutdown()
+	if n := atomic.LoadInt32(&handlers); n != 1 {
+		t.Errorf("write handler called %d times, want 1", n)
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	logs := &bytes.Buffer{}
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		if filename == "panic" {
+			panic("handler bug")
+		}
+		_, err := rf.ReadFrom(strings.NewReader("ok"))
+		return err
+	}, nil)
+	s.SetLogger(log.New(logs, "", 0))
+	s.SetPanicMessage("oops")
+	c, _ := runTestServer(t, s)
+
+	_, err := c.Receive("panic", "octet")
+	var e *TftpError
+	if !errors.As(err, &e) || e.Code != codeNotDefined || e.Message != "oops" {
+		t.Errorf("ERROR(0) with panic message expected, got %v", err)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := c.GetFile("other", "octet", buf); err != nil || buf.String() != "ok" {
+		t.Errorf("server does not serve after panic: %v, %q", err, buf)
+	}
+	s.Shutdown()
+	if !strings.Contains(logs.String(), "panic in read handler for panic") {
+		t.Errorf("panic is not logged:\n%s", logs)
+	}
+}
+
+func TestServerAddr(t *testing.T) {
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		_, err := rf.ReadFrom(strings.NewReader(filename))
+		return err
+	}, nil)
+	if addr := s.Addr(); addr != nil {
+		t.Errorf("nil address expected before serving, got %v", addr)
+	}
+	go s.ListenAndServe("127.0.0.1:0")
+	var addr *net.UDPAddr
+	for i := 0; i < 100 && addr == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		addr = s.Addr()
+	}
+	if addr == nil {
+		t.Fatalf("server address is not available")
+	}
+	defer s.Shutdown()
+	if addr.Port == 0 {
+		t.Fatalf("concrete port expected, got %v", addr)
+	}
+	c, err := NewClient(addr.String())
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := c.GetFile("hello", "octet", buf); err != nil || buf.String() != "hello" {
+		t.Errorf("receiving from %v: %v, %q", addr, err, buf)
+	}
+}
+
+func TestReplySourceAddress(t *testing.T) {
+	addrs := []net.IP{net.IPv4(127, 0, 0, 2), net.IPv4(127, 0, 0, 3)}
+	for _, ip := range addrs {
+		probe, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+		if err != nil {
+			t.Skipf("host has no loopback address %v: %v", ip, err)
+		}
+		probe.Close()
+	}
+	for _, singlePort := range []bool{false, true} {
+		localIPs := make(chan net.IP, 1)
+		s := NewServer(func(filename string, rf io.ReaderFrom) error {
+			localIPs <- rf.(RequestPacketInfo).LocalIP()
+			_, err := rf.ReadFrom(strings.NewReader("data"))
+			return err
+		}, nil)
+		if singlePort {
+			s.EnableSinglePort()
+		}
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+		if err != nil {
+			t.Fatalf("listen UDP: %v", err)
+		}
+		go s.Serve(conn)
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+
+		req := make([]byte, datagramLength)
+		n := packRQ(req, opRRQ, "file", "octet", nil)
+		for _, ip := range addrs {
+			// Bind the peer to one address so that the server sees the
+			// same source address whichever address it talks to.
+			pc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatalf("listen UDP: %v", err)
+			}
+			p := &rawPeer{t: t, conn: pc, buf: make([]byte, 65536)}
+			p.send(req[:n], &net.UDPAddr{IP: ip, Port: port})
+			_, addr := p.receive()
+			if s.conn4 == nil {
+				t.Skip("destination address of requests is not available")
+			}
+			if !addr.IP.Equal(ip) {
+				t.Errorf("single port %v: reply to request for %v came from %v",
+					singlePort, ip, addr.IP)
+			}
+			if local := <-localIPs; !local.Equal(ip) {
+				t.Errorf("single port %v: LocalIP %v, want %v", singlePort, local, ip)
+			}
+			p.send(NewACK(1).Pack(), addr)
+			p.close()
+		}
+		s.Shutdown()
+	}
+}
+
+func TestDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tftp")
+	if err != nil {
+		t.Fatalf("creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	payload := make([]byte, 3000)
+	rand.Read(payload)
+	errSource := errors.New("source failed")
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		if filename == "broken" {
+			pr, pw := io.Pipe()
+			go func() {
+				pw.Write(payload[:2*blockLength])
+				pw.CloseWithError(errSource)
+			}()
+			_, err := rf.ReadFrom(pr)
+			return err
+		}
+		_, err := rf.ReadFrom(bytes.NewReader(payload))
+		return err
+	}, nil)
+	c, _ := startTestServer(t, s)
+
+	path := filepath.Join(dir, "image")
+	n, err := c.Download("image", "octet", path)
+	if err != nil {
+		t.Fatalf("downloading: %v", err)
+	}
+	if n != int64(len(payload)) {
+		t.Errorf("downloaded %d bytes, want %d", n, len(payload))
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || !bytes.Equal(data, payload) {
+		t.Errorf("downloaded file mismatch: %v", err)
+	}
+
+	// A new file gets the permissions os.Create gives, a replaced one
+	// keeps its own.
+	ref := filepath.Join(dir, "ref")
+	f, err := os.Create(ref)
+	if err != nil {
+		t.Fatalf("creating file: %v", err)
+	}
+	f.Close()
+	want, _ := os.Stat(ref)
+	os.Remove(ref)
+	if fi, err := os.Stat(path); err != nil || fi.Mode() != want.Mode() {
+		t.Errorf("new file mode %v, want %v (%v)", fi.Mode(), want.Mode(), err)
+	}
+	if err := os.Chmod(path, 0640); err != nil {
+		t.Fatalf("changing mode: %v", err)
+	}
+	if _, err := c.Download("image", "octet", path); err != nil {
+		t.Fatalf("downloading again: %v", err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("replaced file mode %v, want 0640 (%v)", fi.Mode(), err)
+	}
+
+	path = filepath.Join(dir, "broken")
+	if _, err := c.Download("broken", "octet", path); err == nil {
+		t.Fatalf("error expected for failed transfer")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("partial file is not removed: %v", err)
+	}
+
+	// A failed download keeps the previous copy.
+	if err := ioutil.WriteFile(path, []byte("previous"), 0600); err != nil {
+		t.Fatalf("writing file: %v", err)
+	}
+	if _, err := c.Download("broken", "octet", path); err == nil {
+		t.Fatalf("error expected for failed transfer")
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "previous" {
+		t.Errorf("previous file is not kept: %q, %v", data, err)
+	}
+	if fis, err := ioutil.ReadDir(dir); err != nil || len(fis) != 2 {
+		t.Errorf("temporary file is not removed: %v", err)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tftp")
+	if err != nil {
+		t.Fatalf("creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	payload := make([]byte, 3000)
+	rand.Read(payload)
+	path := filepath.Join(dir, "image")
+	if err := ioutil.WriteFile(path, payload, 0644); err != nil {
+		t.Fatalf("writing local file: %v", err)
+	}
+	type upload struct {
+		size   int64
+		sizeOK bool
+		data   []byte
+	}
+	uploads := make(chan upload, 1)
+	s := NewServer(nil, func(filename string, wt io.WriterTo) error {
+		var u upload
+		u.size, u.sizeOK = wt.(IncomingTransfer).Size()
+		buf := &bytes.Buffer{}
+		_, err := wt.WriteTo(buf)
+		u.data = buf.Bytes()
+		uploads <- u
+		return err
+	})
+	c, _ := startTestServer(t, s)
+
+	n, err := c.Upload("image", "octet", path)
+	if err != nil {
+		t.Fatalf("uploading: %v", err)
+	}
+	if n != int64(len(payload)) {
+		t.Errorf("uploaded %d bytes, want %d", n, len(payload))
+	}
+	u := <-uploads
+	if !u.sizeOK || u.size != int64(len(payload)) {
+		t.Errorf("tsize %d (%v), want %d", u.size, u.sizeOK, len(payload))
+	}
+	if !bytes.Equal(u.data, payload) {
+		t.Errorf("uploaded data mismatch")
+	}
+
+	// Mode names are case-insensitive.
+	if _, err := c.Upload("image", "OCTET", path); err != nil {
+		t.Fatalf("uploading in OCTET mode: %v", err)
+	}
+	if u = <-uploads; !u.sizeOK || u.size != int64(len(payload)) {
+		t.Errorf("OCTET mode: tsize %d (%v), want %d", u.size, u.sizeOK, len(payload))
+	}
+
+	// Line endings are translated in netascii mode, the size of the file
+	// is not the size of the data sent.
+	text := filepath.Join(dir, "motd")
+	if err := ioutil.WriteFile(text, []byte("line 1\nline 2\n"), 0644); err != nil {
+		t.Fatalf("writing local file: %v", err)
+	}
+	if _, err := c.Upload("motd", "netascii", text); err != nil {
+		t.Fatalf("uploading in netascii mode: %v", err)
+	}
+	u = <-uploads
+	if u.sizeOK {
+		t.Errorf("tsize %d announced in netascii mode", u.size)
+	}
+	if string(u.data) != "line 1\nline 2\n" {
+		t.Errorf("uploaded text %q", u.data)
+	}
+
+	_, err = c.Upload("missing", "octet", filepath.Join(dir, "missing"))
+	if !os.IsNotExist(err) {
+		t.Errorf("not exist error expected, got %v", err)
+	}
+	select {
+	case <-uploads:
+		t.Errorf("request sent for missing local file")
+	default:
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	for _, singlePort := range []bool{false, true} {
+		s, c := makeTestServer(singlePort)
+		c.RequestChecksum(true)
+		for _, length := range []int64{0, 100, 512, 5000} {
+			testSendReceive(t, c, length)
+		}
+		s.Shutdown()
+	}
+
+	s, c := makeTestServer(false)
+	c.RequestChecksum(true)
+	c.SetWindowSize(4)
+	testSendReceive(t, c, 10000)
+	s.Shutdown()
+
+	s, c = makeTestServer(false)
+	s.SetAnticipate(4)
+	c.RequestChecksum(true)
+	testSendReceive(t, c, 3000)
+	rf, err := c.Send("negotiated", "octet")
+	if err != nil {
+		t.Fatalf("requesting write: %v", err)
+	}
+	if opts := rf.(NegotiatedOptions).Options(); opts[optChecksum] == "" {
+		t.Errorf("%s option is not negotiated: %v", optChecksum, opts)
+	}
+	rf.ReadFrom(strings.NewReader("data"))
+	s.Shutdown()
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	p := newRawPeer(t)
+	defer p.close()
+	c, err := NewClient(localSystem(p.conn))
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	c.RequestChecksum(true)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.GetFile("corrupted", "octet", ioutil.Discard)
+		errc <- err
+	}()
+	_, addr := p.receive()
+	oack := &OACK{Options: []Option{{Name: optChecksum, Value: "1"}}}
+	p.send(oack.Pack(), addr)
+	p.receive() // ACK 0
+	p.send(NewDATA(1, []byte("hellO")).Pack(), addr)
+	p.receive() // ACK 1
+	sum := fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte("hello")))
+	oack = &OACK{Options: []Option{{Name: optChecksum, Value: sum}}}
+	p.send(oack.Pack(), addr)
+	p.expectError(codeNotDefined)
+	if err := <-errc; !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("%v expected, got %v", ErrChecksumMismatch, err)
+	}
+
+	// A server that does not support the option ignores it.
+	buf := &bytes.Buffer{}
+	go func() {
+		_, err := c.GetFile("plain", "octet", buf)
+		errc <- err
+	}()
+	_, addr = p.receive()
+	p.send(NewDATA(1, []byte("hello")).Pack(), addr)
+	p.receive() // ACK 1
+	if err := <-errc; err != nil || buf.String() != "hello" {
+		t.Errorf("receiving without checksum: %v, %q", err, buf)
+	}
+}
+
+func TestServerChecksumMismatch(t *testing.T) {
+	errc := make(chan error, 1)
+	s := NewServer(nil, func(filename string, wt io.WriterTo) error {
+		_, err := wt.WriteTo(ioutil.Discard)
+		errc <- err
+		return err
+	})
+	_, serverAddr := startTestServer(t, s)
+
+	p := newRawPeer(t)
+	defer p.close()
+	req := make([]byte, datagramLength)
+	n := packRQ(req, opWRQ, "upload", "octet", options{optChecksum: "1"})
+	p.send(req[:n], serverAddr)
+	oack, tid := p.expectOACK()
+	if oack.options()[optChecksum] != "1" {
+		t.Fatalf("OACK with %s expected, got %v", optChecksum, oack.options())
+	}
+	p.send(NewDATA(1, []byte("hellO")).Pack(), tid)
+	p.expectACK(1)
+	sum := fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte("hello")))
+	oack = &OACK{Options: []Option{{Name: optChecksum, Value: sum}}}
+	p.send(oack.Pack(), tid)
+	p.expectError(codeNotDefined)
+	if err := <-errc; !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("%v expected, got %v", ErrChecksumMismatch, err)
+	}
+}
+
+func TestInitialRetries(t *testing.T) {
+	p := newRawPeer(t)
+	defer p.close()
+	c, err := NewClient(localSystem(p.conn))
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	c.SetTimeout(100 * time.Millisecond)
+	c.SetBackoff(func(int) time.Duration { return 0 })
+	c.SetRetries(1)
+	c.SetInitialRetries(4)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.GetFile("slow-start", "octet", ioutil.Discard)
+		errc <- err
+	}()
+	var addr *net.UDPAddr
+	for i := 0; i < 5; i++ {
+		_, addr = p.receive() // RRQ and its retransmissions
+	}
+	p.send(NewDATA(1, make([]byte, blockLength)).Pack(), addr)
+	acks, requests := 0, 0
+	p.conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		n, _, err := p.conn.ReadFromUDP(p.buf)
+		if err != nil {
+			break
+		}
+		switch pkt, _ := parsePacket(p.buf[:n]); pkt := pkt.(type) {
+		case pRRQ:
+			requests++
+		case pACK:
+			if pkt.block() == 1 {
+				acks++
+			}
+		}
+	}
+	if requests != 0 {
+		t.Errorf("RRQ sent %d more times than expected", requests)
+	}
+	if acks != 2 {
+		t.Errorf("ACK 1 sent %d times, want 2", acks)
+	}
+	if err := <-errc; err == nil {
+		t.Errorf("error expected")
+	}
+}
+
+func TestTransferState(t *testing.T) {
+	p := newRawPeer(t)
+	defer p.close()
+	c, err := NewClient(localSystem(p.conn))
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	c.SetTimeout(100 * time.Millisecond)
+	c.SetBackoff(func(int) time.Duration { return 0 })
+	tr := c.GetAsync("paused", "octet", ioutil.Discard)
+
+	_, addr := p.receive() // RRQ
+	for block := uint16(1); block <= 3; block++ {
+		p.send(NewDATA(block, make([]byte, blockLength)).Pack(), addr)
+		p.receive()
+	}
+	// The server pauses, the client retransmits ACK 3.
+	p.receive()
+	if b := tr.CurrentBlock(); b != 4 {
+		t.Errorf("current block %d, want 4", b)
+	}
+	if n := tr.Retransmits(); n < 1 {
+		t.Errorf("retransmits %d, want at least 1", n)
+	}
+	tr.Abort()
+	if err := tr.Wait(); !errors.Is(err, context.Canceled) {
+		t.Errorf("Wait returned %v", err)
+	}
+}
+
+func TestPackageDefaults(t *testing.T) {
+	defer func(timeout time.Duration, retries int) {
+		DefaultTimeout, DefaultRetries = timeout, retries
+	}(DefaultTimeout, DefaultRetries)
+	DefaultTimeout = 2 * time.Second
+	DefaultRetries = 9
+
+	c, err := NewClient("127.0.0.1:69")
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	if c.Timeout() != 2*time.Second || c.Retries() != 9 {
+		t.Errorf("client defaults %v, %d, want 2s, 9", c.Timeout(), c.Retries())
+	}
+	c.SetTimeout(time.Second)
+	c.SetRetries(3)
+	if c.Timeout() != time.Second || c.Retries() != 3 {
+		t.Errorf("client overrides %v, %d, want 1s, 3", c.Timeout(), c.Retries())
+	}
+	c.SetTimeout(0)
+	if c.Timeout() != 2*time.Second {
+		t.Errorf("client timeout reset to %v, want 2s", c.Timeout())
+	}
+	s := NewServer(nil, nil)
+	if s.timeout != 2*time.Second || s.retries != 9 {
+		t.Errorf("server defaults %v, %d, want 2s, 9", s.timeout, s.retries)
+	}
+}
+
+func TestEmptyMode(t *testing.T) {
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		_, err := rf.ReadFrom(strings.NewReader("hello"))
+		return err
+	}, nil)
+	s.SetTimeout(500 * time.Millisecond)
+	s.SetRetries(1)
+	_, serverAddr := startTestServer(t, s)
+
+	p := newRawPeer(t)
+	defer p.close()
+	req := make([]byte, datagramLength)
+	n := packRQ(req, opRRQ, "file", "", nil)
+	p.send(req[:n], serverAddr)
+	d, tid := p.expectDATA(1)
+	if string(d[4:]) != "hello" {
+		t.Fatalf("DATA of hello expected, got %q", d[4:])
+	}
+	p.send(NewACK(1).Pack(), tid)
+
+	q := newRawPeer(t)
+	defer q.close()
+	n = packRQ(req, opRRQ, "file", "binary", nil)
+	q.send(req[:n], serverAddr)
+	q.expectError(codeIllegalOperation)
+}
+
+func TestGzip(t *testing.T) {
+	content := strings.Repeat("interface eth0\n\tmtu 1500\n", 1000)
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		rf.(OutgoingTransfer).SetSize(int64(len(content)))
+		_, err := rf.ReadFrom(strings.NewReader(content))
+		return err
+	}, nil)
+	c, _ := startTestServer(t, s)
+	c.RequestTSize(true)
+	c.RequestChecksum(true)
+
+	c.RequestGzip(true)
+	wt, err := c.Receive("config", "octet")
+	if err != nil {
+		t.Fatalf("requesting read: %v", err)
+	}
+	opts := wt.(NegotiatedOptions).Options()
+	if opts[optEncoding] != "gzip" {
+		t.Fatalf("x-encoding=gzip expected, got %v", opts)
+	}
+	if _, ok := opts["tsize"]; ok {
+		t.Errorf("tsize of uncompressed data is offered: %v", opts)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := wt.WriteTo(buf); err != nil {
+		t.Fatalf("receiving: %v", err)
+	}
+	if buf.Len() >= len(content) {
+		t.Errorf("%d bytes received for %d bytes file", buf.Len(), len(content))
+	}
+	zr, err := gzip.NewReader(buf)
+	if err != nil {
+		t.Fatalf("reading gzip header: %v", err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil || string(data) != content {
+		t.Errorf("inflated data mismatch: %v", err)
+	}
+
+	c.RequestGzip(false)
+	wt, err = c.Receive("config", "octet")
+	if err != nil {
+		t.Fatalf("requesting read: %v", err)
+	}
+	if v, ok := wt.(NegotiatedOptions).Options()[optEncoding]; ok {
+		t.Errorf("x-encoding=%s is not requested", v)
+	}
+	buf.Reset()
+	if _, err := wt.WriteTo(buf); err != nil || buf.String() != content {
+		t.Errorf("raw data expected: %v", err)
+	}
+}
+
+func TestGzipNetascii(t *testing.T) {
+	content := strings.Repeat("interface eth0\n\tmtu 1500\n", 1000)
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		_, err := rf.ReadFrom(strings.NewReader(content))
+		return err
+	}, nil)
+	c, _ := startTestServer(t, s)
+	c.RequestGzip(true)
+	wt, err := c.Receive("config", "netascii")
+	if err != nil {
+		t.Fatalf("requesting read: %v", err)
+	}
+	if v, ok := wt.(NegotiatedOptions).Options()[optEncoding]; ok {
+		t.Errorf("x-encoding=%s acknowledged for netascii", v)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := wt.WriteTo(buf); err != nil || buf.String() != content {
+		t.Errorf("netascii data mismatch: %v", err)
+	}
+}
+
+func TestExactBlockMultiple(t *testing.T) {
+	for _, size := range []int{512, 1024} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			content := make([]byte, size)
+			rand.Read(content)
+			results := make(chan error, 2)
+			var written []byte
+			s := NewServer(func(filename string, rf io.ReaderFrom) error {
+				_, err := rf.ReadFrom(bytes.NewReader(content))
+				results <- err
+				return err
+			}, func(filename string, wt io.WriterTo) error {
+				buf := &bytes.Buffer{}
+				_, err := wt.WriteTo(buf)
+				written = buf.Bytes()
+				results <- err
+				return err
+			})
+			_, serverAddr := startTestServer(t, s)
+			blocks := uint16(size/512 + 1)
+			expectDone := func(op string) {
+				select {
+				case err := <-results:
+					if err != nil {
+						t.Errorf("%s handler: %v", op, err)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("%s handler did not return", op)
+				}
+			}
+
+			p := newRawPeer(t)
+			defer p.close()
+			req := make([]byte, datagramLength)
+			n := packRQ(req, opRRQ, "file", "octet", nil)
+			p.send(req[:n], serverAddr)
+			for b := uint16(1); b <= blocks; b++ {
+				d, addr := p.expectDATA(b)
+				if b == blocks && len(d) != 4 {
+					t.Fatalf("empty final DATA %d expected, got %d bytes", b, len(d)-4)
+				} else if b < blocks && len(d) != 4+512 {
+					t.Fatalf("full DATA %d expected, got %d bytes", b, len(d)-4)
+				}
+				p.send(NewACK(b).Pack(), addr)
+			}
+			expectDone("read")
+
+			q := newRawPeer(t)
+			defer q.close()
+			n = packRQ(req, opWRQ, "file", "octet", nil)
+			q.send(req[:n], serverAddr)
+			var tid *net.UDPAddr
+			for b := uint16(0); b <= blocks; b++ {
+				tid = q.expectACK(b)
+				if b < blocks {
+					off := int(b) * 512
+					end := off + 512
+					if end > size {
+						end = size
+					}
+					q.send(NewDATA(b+1, content[off:end]).Pack(), tid)
+				}
+			}
+			expectDone("write")
+			if !bytes.Equal(written, content) {
+				t.Errorf("%d bytes written, %d expected", len(written), size)
+			}
+		})
+	}
+}
+
+func TestDally(t *testing.T) {
+	for _, dally := range []time.Duration{0, time.Second} {
+		t.Run(dally.String(), func(t *testing.T) {
+			s := NewServer(nil, func(filename string, wt io.WriterTo) error {
+				_, err := wt.WriteTo(ioutil.Discard)
+				return err
+			})
+			s.SetDally(dally)
+			_, serverAddr := startTestServer(t, s)
+
+			p := newRawPeer(t)
+			defer p.close()
+			req := make([]byte, datagramLength)
+			n := packRQ(req, opWRQ, "upload", "octet", nil)
+			p.send(req[:n], serverAddr)
+			_, tid := p.receive()
+			for i := 0; i < 2; i++ {
+				p.send(NewDATA(1, []byte("hello")).Pack(), tid)
+				p.conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+				n, _, err := p.conn.ReadFromUDP(p.buf)
+				if i == 1 && dally == 0 {
+					if err == nil && n == 4 && binary.BigEndian.Uint16(p.buf) == opACK {
+						t.Errorf("unexpected ACK without dally")
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("ACK %d expected: %v", i, err)
+				} else if pkt, err := parsePacket(p.buf[:n]); err != nil {
+					t.Fatalf("parsing reply: %v", err)
+				} else if ack, ok := pkt.(pACK); !ok || ack.block() != 1 {
+					t.Fatalf("ACK 1 expected, got %v", p.buf[:n])
+				}
+			}
+		})
+	}
+}
+
+func TestClientDally(t *testing.T) {
+	p := newRawPeer(t)
+	defer p.close()
+	c, err := NewClient(localSystem(p.conn))
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	c.SetDally(time.Second)
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.GetFile("file", "octet", ioutil.Discard)
+		done <- err
+	}()
+	_, client := p.receive()
+	q := newRawPeer(t)
+	defer q.close()
+	for i := 0; i < 2; i++ {
+		q.send(NewDATA(1, []byte("hello")).Pack(), client)
+		q.expectACK(1)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("receiving: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("GetFile did not return after dally")
+	}
+}
+
+func TestSocketBuffers(t *testing.T) {
+	b := &testBackend{m: make(map[string][]byte)}
+	s := NewServer(b.handleRead, b.handleWrite)
+	s.SetReadBuffer(1 << 20)
+	s.SetWriteBuffer(1 << 20)
+	c, _ := startTestServer(t, s)
+	c.SetReadBuffer(1 << 20)
+	c.SetWriteBuffer(1 << 20)
+	testSendReceive(t, c, 10000)
+}
+
+func TestFilenameRewriter(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		mu.Lock()
+		seen = append(seen, filename)
+		mu.Unlock()
+		_, err := rf.ReadFrom(strings.NewReader(filename))
+		return err
+	}, nil)
+	s.SetFilenameRewriter(func(filename string, addr *net.UDPAddr) (string, error) {
+		switch filename {
+		case "pxelinux.0":
+			return "syslinux-6.04/pxelinux.0", nil
+		case "forbidden":
+			return "", errors.New("no such tenant")
+		case "missing":
+			return "", ErrFileNotFound
+		}
+		return filename, nil
+	})
+	var requested []string
+	s.SetOnRequest(func(op Op, filename string, addr *net.UDPAddr) {
+		mu.Lock()
+		requested = append(requested, filename)
+		mu.Unlock()
+	})
+	c, _ := startTestServer(t, s)
+
+	buf := &bytes.Buffer{}
+	if _, err := c.GetFile("pxelinux.0", "octet", buf); err != nil {
+		t.Fatalf("receiving: %v", err)
+	}
+	if buf.String() != "syslinux-6.04/pxelinux.0" {
+		t.Errorf("handler served %q", buf)
+	}
+	_, err := c.GetFile("forbidden", "octet", ioutil.Discard)
+	var e *TftpError
+	if !errors.As(err, &e) || e.Code != codeAccessViolation || e.Message != "no such tenant" {
+		t.Errorf("access violation expected, got %v", err)
+	}
+	_, err = c.GetFile("missing", "octet", ioutil.Discard)
+	if !errors.As(err, &e) || e.Code != codeFileNotFound {
+		t.Errorf("file not found expected, got %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 1 || seen[0] != "syslinux-6.04/pxelinux.0" {
+		t.Errorf("handler saw %v", seen)
+	}
+	// Rejected requests are reported too, with the original names.
+	if got := strings.Join(requested, " "); got != "pxelinux.0 forbidden missing" {
+		t.Errorf("requests reported: %s", got)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent writes of loggers.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestTransferLog(t *testing.T) {
+	logs := &syncBuffer{}
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		_, err := rf.ReadFrom(bytes.NewReader(make([]byte, 600)))
+		return err
+	}, nil)
+	s.SetLogger(log.New(logs, "tftp: ", 0))
+	s.SetTimeout(200 * time.Millisecond)
+	_, serverAddr := runTestServer(t, s)
+
+	p := newRawPeer(t)
+	defer p.close()
+	req := make([]byte, datagramLength)
+	n := packRQ(req, opRRQ, "file", "octet", nil)
+	p.send(req[:n], serverAddr)
+	_, tid := p.receive()
+	// Let the server retransmit block 1 before acknowledging it.
+	p.receive()
+	p.send(NewACK(1).Pack(), tid)
+	p.receive()
+	p.send(NewACK(2).Pack(), tid)
+	s.Shutdown()
+
+	prefix := fmt.Sprintf(":%d tid=%d: ", p.conn.LocalAddr().(*net.UDPAddr).Port, tid.Port)
+	for _, line := range []string{
+		prefix + "timeout waiting for ACK 1, retransmitting",
+		prefix + "sent 2 blocks, 600 bytes",
+	} {
+		if !strings.Contains(logs.String(), line+"\n") {
+			t.Errorf("%q is not logged:\n%s", line, logs)
+		}
+	}
+}
+
+func TestStrict(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict-%v", strict), func(t *testing.T) {
+			s := NewServer(func(filename string, rf io.ReaderFrom) error {
+				_, err := rf.ReadFrom(bytes.NewReader(make([]byte, 1000)))
+				return err
+			}, nil)
+			s.SetStrict(strict)
+			_, serverAddr := startTestServer(t, s)
+
+			// Unknown option
+			p := newRawPeer(t)
+			defer p.close()
+			req := make([]byte, datagramLength)
+			n := packRQ(req, opRRQ, "file", "octet", options{"x-unknown": "1"})
+			p.send(req[:n], serverAddr)
+			if strict {
+				p.expectError(codeBadOption)
+			} else {
+				_, addr := p.expectDATA(1)
+				p.send(NewACK(1).Pack(), addr)
+				p.expectDATA(2)
+				p.send(NewACK(2).Pack(), addr)
+			}
+
+			// DATA sent to a read transfer
+			p2 := newRawPeer(t)
+			defer p2.close()
+			n = packRQ(req, opRRQ, "file", "octet", nil)
+			p2.send(req[:n], serverAddr)
+			_, addr := p2.expectDATA(1)
+			p2.send(NewDATA(1, []byte("data")).Pack(), addr)
+			if strict {
+				p2.expectError(codeIllegalOperation)
+				return
+			}
+			p2.send(NewACK(1).Pack(), addr)
+			p2.expectDATA(2)
+			p2.send(NewACK(2).Pack(), addr)
+		})
+	}
+}
+
+func TestAppend(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enabled-%v", enabled), func(t *testing.T) {
+			appends := make(chan bool, 1)
+			s := NewServer(nil, func(filename string, wt io.WriterTo) error {
+				select {
+				case appends <- wt.(AppendRequest).Append():
+				default:
+				}
+				_, err := wt.WriteTo(ioutil.Discard)
+				return err
+			})
+			if enabled {
+				s.EnableAppend()
+			}
+			c, _ := startTestServer(t, s)
+			for _, opt := range []bool{false, true} {
+				c.RequestAppend(opt)
+				rf, err := c.Send("log", "octet")
+				if err != nil {
+					t.Fatalf("requesting write: %v", err)
+				}
+				acked := rf.(NegotiatedOptions).Options()[optAppend] == "1"
+				if _, err := rf.ReadFrom(strings.NewReader("line\n")); err != nil {
+					t.Fatalf("sending: %v", err)
+				}
+				want := enabled && opt
+				if got := <-appends; got != want {
+					t.Errorf("request with x-append %v: Append() = %v, want %v", opt, got, want)
+				}
+				if acked != want {
+					t.Errorf("request with x-append %v: acknowledged %v, want %v", opt, acked, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSenderPeerError(t *testing.T) {
+	for _, window := range []int{1, 2} {
+		t.Run(fmt.Sprintf("window-%d", window), func(t *testing.T) {
+			errs := make(chan error, 1)
+			s := NewServer(func(filename string, rf io.ReaderFrom) error {
+				_, err := rf.ReadFrom(bytes.NewReader(make([]byte, 5000)))
+				select {
+				case errs <- err:
+				default:
+				}
+				return err
+			}, nil)
+			s.SetTimeout(2 * time.Second)
+			_, serverAddr := startTestServer(t, s)
+
+			p := newRawPeer(t)
+			defer p.close()
+			var opts options
+			if window > 1 {
+				opts = options{"windowsize": strconv.Itoa(window)}
+			}
+			req := make([]byte, datagramLength)
+			n := packRQ(req, opRRQ, "file", "octet", opts)
+			p.send(req[:n], serverAddr)
+			var addr *net.UDPAddr
+			if window > 1 {
+				_, addr = p.expectOACK()
+				p.send(NewACK(0).Pack(), addr)
+			}
+			for block := uint16(1); block <= 2; block++ {
+				_, addr = p.expectDATA(block)
+				if window == 1 && block == 1 {
+					p.send(NewACK(1).Pack(), addr)
+				}
+			}
+			start := time.Now()
+			p.send((&ERROR{Code: CodeDiskFull, Message: "disk full"}).Pack(), addr)
+			select {
+			case err := <-errs:
+				if !errors.Is(err, ErrDiskFull) {
+					t.Errorf("ErrDiskFull expected, got %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("read handler did not return")
+			}
+			if d := time.Since(start); d >= time.Second {
+				t.Errorf("sender aborted after %v, expected it to stop right away", d)
+			}
+			p.conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+			if n, _, err := p.conn.ReadFromUDP(p.buf); err == nil {
+				t.Errorf("unexpected packet after ERROR: %v", p.buf[:n])
+			}
+		})
+	}
+}
+
+func TestRequestOptionLimits(t *testing.T) {
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		_, err := rf.ReadFrom(bytes.NewReader(make([]byte, 100)))
+		return err
+	}, nil)
+	_, serverAddr := startTestServer(t, s)
+	many := make(options)
+	for i := 0; i <= maxOptions; i++ {
+		many[fmt.Sprintf("x-opt%d", i)] = "1"
+	}
+	long := options{"blksize": strings.Repeat("1", maxOptionLength+1)}
+	for _, opts := range []options{many, long} {
+		p := newRawPeer(t)
+		req := make([]byte, datagramLength)
+		n := packRQ(req, opRRQ, "file", "octet", opts)
+		p.send(req[:n], serverAddr)
+		p.expectError(codeBadOption)
+		p.close()
+	}
+}
+
+func TestOACKOrder(t *testing.T) {
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		rf.(OutgoingTransfer).SetSize(100)
+		_, err := rf.ReadFrom(bytes.NewReader(make([]byte, 100)))
+		return err
+	}, nil)
+	_, serverAddr := startTestServer(t, s)
+	// Options are acknowledged in the order of the request, case
+	// insensitive names in lower case.
+	for _, tt := range []struct {
+		request string
+		want    string
+	}{
+		{"blksize\x001024\x00tsize\x000\x00timeout\x002\x00",
+			"\x00\x06blksize\x001024\x00tsize\x00100\x00timeout\x002\x00"},
+		{"timeout\x002\x00BLKSIZE\x001024\x00tsize\x000\x00",
+			"\x00\x06timeout\x002\x00blksize\x001024\x00tsize\x00100\x00"},
+		{"tsize\x000\x00x-unknown\x001\x00timeout\x002\x00blksize\x001024\x00",
+			"\x00\x06tsize\x00100\x00timeout\x002\x00blksize\x001024\x00"},
+	} {
+		for i := 0; i < 5; i++ {
+			p := newRawPeer(t)
+			p.send([]byte("\x00\x01file\x00octet\x00"+tt.request), serverAddr)
+			reply, addr := p.receive()
+			if string(reply) != tt.want {
+				t.Fatalf("OACK %q, want %q", reply, tt.want)
+			}
+			p.send((&ERROR{Message: "done"}).Pack(), addr)
+			p.close()
+		}
+	}
+}
+
+func TestInvalidBlockSize(t *testing.T) {
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		_, err := rf.ReadFrom(bytes.NewReader(make([]byte, 100)))
+		return err
+	}, nil)
+	c, serverAddr := startTestServer(t, s)
+	for _, blksize := range []string{"abc", "999999", "4"} {
+		p := newRawPeer(t)
+		req := make([]byte, datagramLength)
+		n := packRQ(req, opRRQ, "file", "octet", options{"blksize": blksize})
+		p.send(req[:n], serverAddr)
+		p.expectError(codeBadOption)
+		p.close()
+	}
+
+	c.SetBlockSize(999999)
+	_, err := c.GetFile("file", "octet", ioutil.Discard)
+	if !errors.Is(err, ErrBadOption) {
+		t.Fatalf("ErrBadOption expected, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "blksize") {
+		t.Errorf("error does not name the option: %v", err)
+	}
+}
+
+func TestHandlerPipeErrorCode(t *testing.T) {
+	exists := &TftpError{Code: codeFileExists, Message: "file already exists"}
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.Write(make([]byte, 1500))
+			pw.CloseWithError(exists)
+		}()
+		_, err := rf.ReadFrom(pr)
+		return err
+	}, func(filename string, wt io.WriterTo) error {
+		pr, pw := io.Pipe()
+		go func() {
+			pr.Read(make([]byte, 100))
+			pr.CloseWithError(exists)
+		}()
+		_, err := wt.WriteTo(pw)
+		return err
+	})
+	c, _ := startTestServer(t, s)
+	check := func(op string, err error) {
+		t.Helper()
+		var e *TftpError
+		if !errors.As(err, &e) {
+			t.Fatalf("%s: TftpError expected, got %v", op, err)
+		}
+		if e.Code != codeFileExists || e.Message != exists.Message {
+			t.Errorf("%s: code 6 %q expected, got %v", op, exists.Message, e)
+		}
+	}
+	_, err := c.GetFile("file", "octet", ioutil.Discard)
+	check("read", err)
+	_, err = c.PutFile("file", "octet", bytes.NewReader(make([]byte, 1500)))
+	check("write", err)
+}
+
+func TestDSCP(t *testing.T) {
+	const ef = 46 // expedited forwarding
+	b := &testBackend{m: make(map[string][]byte)}
+	s := NewServer(b.handleRead, b.handleWrite)
+	s.SetDSCP(ef)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatalf("listen UDP: %v", err)
+	}
+	c, _ := serveTestConn(t, s, conn)
+	c.SetDSCP(ef)
+	testSendReceive(t, c, 3000)
+
+	tc, err := ipv6.NewConn(conn).TrafficClass()
+	if err != nil {
+		t.Logf("traffic class not observable: %v", err)
+	} else if tc != ef<<2 {
+		t.Errorf("server socket traffic class %#x, want %#x", tc, ef<<2)
+	}
+	tconn, err := s.listenTransfer(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listening for transfer: %v", err)
+	}
+	if tos, err := ipv4.NewConn(tconn).TOS(); err != nil {
+		t.Logf("TOS not observable: %v", err)
+	} else if tos != ef<<2 {
+		t.Errorf("transfer socket TOS %#x, want %#x", tos, ef<<2)
+	}
+	tconn.Close()
+	s.Shutdown()
+
+	c.SetDSCP(64)
+	if _, err := c.Receive("file", "octet"); err == nil {
+		t.Errorf("error expected for DSCP out of range")
+	}
+}
+
+func TestNoResponse(t *testing.T) {
+	// A socket that swallows requests, like a firewall dropping them.
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatalf("listen UDP: %v", err)
+	}
+	defer conn.Close()
+	c, err := NewClient(localSystem(conn))
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	c.SetTimeout(100 * time.Millisecond)
+	c.SetRetries(3)
+	c.SetBackoff(func(int) time.Duration { return 10 * time.Millisecond })
+	// The first attempt and three retransmissions.
+	bound := 4*(100*time.Millisecond) + 3*(10*time.Millisecond)
+	for op, request := range map[string]func() error{
+		"WRQ": func() error {
+			_, err := c.PutFile("file", "octet", strings.NewReader("data"))
+			return err
+		},
+		"RRQ": func() error {
+			_, err := c.GetFile("file", "octet", ioutil.Discard)
+			return err
+		},
+	} {
+		start := time.Now()
+		err := request()
+		if d := time.Since(start); d > bound+500*time.Millisecond {
+			t.Errorf("%s: gave up after %v, expected about %v", op, d, bound)
+		}
+		if !errors.Is(err, ErrNoResponse) {
+			t.Fatalf("%s: ErrNoResponse expected, got %v", op, err)
+		}
+		if !strings.Contains(err.Error(), "no response to "+op) {
+			t.Errorf("%s: unexpected message: %v", op, err)
+		}
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			t.Errorf("%s: timeout expected: %v", op, err)
+		}
+	}
+}
+
+// windowShrinker shrinks the window of a transfer once n bytes are read.
+type windowShrinker struct {
+	r      io.Reader
+	n      int
+	wc     WindowControl
+	window int
+}
+
+func (w *windowShrinker) Read(p []byte) (int, error) {
+	k, err := w.r.Read(p)
+	w.n -= k
+	if w.n <= 0 && w.wc != nil {
+		w.wc.SetWindow(w.window)
+		w.wc = nil
+	}
+	return k, err
+}
+
+func TestSetWindow(t *testing.T) {
+	windows := make(chan int, 1)
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		wc := rf.(WindowControl)
+		r := &windowShrinker{r: bytes.NewReader(make([]byte, 512*30+100)), n: 512 * 9, wc: wc, window: 2}
+		_, err := rf.ReadFrom(r)
+		windows <- wc.Window()
+		return err
+	}, nil)
+	_, serverAddr := startTestServer(t, s)
+
+	p := newRawPeer(t)
+	defer p.close()
+	req := make([]byte, datagramLength)
+	n := packRQ(req, opRRQ, "file", "octet", options{"windowsize": "8"})
+	p.send(req[:n], serverAddr)
+	_, addr := p.expectOACK()
+	p.send(NewACK(0).Pack(), addr)
+	var sizes []int
+	last := 0
+	for last < 31 {
+		size := 0
+		for {
+			p.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			n, _, err := p.conn.ReadFromUDP(p.buf)
+			if err != nil {
+				break
+			}
+			p.checkDATA(p.buf[:n], uint16(last+size+1))
+			size++
+		}
+		if size == 0 {
+			t.Fatalf("no window after block %d", last)
+		}
+		sizes = append(sizes, size)
+		last += size
+		p.send(NewACK(uint16(last)).Pack(), addr)
+	}
+	if sizes[0] != 8 {
+		t.Errorf("first window of %d blocks, want 8", sizes[0])
+	}
+	for i, size := range sizes[2:] {
+		if size > 2 {
+			t.Errorf("window %d of %d blocks after SetWindow(2): %v", i+3, size, sizes)
+		}
+	}
+	if w := <-windows; w != 2 {
+		t.Errorf("Window() = %d after SetWindow(2)", w)
+	}
+}
+
+func TestTransferSetWindow(t *testing.T) {
+	p := newRawPeer(t)
+	defer p.close()
+	c, err := NewClient(localSystem(p.conn))
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	c.SetWindowSize(8)
+	tr := c.PutAsync("file", "octet", bytes.NewReader(make([]byte, 512*30+100)))
+	reply, addr := p.receive()
+	if pkt, err := parsePacket(reply); err != nil {
+		t.Fatalf("parsing request: %v", err)
+	} else if _, ok := pkt.(pWRQ); !ok {
+		t.Fatalf("WRQ expected, got %v", reply)
+	}
+	oack := make([]byte, datagramLength)
+	p.send(oack[:packOACK(oack, []Option{{Name: "windowsize", Value: "8"}})], addr)
+
+	// window reads the next window of DATA and acknowledges its last block.
+	last := 0
+	window := func() int {
+		size := 0
+		for {
+			p.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			n, _, err := p.conn.ReadFromUDP(p.buf)
+			if err != nil {
+				break
+			}
+			p.checkDATA(p.buf[:n], uint16(last+size+1))
+			size++
+		}
+		if size == 0 {
+			t.Fatalf("no window after block %d", last)
+		}
+		last += size
+		return size
+	}
+	if size := window(); size != 8 {
+		t.Errorf("first window of %d blocks, want 8", size)
+	}
+	if w := tr.Window(); w != 8 {
+		t.Errorf("Window() = %d, want 8", w)
+	}
+	tr.SetWindow(2)
+	p.send(NewACK(uint16(last)).Pack(), addr)
+	for last < 31 {
+		if size := window(); size > 2 {
+			t.Errorf("window of %d blocks after SetWindow(2)", size)
+		}
+		p.send(NewACK(uint16(last)).Pack(), addr)
+	}
+	if err := tr.Wait(); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	if w := tr.Window(); w != 2 {
+		t.Errorf("Window() = %d after SetWindow(2)", w)
+	}
+}
+
+func TestQueueDepth(t *testing.T) {
+	started := make(chan string, 3)
+	proceed := make(chan struct{})
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		started <- filename
+		if filename == "slow" {
+			<-proceed
+		}
+		_, err := rf.ReadFrom(strings.NewReader(filename))
+		return err
+	}, nil)
+	s.SetMaxConcurrent(1)
+	s.SetQueueDepth(1)
+	c, _ := startTestServer(t, s)
+
+	get := func(filename string, done chan<- error) {
+		buf := &bytes.Buffer{}
+		_, err := c.GetFile(filename, "octet", buf)
+		if err == nil && buf.String() != filename {
+			err = fmt.Errorf("received %q", buf.String())
+		}
+		done <- err
+	}
+	slow := make(chan error, 1)
+	go get("slow", slow)
+	if name := <-started; name != "slow" {
+		t.Fatalf("handler for %s started first", name)
+	}
+	queued := make(chan error, 1)
+	go get("queued", queued)
+	for i := 0; i < 100; i++ {
+		s.queueMu.Lock()
+		n := len(s.queued)
+		s.queueMu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The queue is full.
+	_, err := c.GetFile("rejected", "octet", ioutil.Discard)
+	var e *TftpError
+	if !errors.As(err, &e) || e.Code != codeNotDefined {
+		t.Errorf("ERROR(0) expected with a full queue, got %v", err)
+	}
+	select {
+	case name := <-started:
+		t.Fatalf("handler for %s started while the slot is taken", name)
+	default:
+	}
+
+	close(proceed)
+	if err := <-slow; err != nil {
+		t.Fatalf("slow transfer: %v", err)
+	}
+	select {
+	case err := <-queued:
+		if err != nil {
+			t.Fatalf("queued transfer: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("queued transfer did not run")
+	}
+	if name := <-started; name != "queued" {
+		t.Errorf("handler for %s started, want queued", name)
+	}
+}
+
+func TestQueueOrder(t *testing.T) {
+	s := NewServer(nil, nil)
+	s.SetMaxConcurrent(1)
+	s.SetQueueDepth(2)
+	addr := func(port int) *net.UDPAddr {
+		return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	}
+	admit := func(port int) *waiter {
+		t.Helper()
+		w, err := s.admit("RRQ", addr(port))
+		if err != nil {
+			t.Fatalf("request from port %d: %v", port, err)
+		}
+		return w
+	}
+	ready := func(w *waiter) bool {
+		select {
+		case <-w.ready:
+			return true
+		default:
+			return false
+		}
+	}
+	if w := admit(1); w != nil {
+		t.Fatal("first request queued")
+	}
+	first, second := admit(2), admit(3)
+	if first == nil || second == nil {
+		t.Fatal("requests over the limit not queued")
+	}
+
+	// The freed slot goes to the oldest queued request, and a request
+	// arriving then queues up behind the others.
+	s.release()
+	if !ready(first) || ready(second) {
+		t.Fatalf("slot not given to the oldest request")
+	}
+	third := admit(4)
+	if third == nil {
+		t.Fatal("new request took the slot ahead of the queue")
+	}
+	s.release()
+	if !ready(second) || ready(third) {
+		t.Fatalf("slot not given to the second request")
+	}
+	s.release()
+	if !ready(third) {
+		t.Fatalf("slot not given to the third request")
+	}
+}
+
+func TestSetNetwork(t *testing.T) {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	conn.Close()
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		_, err := rf.ReadFrom(strings.NewReader(filename))
+		return err
+	}, nil)
+	s.SetNetwork("udp4")
+	go s.ListenAndServe(":0")
+	var addr *net.UDPAddr
+	for i := 0; i < 100 && addr == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		addr = s.Addr()
+	}
+	if addr == nil {
+		t.Fatalf("server address is not available")
+	}
+	defer s.Shutdown()
+	if addr.IP.To4() == nil {
+		t.Errorf("IPv4 address expected, got %v", addr)
+	}
+	port := strconv.Itoa(addr.Port)
+
+	c, err := NewClient(net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := c.GetFile("hello", "octet", buf); err != nil || buf.String() != "hello" {
+		t.Errorf("receiving over IPv4: %v, %q", err, buf)
+	}
+
+	c, err = NewClient(net.JoinHostPort("::1", port))
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	c.SetTimeout(100 * time.Millisecond)
+	c.SetRetries(1)
+	if _, err := c.GetFile("hello", "octet", ioutil.Discard); err == nil {
+		t.Errorf("IPv6 client reached udp4 server")
+	}
+}
+
+func TestOnRetransmit(t *testing.T) {
+	type retransmit struct {
+		block   uint16
+		attempt int
+	}
+	retransmits := make(chan retransmit, 10)
+	onRetransmit := func(block uint16, attempt int) {
+		select {
+		case retransmits <- retransmit{block, attempt}:
+		default:
+		}
+	}
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		_, err := rf.ReadFrom(bytes.NewReader(make([]byte, 700)))
+		return err
+	}, nil)
+	s.SetTimeout(200 * time.Millisecond)
+	s.SetBackoff(func(int) time.Duration { return 0 })
+	s.SetOnRetransmit(onRetransmit)
+	_, serverAddr := startTestServer(t, s)
+
+	// The ACK of block 1 is lost, the server sends it again.
+	p := newRawPeer(t)
+	defer p.close()
+	req := make([]byte, datagramLength)
+	n := packRQ(req, opRRQ, "file", "octet", nil)
+	p.send(req[:n], serverAddr)
+	p.expectDATA(1)
+	_, addr := p.expectDATA(1)
+	if r := <-retransmits; r != (retransmit{1, 1}) {
+		t.Errorf("retransmit %+v, want block 1 attempt 1", r)
+	}
+	p.send(NewACK(1).Pack(), addr)
+	p.receive()
+	p.send(NewACK(2).Pack(), addr)
+
+	// The client retransmits its request the server did not answer.
+	c, err := NewClient(p.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	c.SetTimeout(100 * time.Millisecond)
+	c.SetRetries(1)
+	c.SetBackoff(func(int) time.Duration { return 0 })
+	c.SetOnRetransmit(onRetransmit)
+	c.GetFile("file", "octet", ioutil.Discard)
+	select {
+	case r := <-retransmits:
+		if r != (retransmit{1, 1}) {
+			t.Errorf("client retransmit %+v, want block 1 attempt 1", r)
+		}
+	default:
+		t.Errorf("client retransmit not reported")
+	}
+}
+
+func TestProbe(t *testing.T) {
+	s, c := makeTestServer(false)
+	defer s.Shutdown()
+	c.SetTimeout(time.Second)
+	c.SetRetries(1)
+	data := make([]byte, 3000)
+	if _, err := c.PutFile("probe", "octet", bytes.NewReader(data)); err != nil {
+		t.Fatalf("uploading file: %v", err)
+	}
+	tsize, err := c.Probe("probe", "octet")
+	if err != nil {
+		t.Fatalf("probing file: %v", err)
+	}
+	if tsize != int64(len(data)) {
+		t.Errorf("tsize %d, want %d", tsize, len(data))
+	}
+	// The server sees the probe cancelled and the file can still be read.
+	buf := &bytes.Buffer{}
+	if _, err := c.GetFile("probe", "octet", buf); err != nil || buf.Len() != len(data) {
+		t.Errorf("downloading probed file: %d bytes, %v", buf.Len(), err)
+	}
+	if _, err := c.Probe("missing", "octet"); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("probing missing file: ErrFileNotFound expected, got %v", err)
+	}
+}
+
+// reservePorts binds n consecutive UDP ports of network and returns the
+// sockets holding them, the first one bound to the lowest port.
+func reservePorts(t *testing.T, network string, n int) []*net.UDPConn {
+	t.Helper()
+	for attempt := 0; attempt < 100; attempt++ {
+		first, err := net.ListenUDP(network, &net.UDPAddr{})
+		if err != nil {
+			t.Fatalf("listen UDP: %v", err)
+		}
+		conns := []*net.UDPConn{first}
+		port := first.LocalAddr().(*net.UDPAddr).Port
+		for i := 1; i < n && port+i <= 65535; i++ {
+			conn, err := net.ListenUDP(network, &net.UDPAddr{Port: port + i})
+			if err != nil {
+				break
+			}
+			conns = append(conns, conn)
+		}
+		if len(conns) == n {
+			return conns
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	t.Fatalf("no %d consecutive free ports", n)
+	return nil
+}
+
+func TestPortRange(t *testing.T) {
+	local, err := net.ResolveUDPAddr("udp", net.JoinHostPort(localhost, "0"))
+	if err != nil {
+		t.Fatalf("resolving %s: %v", localhost, err)
+	}
+	network := udpNetwork(local)
+	held := reservePorts(t, network, 2)
+	min := held[0].LocalAddr().(*net.UDPAddr).Port
+	max := min + 1
+	for _, conn := range held {
+		conn.Close()
+	}
+	b := &testBackend{m: make(map[string][]byte)}
+	s := NewServer(b.handleRead, b.handleWrite)
+	s.SetPortRange(min, max)
+	c, _ := startTestServer(t, s)
+	c.SetPortRange(min, max)
+	c.SetTimeout(time.Second)
+	c.SetRetries(1)
+
+	// The client socket and the transfer socket of the server take one
+	// port each.
+	sess, err := c.NewSession()
+	if err != nil {
+		t.Fatalf("opening session: %v", err)
+	}
+	port := sess.LocalAddr().Port
+	if port < min || port > max {
+		t.Errorf("client port %d outside of %d-%d", port, min, max)
+	}
+	if _, err := sess.PutFile("range", "octet", bytes.NewReader(make([]byte, 100))); err != nil {
+		t.Fatalf("uploading file: %v", err)
+	}
+	serverPort := sess.last.Port
+	sess.Close()
+	if serverPort < min || serverPort > max || serverPort == port {
+		t.Errorf("server port %d, want the other port of %d-%d", serverPort, min, max)
+	}
+
+	// Both ports in use.
+	held = held[:0]
+	for p := min; p <= max; p++ {
+		conn, err := net.ListenUDP(network, &net.UDPAddr{Port: p})
+		if err != nil {
+			t.Fatalf("binding port %d: %v", p, err)
+		}
+		held = append(held, conn)
+	}
+	defer func() {
+		for _, conn := range held {
+			conn.Close()
+		}
+	}()
+	if _, err := c.GetFile("range", "octet", ioutil.Discard); !errors.Is(err, ErrPortRangeExhausted) {
+		t.Errorf("client: ErrPortRangeExhausted expected, got %v", err)
+	}
+	c.SetPortRange(0, 0)
+	var perr *TftpError
+	if _, err := c.GetFile("range", "octet", ioutil.Discard); !errors.As(err, &perr) || perr.Message != "server busy" {
+		t.Errorf("server: busy error expected, got %v", err)
+	}
+}
+
+func TestPortRangeAddrError(t *testing.T) {
+	// An address not assigned to the host fails for every port alike.
+	laddr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1")}
+	_, err := listenUDP("udp4", laddr, 40000, 40009)
+	if err == nil {
+		t.Fatal("error expected for address not of the host")
+	}
+	if errors.Is(err, ErrPortRangeExhausted) {
+		t.Errorf("address error reported as exhausted range: %v", err)
+	}
+}
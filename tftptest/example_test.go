@@ -0,0 +1,26 @@
+package tftptest_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/pin/tftp/tftptest"
+)
+
+func ExampleNewServer() {
+	s := tftptest.NewServer(func(filename string, rf io.ReaderFrom) error {
+		_, err := rf.ReadFrom(strings.NewReader("hello, " + filename))
+		return err
+	}, nil)
+	defer s.Close()
+
+	buf := &bytes.Buffer{}
+	if _, err := s.Client().GetFile("world", "octet", buf); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(buf)
+	// Output: hello, world
+}
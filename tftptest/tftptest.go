@@ -0,0 +1,89 @@
+// Package tftptest provides utilities for testing code that uses the tftp
+// package, in the spirit of net/http/httptest.
+package tftptest
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pin/tftp"
+)
+
+// Server is a TFTP server listening on an ephemeral port of the loopback
+// interface.
+type Server struct {
+	// Addr is the address of the server in host:port form, suitable
+	// for tftp.NewClient.
+	Addr string
+
+	// Server is the underlying server. It may be configured between
+	// NewUnstartedServer and Start.
+	Server *tftp.Server
+
+	conn *net.UDPConn
+	done chan error
+}
+
+// NewServer starts and returns a new Server with the handlers provided.
+// Either handler may be nil to disable the respective operation. The
+// caller should call Close when finished to shut it down.
+func NewServer(readHandler tftp.ReadHandler, writeHandler tftp.WriteHandler) *Server {
+	s := NewUnstartedServer(readHandler, writeHandler)
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a new Server that is bound to its address but
+// does not serve requests yet. The caller should call Start when done
+// configuring it and Close when finished.
+func NewUnstartedServer(readHandler tftp.ReadHandler, writeHandler tftp.WriteHandler) *Server {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		panic(fmt.Sprintf("tftptest: failed to listen on a port: %v", err))
+	}
+	return &Server{
+		Addr:   conn.LocalAddr().String(),
+		Server: tftp.NewServer(readHandler, writeHandler),
+		conn:   conn,
+	}
+}
+
+// Start starts serving requests.
+func (s *Server) Start() {
+	if s.done != nil {
+		panic("tftptest: server already started")
+	}
+	s.done = make(chan error, 1)
+	go func() {
+		s.done <- s.Server.Serve(s.conn)
+	}()
+	// Shutdown requires Serve to be running.
+	for s.Server.Addr() == nil {
+		select {
+		case err := <-s.done:
+			panic(fmt.Sprintf("tftptest: serving: %v", err))
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// Client returns a client for the server.
+func (s *Server) Client() *tftp.Client {
+	c, err := tftp.NewClient(s.Addr)
+	if err != nil {
+		panic(fmt.Sprintf("tftptest: creating client: %v", err))
+	}
+	return c
+}
+
+// Close shuts down the server and blocks until all outstanding transfers
+// have completed.
+func (s *Server) Close() {
+	if s.done == nil {
+		s.conn.Close()
+		return
+	}
+	s.Server.Shutdown()
+	<-s.done
+}
@@ -0,0 +1,47 @@
+package tftptest
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	files := map[string]string{}
+	s := NewServer(func(filename string, rf io.ReaderFrom) error {
+		_, err := rf.ReadFrom(strings.NewReader(files[filename]))
+		return err
+	}, func(filename string, wt io.WriterTo) error {
+		buf := &bytes.Buffer{}
+		_, err := wt.WriteTo(buf)
+		files[filename] = buf.String()
+		return err
+	})
+	c := s.Client()
+	if _, err := c.PutFile("f", "octet", strings.NewReader("data")); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := c.GetFile("f", "octet", buf); err != nil || buf.String() != "data" {
+		t.Errorf("get: %v, %q", err, buf)
+	}
+	s.Close()
+}
+
+func TestUnstartedServer(t *testing.T) {
+	s := NewUnstartedServer(func(filename string, rf io.ReaderFrom) error {
+		_, err := rf.ReadFrom(strings.NewReader(filename))
+		return err
+	}, nil)
+	s.Server.SetBlockSize(1024)
+	s.Start()
+	defer s.Close()
+	c := s.Client()
+	c.SetBlockSize(1024)
+	buf := &bytes.Buffer{}
+	if _, err := c.GetFile("name", "octet", buf); err != nil || buf.String() != "name" {
+		t.Errorf("get: %v, %q", err, buf)
+	}
+	NewUnstartedServer(nil, nil).Close()
+}